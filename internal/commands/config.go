@@ -0,0 +1,57 @@
+package commands
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/open-uem/openuem-worker/internal/common"
+	"github.com/urfave/cli/v2"
+)
+
+func Config() *cli.Command {
+	return &cli.Command{
+		Name:  "config",
+		Usage: "Inspect the worker's configuration",
+		Subcommands: []*cli.Command{
+			{
+				Name:   "print",
+				Usage:  "Print the effective configuration as YAML after reading the config files, the env vars and the flags, secrets are redacted",
+				Action: printConfig,
+				Flags: append(StartWorkersFlags(),
+					&cli.BoolFlag{
+						Name:  "sources",
+						Usage: "add a comment to each setting telling where its value comes from",
+					},
+				),
+			},
+		},
+	}
+}
+
+func printConfig(cCtx *cli.Context) error {
+	roles, err := common.ParseRoles(cCtx.StringSlice("roles"))
+	if err != nil {
+		return err
+	}
+
+	opts := common.ConfigOptions{Role: strings.Join(roles, ","), Flags: cCtx}
+	config, sources, loadErr := common.LoadConfig(opts)
+	if config == nil {
+		return loadErr
+	}
+
+	data, err := common.FormatConfig(config, sources, opts, cCtx.Bool("sources"))
+	if err != nil {
+		return fmt.Errorf("could not format the configuration, reason: %v", err)
+	}
+	fmt.Print(string(data))
+
+	// the settings are printed even if some of them aren't valid so they can be fixed
+	if loadErr != nil {
+		fmt.Fprintf(os.Stderr, "\nthe configuration is not valid:\n%v\n", loadErr)
+		return cli.Exit("", 1)
+	}
+
+	return nil
+}
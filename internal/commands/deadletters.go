@@ -0,0 +1,323 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/open-uem/openuem-worker/internal/common"
+	"github.com/urfave/cli/v2"
+)
+
+func DeadLetters() *cli.Command {
+	return &cli.Command{
+		Name:  "deadletters",
+		Usage: "Manage the messages that failed permanently",
+		Subcommands: []*cli.Command{
+			{
+				Name:   "list",
+				Usage:  "List the dead-lettered messages",
+				Action: listDeadLetters,
+				Flags: append(NATSFlags(),
+					&cli.StringFlag{
+						Name:  "subject",
+						Usage: "only list the messages received on this subject, wildcards are allowed e.g (ingest.*)",
+					},
+					&cli.IntFlag{
+						Name:  "limit",
+						Value: 100,
+						Usage: "the max number of messages to list",
+					},
+				),
+			},
+			{
+				Name:      "inspect",
+				Usage:     "Show the headers and the payload of a dead-lettered message",
+				ArgsUsage: "<sequence>",
+				Action:    inspectDeadLetter,
+				Flags:     NATSFlags(),
+			},
+			{
+				Name:   "purge",
+				Usage:  "Delete dead-lettered messages",
+				Action: purgeDeadLetters,
+				Flags: append(NATSFlags(),
+					&cli.StringFlag{
+						Name:  "subject",
+						Usage: "only delete the messages received on this subject, wildcards are allowed e.g (ingest.*)",
+					},
+					&cli.Uint64Flag{
+						Name:  "seq",
+						Usage: "only delete the message with this sequence",
+					},
+					&cli.BoolFlag{
+						Name:  "confirm",
+						Usage: "confirm that the messages must be deleted",
+					},
+				),
+			},
+			{
+				Name:      "replay",
+				Usage:     "Publish dead-lettered messages again to their original subject",
+				ArgsUsage: "[<sequence>...]",
+				Action:    replayDeadLetters,
+				Flags: append(NATSFlags(),
+					&cli.BoolFlag{
+						Name:  "all",
+						Usage: "replay all the dead-lettered messages",
+					},
+					&cli.StringFlag{
+						Name:  "subject",
+						Usage: "only replay the messages received on this subject, wildcards are allowed e.g (ingest.*)",
+					},
+					&cli.BoolFlag{
+						Name:  "keep",
+						Usage: "keep the messages in the dead-letter stream once they've been replayed",
+					},
+				),
+			},
+		},
+	}
+}
+
+func listDeadLetters(cCtx *cli.Context) error {
+	nc, stream, err := deadLetterStream(cCtx)
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+
+	msgs, err := readDeadLetters(cCtx.Context, stream, cCtx.String("subject"), cCtx.Int("limit"))
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SEQ\tTIME\tSUBJECT\tDELIVERED\tWORKER\tSIZE\tERROR")
+	for _, m := range msgs {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%d\t%s\n",
+			m.Sequence, m.Time.Format(time.RFC3339),
+			m.Header.Get(common.DeadLetterSubjectHeader),
+			m.Header.Get(common.DeadLetterDeliveredHeader),
+			m.Header.Get(common.DeadLetterWorkerHeader),
+			len(m.Data),
+			m.Header.Get(common.DeadLetterErrorHeader))
+	}
+	return tw.Flush()
+}
+
+func inspectDeadLetter(cCtx *cli.Context) error {
+	seq, err := strconv.ParseUint(cCtx.Args().First(), 10, 64)
+	if err != nil {
+		return fmt.Errorf("the sequence of the message is required")
+	}
+
+	nc, stream, err := deadLetterStream(cCtx)
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+
+	m, err := stream.GetMsg(cCtx.Context, seq)
+	if err != nil {
+		return fmt.Errorf("could not get the message %d, reason: %v", seq, err)
+	}
+
+	fmt.Printf("Sequence: %d\n", m.Sequence)
+	fmt.Printf("Subject: %s\n", m.Subject)
+	fmt.Printf("Time: %s\n", m.Time.Format(time.RFC3339))
+
+	fmt.Println("\nHeaders:")
+	keys := make([]string, 0, len(m.Header))
+	for k := range m.Header {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		for _, v := range m.Header[k] {
+			fmt.Printf("  %s: %s\n", k, v)
+		}
+	}
+
+	fmt.Println("\nPayload:")
+	var out bytes.Buffer
+	if err := json.Indent(&out, m.Data, "", "  "); err == nil {
+		fmt.Println(out.String())
+	} else {
+		fmt.Println(string(m.Data))
+	}
+
+	return nil
+}
+
+func purgeDeadLetters(cCtx *cli.Context) error {
+	if !cCtx.Bool("confirm") {
+		return fmt.Errorf("the dead-lettered messages can't be recovered once they've been purged, use --confirm to delete them")
+	}
+
+	nc, stream, err := deadLetterStream(cCtx)
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+
+	if seq := cCtx.Uint64("seq"); seq != 0 {
+		if err := stream.DeleteMsg(cCtx.Context, seq); err != nil {
+			return fmt.Errorf("could not delete the message %d, reason: %v", seq, err)
+		}
+		fmt.Printf("the message %d has been deleted\n", seq)
+		return nil
+	}
+
+	opts := []jetstream.StreamPurgeOpt{}
+	if subject := cCtx.String("subject"); subject != "" {
+		opts = append(opts, jetstream.WithPurgeSubject(common.DeadLetterSubjectPrefix+subject))
+	}
+
+	if err := stream.Purge(cCtx.Context, opts...); err != nil {
+		return fmt.Errorf("could not purge the dead-lettered messages, reason: %v", err)
+	}
+	fmt.Println("the dead-lettered messages have been purged")
+	return nil
+}
+
+func replayDeadLetters(cCtx *cli.Context) error {
+	if !cCtx.Bool("all") && cCtx.NArg() == 0 {
+		return fmt.Errorf("the sequence of the messages to replay or --all are required")
+	}
+
+	nc, stream, err := deadLetterStream(cCtx)
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+
+	var msgs []*jetstream.RawStreamMsg
+	if cCtx.Bool("all") {
+		msgs, err = readDeadLetters(cCtx.Context, stream, cCtx.String("subject"), 0)
+		if err != nil {
+			return err
+		}
+	} else {
+		for _, arg := range cCtx.Args().Slice() {
+			seq, err := strconv.ParseUint(arg, 10, 64)
+			if err != nil {
+				return fmt.Errorf("%q is not a valid sequence", arg)
+			}
+			m, err := stream.GetMsg(cCtx.Context, seq)
+			if err != nil {
+				return fmt.Errorf("could not get the message %d, reason: %v", seq, err)
+			}
+			msgs = append(msgs, m)
+		}
+	}
+
+	replayed := 0
+	for _, m := range msgs {
+		ctx, cancel := context.WithTimeout(cCtx.Context, 10*time.Second)
+		subject, err := common.ReplayDeadLetter(ctx, nc, m)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("could not replay the message %d, %d messages have been replayed, reason: %v", m.Sequence, replayed, err)
+		}
+		replayed++
+		fmt.Printf("the message %d has been published to %s\n", m.Sequence, subject)
+
+		if cCtx.Bool("keep") {
+			continue
+		}
+		if err := stream.DeleteMsg(cCtx.Context, m.Sequence); err != nil {
+			return fmt.Errorf("the message %d has been replayed but it could not be deleted, reason: %v", m.Sequence, err)
+		}
+	}
+
+	fmt.Printf("%d messages have been replayed\n", replayed)
+	return nil
+}
+
+func deadLetterStream(cCtx *cli.Context) (*nats.Conn, jetstream.Stream, error) {
+	nc, err := connectNATS(cCtx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	js, err := jetstream.New(nc)
+	if err != nil {
+		nc.Close()
+		return nil, nil, fmt.Errorf("could not create the JetStream context, reason: %v", err)
+	}
+
+	stream, err := js.Stream(cCtx.Context, common.DeadLetterStream)
+	if err != nil {
+		nc.Close()
+		if errors.Is(err, jetstream.ErrStreamNotFound) {
+			return nil, nil, fmt.Errorf("no message has been dead-lettered yet")
+		}
+		return nil, nil, fmt.Errorf("could not get the %s stream, reason: %v", common.DeadLetterStream, err)
+	}
+
+	return nc, stream, nil
+}
+
+// readDeadLetters returns the dead-lettered messages received on subject, oldest first, limit 0 returns all of them
+func readDeadLetters(ctx context.Context, stream jetstream.Stream, subject string, limit int) ([]*jetstream.RawStreamMsg, error) {
+	info, err := stream.Info(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not get the %s stream info, reason: %v", common.DeadLetterStream, err)
+	}
+
+	msgs := []*jetstream.RawStreamMsg{}
+	if info.State.Msgs == 0 {
+		return msgs, nil
+	}
+
+	for seq := info.State.FirstSeq; seq <= info.State.LastSeq; seq++ {
+		if limit > 0 && len(msgs) >= limit {
+			break
+		}
+
+		m, err := stream.GetMsg(ctx, seq)
+		if err != nil {
+			if errors.Is(err, jetstream.ErrMsgNotFound) {
+				continue
+			}
+			return nil, fmt.Errorf("could not get the message %d, reason: %v", seq, err)
+		}
+
+		if subject != "" && !common.SubjectMatches(subject, strings.TrimPrefix(m.Subject, common.DeadLetterSubjectPrefix)) {
+			continue
+		}
+		msgs = append(msgs, m)
+	}
+
+	return msgs, nil
+}
+
+func connectNATS(cCtx *cli.Context) (*nats.Conn, error) {
+	config, _, err := common.LoadConfig(common.ConfigOptions{
+		Flags: cCtx,
+		Keys:  []string{"nats-servers", "cacert", "cert", "key"},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	nc, err := nats.Connect(config.NATSServers,
+		nats.RootCAs(config.CACertPath),
+		nats.ClientCert(config.ClientCertPath, config.ClientKeyPath),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to NATS server, reason: %v", err)
+	}
+	return nc, nil
+}
@@ -1,10 +1,16 @@
 package commands
 
 import (
+	"context"
 	"database/sql"
-	"log"
+	"fmt"
+	"log/slog"
 	"os"
+	"slices"
+	"strings"
+	"time"
 
+	_ "github.com/jackc/pgx/v5/stdlib"
 	"github.com/nats-io/nats.go"
 	"github.com/open-uem/openuem-worker/internal/common"
 	"github.com/urfave/cli/v2"
@@ -15,34 +21,107 @@ func HealthCheck() *cli.Command {
 		Name:   "healthcheck",
 		Usage:  "Check the health of the worker",
 		Action: healtCheck,
-		Flags:  CommonFlags(),
+		Flags:  append(CommonFlags(), HealthCheckFlags()...),
+	}
+}
+
+func HealthCheckFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    "worker",
+			Usage:   "the worker to check (agent-worker, cert-manager-worker or notification-worker), the ping request is skipped if empty",
+			EnvVars: []string{"WORKER"},
+		},
+		&cli.DurationFlag{
+			Name:    "timeout",
+			Value:   5 * time.Second,
+			Usage:   "the maximum time each check can take",
+			EnvVars: []string{"HEALTHCHECK_TIMEOUT"},
+		},
 	}
 }
 
 func healtCheck(cCtx *cli.Context) error {
 	worker := common.NewWorker("")
 
+	role := cCtx.String("worker")
+	if role != "" {
+		if _, ok := common.PingSubjects[role]; !ok {
+			roles := []string{}
+			for r := range common.PingSubjects {
+				roles = append(roles, r)
+			}
+			slices.Sort(roles)
+			slog.Error("unknown worker", "worker", role, "valid", strings.Join(roles, ", "))
+			os.Exit(1)
+		}
+	}
+
+	// The role selects the worker's certificate in the config file
+	worker.Role = role
+
 	// Get CLI flags values
 	if err := worker.CheckCLICommonRequisites(cCtx); err != nil {
-		log.Printf("[ERROR]: could not check requisites, reason: %v", err)
+		slog.Error("could not check requisites", "error", err)
 		os.Exit(1)
 	}
+	timeout := cCtx.Duration("timeout")
 
-	// Check if we can connect with the NATS service
-	nc, err := nats.Connect(worker.NATSServers, nats.RootCAs(worker.CACertPath), nats.ClientCert(worker.ClientCertPath, worker.ClientKeyPath))
-	if err != nil {
-		log.Printf("[ERROR]: could not connect to NATS server, reason: %v", err)
+	// Check that the certificates haven't expired
+	for _, path := range []string{worker.CACertPath, worker.ClientCertPath} {
+		if err := common.CheckCertificateExpiry(path); err != nil {
+			slog.Error("certificate is not valid", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	// Check if the database answers
+	if err := checkDatabase(worker.DBUrl, timeout); err != nil {
+		slog.Error("could not ping the database", "error", err)
 		os.Exit(1)
 	}
-	nc.Close()
 
-	// Check if we can connect with the database
-	db, err := sql.Open("pgx", worker.DBUrl)
-	if err != nil {
-		log.Printf("[ERROR]: could not connect to database, reason: %v", err)
+	// Check if we can connect with the NATS service and a worker replies to its ping subject
+	if err := checkNATS(worker, role, timeout); err != nil {
+		slog.Error("NATS check failed", "error", err)
 		os.Exit(1)
 	}
-	db.Close()
+
+	slog.Info("the worker is healthy", "worker", role)
+	return nil
+}
+
+func checkDatabase(dbUrl string, timeout time.Duration) error {
+	db, err := sql.Open("pgx", dbUrl)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	return db.PingContext(ctx)
+}
+
+func checkNATS(w *common.Worker, role string, timeout time.Duration) error {
+	nc, err := nats.Connect(w.NATSServers,
+		nats.RootCAs(w.CACertPath),
+		nats.ClientCert(w.ClientCertPath, w.ClientKeyPath),
+		nats.Timeout(timeout),
+	)
+	if err != nil {
+		return fmt.Errorf("could not connect to NATS server: %v", err)
+	}
+	defer nc.Close()
+
+	if role == "" {
+		return nil
+	}
+
+	if _, err := nc.Request(common.PingSubjects[role], nil, timeout); err != nil {
+		return fmt.Errorf("no %s replied to %s: %v", role, common.PingSubjects[role], err)
+	}
 
 	return nil
 }
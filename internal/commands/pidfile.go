@@ -0,0 +1,267 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// DefaultPIDFile returns the PID file of a role in the working directory, each
+// role has its own file so they can be started from the same directory
+func DefaultPIDFile(role string) string {
+	return "openuem-" + role + ".pid"
+}
+
+// PIDFileFlag is read from an env var of the role e.g (AGENT_WORKER_PIDFILE) so
+// the workers of different roles can share their environment
+func PIDFileFlag(role string) cli.Flag {
+	return &cli.StringFlag{
+		Name:    "pidfile",
+		Value:   DefaultPIDFile(role),
+		Usage:   "the path to the file where the worker's process ID is written",
+		EnvVars: []string{strings.ToUpper(strings.ReplaceAll(role, "-", "_")) + "_PIDFILE"},
+	}
+}
+
+func StopFlags(role string) []cli.Flag {
+	return []cli.Flag{
+		PIDFileFlag(role),
+		&cli.BoolFlag{
+			Name:  "wait",
+			Usage: "wait until the worker's process has exited",
+		},
+		waitTimeoutFlag(),
+	}
+}
+
+func waitTimeoutFlag() cli.Flag {
+	return &cli.DurationFlag{
+		Name:  "wait-timeout",
+		Value: 2 * time.Minute,
+		Usage: "the maximum time to wait for the worker's process to exit",
+	}
+}
+
+// workerCommands returns the start, stop, status and restart commands of a role
+func workerCommands(name, role string, start cli.ActionFunc, startFlags []cli.Flag) []*cli.Command {
+	startFlags = append(startFlags, PIDFileFlag(role))
+
+	return []*cli.Command{
+		{
+			Name:   "start",
+			Usage:  "Start an OpenUEM's " + name + " worker",
+			Action: start,
+			Flags:  startFlags,
+		},
+		{
+			Name:   "stop",
+			Usage:  "Stop an OpenUEM's " + name + " worker",
+			Action: stopWorker,
+			Flags:  StopFlags(role),
+		},
+		{
+			Name:   "status",
+			Usage:  "Show if an OpenUEM's " + name + " worker is running",
+			Action: workerStatus,
+			Flags:  []cli.Flag{PIDFileFlag(role)},
+		},
+		{
+			Name:  "restart",
+			Usage: "Stop the running OpenUEM's " + name + " worker and start it again in this process",
+			Action: func(cCtx *cli.Context) error {
+				if err := stopRunningWorker(cCtx.String("pidfile"), true, cCtx.Duration("wait-timeout")); err != nil && !errors.Is(err, errNotRunning) {
+					return err
+				}
+				return start(cCtx)
+			},
+			Flags: append(startFlags, waitTimeoutFlag()),
+		},
+	}
+}
+
+var errNotRunning = errors.New("the worker is not running")
+
+// pidFile is the content of a PID file, the start time of the process tells the worker
+// from an unrelated process that has got its PID after the worker exited
+type pidFile struct {
+	pid       int
+	startTime string
+}
+
+// running reports if the worker's process is still running, the start time isn't
+// checked if it's unknown e.g (PID files written by older versions)
+func (p pidFile) running() bool {
+	if !processRunning(p.pid) {
+		return false
+	}
+	if p.startTime == "" {
+		return true
+	}
+
+	startTime, err := processStartTime(p.pid)
+	if err != nil {
+		return true
+	}
+	return startTime == p.startTime
+}
+
+// writePIDFile writes the PID of this process, the file can only be written by its owner.
+// A PID file left by a worker that is no longer running is replaced
+func writePIDFile(path string) error {
+	if p, err := readPIDFile(path); err == nil {
+		if p.running() {
+			return fmt.Errorf("a worker is already running with PID %d, PID file: %s", p.pid, path)
+		}
+		slog.Warn("removing stale PID file", "path", path, "pid", p.pid)
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		slog.Warn("removing invalid PID file", "path", path, "error", err)
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	// O_EXCL so two workers starting at the same time can't both own the file
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("could not create the PID file, reason: %v", err)
+	}
+	defer f.Close()
+
+	content := strconv.Itoa(os.Getpid())
+	if startTime, err := processStartTime(os.Getpid()); err == nil {
+		content += "\n" + startTime
+	} else {
+		slog.Debug("could not read the start time of the worker's process", "error", err)
+	}
+
+	if _, err := f.WriteString(content); err != nil {
+		return err
+	}
+	return nil
+}
+
+// removePIDFile removes the PID file if it still belongs to this process
+func removePIDFile(path string) {
+	if p, err := readPIDFile(path); err != nil || p.pid != os.Getpid() {
+		return
+	}
+	if err := os.Remove(path); err != nil {
+		slog.Error("could not remove the PID file", "path", path, "error", err)
+	}
+}
+
+// readPIDFile reads the PID and, in the second line, the start time of the process
+func readPIDFile(path string) (pidFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return pidFile{}, err
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 || len(fields) > 2 {
+		return pidFile{}, fmt.Errorf("could not parse the PID from %s", path)
+	}
+
+	pid, err := strconv.Atoi(fields[0])
+	if err != nil || pid <= 0 {
+		return pidFile{}, fmt.Errorf("could not parse the PID from %s", path)
+	}
+
+	p := pidFile{pid: pid}
+	if len(fields) == 2 {
+		p.startTime = fields[1]
+	}
+	return p, nil
+}
+
+// runningWorker returns the PID file of the worker if it's running
+func runningWorker(path string) (pidFile, error) {
+	p, err := readPIDFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return pidFile{}, errNotRunning
+	}
+	if err != nil {
+		return pidFile{}, err
+	}
+
+	if !p.running() {
+		return p, errNotRunning
+	}
+	return p, nil
+}
+
+func workerStatus(cCtx *cli.Context) error {
+	path := cCtx.String("pidfile")
+
+	p, err := runningWorker(path)
+	switch {
+	case errors.Is(err, errNotRunning) && p.pid != 0:
+		return cli.Exit(fmt.Sprintf("the worker is not running, the PID file %s is stale (PID %d)", path, p.pid), 1)
+	case errors.Is(err, errNotRunning):
+		return cli.Exit("the worker is not running", 3)
+	case err != nil:
+		return cli.Exit(err.Error(), 4)
+	}
+
+	fmt.Printf("the worker is running with PID %d\n", p.pid)
+	return nil
+}
+
+func stopRunningWorker(path string, wait bool, timeout time.Duration) error {
+	running, err := runningWorker(path)
+	pid := running.pid
+	if errors.Is(err, errNotRunning) && pid != 0 {
+		slog.Warn("the worker is not running, removing stale PID file", "path", path, "pid", pid)
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		return errNotRunning
+	}
+	if err != nil {
+		return err
+	}
+
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return fmt.Errorf("could not find process associated with worker")
+	}
+
+	if err := terminateProcess(p); err != nil {
+		return fmt.Errorf("could not terminate the process associated with the worker, reason: %v", err)
+	}
+
+	if !wait {
+		slog.Info("👋 Done! Your worker has been asked to stop", "pid", pid)
+		return nil
+	}
+
+	deadline := time.Now().Add(timeout)
+	for running.running() {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("the worker with PID %d is still running after %s", pid, timeout)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+
+	// the worker removes its PID file unless it has been killed
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	slog.Info("👋 Done! Your worker has stopped listening", "pid", pid)
+	return nil
+}
@@ -0,0 +1,44 @@
+//go:build !windows
+
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// processRunning reports if a process with the PID exists, EPERM means that it
+// exists but belongs to another user
+func processRunning(pid int) bool {
+	err := syscall.Kill(pid, syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+func terminateProcess(p *os.Process) error {
+	return p.Signal(os.Interrupt)
+}
+
+// processStartTime returns the start time of the process in clock ticks since boot, it's
+// read from /proc so it fails on the systems that don't have it
+func processStartTime(pid int) (string, error) {
+	data, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return "", err
+	}
+
+	// the command name is between parentheses and may contain spaces, the start
+	// time is the 22nd field and the 20th after the command name
+	i := strings.LastIndexByte(string(data), ')')
+	if i < 0 {
+		return "", fmt.Errorf("could not parse the status of the process %d", pid)
+	}
+	fields := strings.Fields(string(data[i+1:]))
+	if len(fields) < 20 {
+		return "", fmt.Errorf("could not parse the status of the process %d", pid)
+	}
+	return fields[19], nil
+}
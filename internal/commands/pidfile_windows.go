@@ -0,0 +1,47 @@
+//go:build windows
+
+package commands
+
+import (
+	"os"
+	"strconv"
+
+	"golang.org/x/sys/windows"
+)
+
+// stillActive is the exit code of a process that hasn't exited yet
+const stillActive = 259
+
+func processRunning(pid int) bool {
+	h, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return err == windows.ERROR_ACCESS_DENIED
+	}
+	defer windows.CloseHandle(h)
+
+	var code uint32
+	if err := windows.GetExitCodeProcess(h, &code); err != nil {
+		return false
+	}
+	return code == stillActive
+}
+
+// terminateProcess kills the process, Windows can't send an interrupt to another console process
+func terminateProcess(p *os.Process) error {
+	return p.Kill()
+}
+
+// processStartTime returns the creation time of the process in nanoseconds since the epoch
+func processStartTime(pid int) (string, error) {
+	h, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return "", err
+	}
+	defer windows.CloseHandle(h)
+
+	var creation, exit, kernel, user windows.Filetime
+	if err := windows.GetProcessTimes(h, &creation, &exit, &kernel, &user); err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(creation.Nanoseconds(), 10), nil
+}
@@ -0,0 +1,163 @@
+package commands
+
+import (
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+	"github.com/open-uem/openuem-worker/internal/common"
+	"github.com/urfave/cli/v2"
+)
+
+func Replay() *cli.Command {
+	return &cli.Command{
+		Name:      "replay",
+		Usage:     "Run the messages of capture files through the worker's handlers against a test database and compare the replies with the recorded ones",
+		ArgsUsage: "<capture file>...",
+		Action:    replayCapture,
+		Flags:     ReplayFlags(),
+	}
+}
+
+// ReplayFlags are the worker's flags but the database url, it must be set on the command
+// line so the messages are never replayed against the database of the config files
+func ReplayFlags() []cli.Flag {
+	flags := slices.DeleteFunc(StartWorkersFlags(), func(f cli.Flag) bool {
+		return slices.Contains(f.Names(), "dburl")
+	})
+
+	return append(flags,
+		&cli.StringFlag{
+			Name:     "dburl",
+			Required: true,
+			Usage:    "the Postgres connection url of the test database the messages are replayed against, DATABASE_URL and the config files are ignored",
+		},
+		&cli.StringSliceFlag{
+			Name:  "agent",
+			Usage: "only replay the messages of these agents",
+		},
+		&cli.StringSliceFlag{
+			Name:  "subject",
+			Usage: "only replay the messages received on these subjects, wildcards are allowed e.g (wingetcfg.*)",
+		},
+	)
+}
+
+func replayCapture(cCtx *cli.Context) error {
+	if cCtx.NArg() == 0 {
+		return fmt.Errorf("at least one capture file is required")
+	}
+
+	roles, err := common.ParseRoles(cCtx.StringSlice("roles"))
+	if err != nil {
+		return err
+	}
+
+	worker := common.NewWorker("")
+	worker.Role = strings.Join(roles, ",")
+
+	if err := worker.CheckCLICommonRequisites(cCtx); err != nil {
+		slog.Error("could not generate config for replay", "error", err)
+		return err
+	}
+
+	if err := worker.StartReplay(); err != nil {
+		return err
+	}
+	defer worker.StopReplay()
+
+	filter := common.CaptureFilter{Agents: cCtx.StringSlice("agent"), Subjects: cCtx.StringSlice("subject")}
+	replayed, different, skipped := 0, 0, 0
+
+	for _, path := range cCtx.Args().Slice() {
+		err := common.ReadCaptureFile(path, func(record common.CaptureRecord) error {
+			if !filter.Matches(record.Subject, record.AgentID) {
+				return nil
+			}
+
+			replies, err := worker.Replay(record)
+			if err != nil {
+				skipped++
+				fmt.Printf("%s skipped: %v\n", recordName(record), err)
+				return nil
+			}
+			replayed++
+
+			if diff := diffReplies(record.Replies, replies); len(diff) > 0 {
+				different++
+				fmt.Printf("%s replies differ:\n", recordName(record))
+				for _, line := range diff {
+					fmt.Println("  " + line)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("%d messages replayed, %d with different replies, %d skipped\n", replayed, different, skipped)
+	if different > 0 {
+		return fmt.Errorf("%d replayed messages got different replies", different)
+	}
+	return nil
+}
+
+// recordName identifies a captured message in the replay output
+func recordName(r common.CaptureRecord) string {
+	name := r.Time.Format("2006-01-02T15:04:05.000Z07:00") + " " + r.Subject
+	if r.AgentID != "" {
+		name += " agent=" + r.AgentID
+	}
+	return name
+}
+
+// diffReplies compares the recorded and the replayed replies one by one, the lines
+// starting with - are the recorded replies and the ones starting with + the replayed ones
+func diffReplies(recorded, replayed []common.CapturedReply) []string {
+	diff := []string{}
+
+	for i := range max(len(recorded), len(replayed)) {
+		switch {
+		case i >= len(replayed):
+			diff = append(diff, fmt.Sprintf("- reply %d: %s", i+1, formatReply(recorded[i])))
+		case i >= len(recorded):
+			diff = append(diff, fmt.Sprintf("+ reply %d: %s", i+1, formatReply(replayed[i])))
+		case !recorded[i].Data.Equal(replayed[i].Data) || !equalHeaders(recorded[i].Header, replayed[i].Header):
+			diff = append(diff,
+				fmt.Sprintf("- reply %d: %s", i+1, formatReply(recorded[i])),
+				fmt.Sprintf("+ reply %d: %s", i+1, formatReply(replayed[i])),
+			)
+		}
+	}
+
+	return diff
+}
+
+func formatReply(r common.CapturedReply) string {
+	if len(r.Header) == 0 {
+		return r.Data.String()
+	}
+
+	headers := []string{}
+	for _, k := range slices.Sorted(maps.Keys(r.Header)) {
+		headers = append(headers, k+"="+strings.Join(r.Header[k], ","))
+	}
+	return "[" + strings.Join(headers, " ") + "] " + r.Data.String()
+}
+
+func equalHeaders(a, b nats.Header) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if !slices.Equal(v, b[k]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,107 @@
+package commands
+
+import (
+	"fmt"
+
+	"github.com/open-uem/openuem-worker/internal/common"
+	"github.com/open-uem/openuem-worker/internal/models"
+	"github.com/urfave/cli/v2"
+)
+
+// rotationProgressStep is the number of rows between the progress lines
+const rotationProgressStep = 100
+
+func Secrets() *cli.Command {
+	return &cli.Command{
+		Name:  "secrets",
+		Usage: "Manage the sensitive fields encrypted with the encryption master key",
+		Subcommands: []*cli.Command{
+			{
+				Name:   "rotate",
+				Usage:  "Encrypt again the sensitive fields with the active encryption master key, the retired keys must be set to decrypt the old values",
+				Action: rotateSecrets,
+				Flags:  SecretsFlags(),
+			},
+		},
+	}
+}
+
+func SecretsFlags() []cli.Flag {
+	return append(DBFlags(),
+		&cli.StringFlag{
+			Name:    "encryption-master-key",
+			Usage:   "the new encryption master key, need to be 32 bytes long (for example 32 ASCII characters)",
+			EnvVars: []string{"ENCRYPTION_MASTER_KEY"},
+		},
+		&cli.StringFlag{
+			Name:    "encryption-key-id",
+			Value:   common.ConfigDefault("encryption-key-id"),
+			Usage:   "the ID of the new encryption master key, it's stored with the encrypted values",
+			EnvVars: []string{"ENCRYPTION_KEY_ID"},
+		},
+		&cli.StringFlag{
+			Name:    "encryption-retired-keys",
+			Usage:   "the previous encryption master keys as comma-separated id=key pairs e.g (1=<key>), the values encrypted before key IDs were stored can be decrypted with any of them",
+			EnvVars: []string{"ENCRYPTION_RETIRED_KEYS"},
+		},
+		&cli.BoolFlag{
+			Name:  "store-key-ids",
+			Usage: "store the ID of the key with the encrypted values e.g (enc:2:...), only set it if your OpenUEM console can read them as older consoles can't decrypt these values",
+		},
+		&cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "count the values that would be encrypted again and roll back the transaction",
+		},
+	)
+}
+
+func rotateSecrets(cCtx *cli.Context) error {
+	config, _, err := common.LoadConfig(common.ConfigOptions{Flags: cCtx, Keys: []string{"dburl", "db-password", "encryption-master-key", "encryption-key-id", "encryption-retired-keys"}})
+	if err != nil {
+		return err
+	}
+
+	keyring, err := common.NewKeyring(config.EncryptionKeyID, config.EncryptionMasterKey, config.EncryptionRetiredKeys)
+	if err != nil {
+		return err
+	}
+	if keyring == nil {
+		return fmt.Errorf("the encryption master key is required to encrypt the sensitive fields")
+	}
+
+	model, err := models.New(cCtx.Context, config.DBUrl, models.DefaultPoolConfig())
+	if err != nil {
+		return err
+	}
+	defer model.Close()
+
+	dryRun := cCtx.Bool("dry-run")
+	keyIDs := cCtx.Bool("store-key-ids")
+	changed, err := model.ReencryptSensitiveFields(cCtx.Context, models.ReencryptOptions{
+		Reencrypt: func(v string) (string, bool, error) {
+			return keyring.Rotate(v, keyIDs)
+		},
+		DryRun: dryRun,
+		Progress: func(f models.SensitiveField, done, total int) {
+			if done == total || done%rotationProgressStep == 0 {
+				fmt.Printf("%s: %d/%d values checked\n", f, done, total)
+			}
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("could not rotate the sensitive fields, no value has been changed, reason: %v", err)
+	}
+
+	total := 0
+	for _, f := range models.SensitiveFields {
+		total += changed[f]
+	}
+
+	if dryRun {
+		fmt.Printf("%d values would be encrypted with the key %s, no value has been changed\n", total, keyring.ActiveID())
+		return nil
+	}
+
+	fmt.Printf("%d values have been encrypted with the key %s\n", total, keyring.ActiveID())
+	return nil
+}
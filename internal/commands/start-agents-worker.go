@@ -1,10 +1,9 @@
 package commands
 
 import (
-	"log"
+	"log/slog"
 	"os"
 	"os/signal"
-	"strconv"
 	"syscall"
 
 	"github.com/go-co-op/gocron/v2"
@@ -14,21 +13,9 @@ import (
 
 func AgentWorker() *cli.Command {
 	return &cli.Command{
-		Name:  "agents",
-		Usage: "Manage OpenUEM's Agents worker",
-		Subcommands: []*cli.Command{
-			{
-				Name:   "start",
-				Usage:  "Start an OpenUEM's Agents worker",
-				Action: startAgentsWorker,
-				Flags:  CommonFlags(),
-			},
-			{
-				Name:   "stop",
-				Usage:  "Stop an OpenUEM's Agents worker",
-				Action: stopWorker,
-			},
-		},
+		Name:        "agents",
+		Usage:       "Manage OpenUEM's Agents worker",
+		Subcommands: workerCommands("Agents", common.AgentWorkerRole, startAgentsWorker, CommonFlags()),
 	}
 }
 
@@ -36,31 +23,35 @@ func startAgentsWorker(cCtx *cli.Context) error {
 	var err error
 
 	worker := common.NewWorker("")
+	worker.Role = common.AgentWorkerRole
 
 	if err := worker.CheckCLICommonRequisites(cCtx); err != nil {
-		log.Printf("[ERROR]: could not generate config for Agents Worker: %v", err)
+		slog.Error("could not generate config for Agents Worker", "error", err)
+		return err
 	}
 
-	if err := os.WriteFile("PIDFILE", []byte(strconv.Itoa(os.Getpid())), 0666); err != nil {
+	if err := writePIDFile(cCtx.String("pidfile")); err != nil {
 		return err
 	}
+	defer removePIDFile(cCtx.String("pidfile"))
 
 	// Start Task Scheduler
 	worker.TaskScheduler, err = gocron.NewScheduler()
 	if err != nil {
-		log.Fatalf("[FATAL]: could not create task scheduler, reason: %v", err)
+		slog.Error("could not create task scheduler", "error", err)
+		os.Exit(1)
 	}
 	worker.TaskScheduler.Start()
-	log.Println("[INFO]: task scheduler has been started")
+	slog.Info("task scheduler has been started")
 
 	worker.StartWorker(worker.SubscribeToAgentWorkerQueues)
 	// Keep the connection alive
 	done := make(chan os.Signal, 1)
 	signal.Notify(done, syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
-	log.Printf("[INFO]: agents worker is ready\n\n")
+	slog.Info("agents worker is ready")
 	<-done
 
 	worker.StopWorker()
-	log.Printf("[INFO]: agents worker has been shutdown\n\n")
+	slog.Info("agents worker has been shutdown")
 	return nil
 }
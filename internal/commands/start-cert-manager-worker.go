@@ -1,107 +1,95 @@
 package commands
 
 import (
-	"log"
+	"log/slog"
 	"os"
 	"os/signal"
-	"path/filepath"
-	"strconv"
-	"strings"
 	"syscall"
 
 	"github.com/go-co-op/gocron/v2"
 	"github.com/open-uem/openuem-worker/internal/common"
-	"github.com/open-uem/utils"
 	"github.com/urfave/cli/v2"
 )
 
 func CertManagerWorker() *cli.Command {
 	return &cli.Command{
-		Name:  "cert-manager",
-		Usage: "Manage OpenUEM's Cert-Manager worker",
-		Subcommands: []*cli.Command{
-			{
-				Name:   "start",
-				Usage:  "Start an OpenUEM's Cert-Manager worker",
-				Action: startCertManagerWorker,
-				Flags:  StartCertManagerWorkerFlags(),
-			},
-			{
-				Name:   "stop",
-				Usage:  "Stop an OpenUEM's Cert-Manager worker",
-				Action: stopWorker,
-			},
-		},
+		Name:        "cert-manager",
+		Usage:       "Manage OpenUEM's Cert-Manager worker",
+		Subcommands: workerCommands("Cert-Manager", common.CertManagerWorkerRole, startCertManagerWorker, StartCertManagerWorkerFlags()),
 	}
 }
 
 func StartCertManagerWorkerFlags() []cli.Flag {
-	flags := CommonFlags()
-
-	flags = append(flags, &cli.StringFlag{
-		Name:     "ocsp",
-		Usage:    "the url of the OCSP responder, e.g https://ocsp.example.com",
-		EnvVars:  []string{"OCSP"},
-		Required: true,
-	})
+	return append(CommonFlags(), CertManagerFlags()...)
+}
 
-	return append(flags, &cli.StringFlag{
-		Name:    "cakey",
-		Value:   "certificates/ca.key",
-		Usage:   "the path to your CA private key file in PEM format",
-		EnvVars: []string{"CA_KEY_FILENAME"},
-	})
+// CertManagerFlags are the flags only used by the cert-manager role
+func CertManagerFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    "ocsp",
+			Usage:   "the url of the OCSP responder, e.g https://ocsp.example.com",
+			EnvVars: []string{"OCSP"},
+		},
+		&cli.StringFlag{
+			Name:    "cakey",
+			Value:   common.ConfigDefault("cakey"),
+			Usage:   "the path to your CA private key file in PEM format",
+			EnvVars: []string{"CA_KEY_FILENAME"},
+		},
+		&cli.StringFlag{
+			Name:    "cakey-passphrase",
+			Usage:   "the passphrase of the CA private key if it's encrypted with PKCS#8 (ENCRYPTED PRIVATE KEY)",
+			EnvVars: []string{"CA_KEY_PASSPHRASE"},
+		},
+		&cli.BoolFlag{
+			Name:    "cert-self-renew",
+			Usage:   "renew the worker's own certificate with the CA before it expires",
+			EnvVars: []string{"CERT_SELF_RENEW"},
+		},
+		&cli.DurationFlag{
+			Name:    "cert-renew-before",
+			Value:   common.DefaultCertRenewBefore,
+			Usage:   "how long before the worker's certificate expires it's renewed",
+			EnvVars: []string{"CERT_RENEW_BEFORE"},
+		},
+	}
 }
 
 func startCertManagerWorker(cCtx *cli.Context) error {
 	var err error
 
 	worker := common.NewWorker("")
-
-	// Specific requisites
-	cwd, err := os.Getwd()
-	if err != nil {
-		return err
-	}
-
-	caKeyPath := filepath.Join(cwd, cCtx.String("cakey"))
-	worker.CAPrivateKey, err = utils.ReadPEMPrivateKey(caKeyPath)
-	if err != nil {
-		return err
-	}
-
-	// get ocsp servers
-	ocspServers := []string{}
-	for ocsp := range strings.SplitSeq(cCtx.String("ocsp"), ",") {
-		ocspServers = append(ocspServers, strings.TrimSpace(ocsp))
-	}
-	worker.OCSPResponders = ocspServers
+	worker.Role = common.CertManagerWorkerRole
 
 	if err := worker.CheckCLICommonRequisites(cCtx); err != nil {
-		log.Printf("[ERROR]: could not generate config for Cert Manager Worker: %v", err)
+		slog.Error("could not generate config for Cert Manager Worker", "error", err)
+		return err
 	}
 
-	if err := os.WriteFile("PIDFILE", []byte(strconv.Itoa(os.Getpid())), 0666); err != nil {
+	if err := writePIDFile(cCtx.String("pidfile")); err != nil {
 		return err
 	}
+	defer removePIDFile(cCtx.String("pidfile"))
 
 	// Start Task Scheduler
 	worker.TaskScheduler, err = gocron.NewScheduler()
 	if err != nil {
-		log.Fatalf("[FATAL]: could not create task scheduler, reason: %v", err)
+		slog.Error("could not create task scheduler", "error", err)
+		os.Exit(1)
 	}
 	worker.TaskScheduler.Start()
-	log.Println("[INFO]: task scheduler has been started")
+	slog.Info("task scheduler has been started")
 
 	worker.StartWorker(worker.SubscribeToCertManagerWorkerQueues)
 
 	// Keep the connection alive
 	done := make(chan os.Signal, 1)
 	signal.Notify(done, syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
-	log.Println("[INFO]: cert manager worker is ready")
+	slog.Info("cert manager worker is ready")
 	<-done
 
 	worker.StopWorker()
-	log.Println("[INFO]: cert manager worker has been shutdown")
+	slog.Info("cert manager worker has been shutdown")
 	return nil
 }
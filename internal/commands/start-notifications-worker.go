@@ -1,10 +1,9 @@
 package commands
 
 import (
-	"log"
+	"log/slog"
 	"os"
 	"os/signal"
-	"strconv"
 	"syscall"
 
 	"github.com/go-co-op/gocron/v2"
@@ -14,21 +13,9 @@ import (
 
 func NotificationsWorker() *cli.Command {
 	return &cli.Command{
-		Name:  "notifications",
-		Usage: "Manage OpenUEM's Notifications worker",
-		Subcommands: []*cli.Command{
-			{
-				Name:   "start",
-				Usage:  "Start an OpenUEM's Notifications worker",
-				Action: startNotificationsWorker,
-				Flags:  CommonFlags(),
-			},
-			{
-				Name:   "stop",
-				Usage:  "Stop an OpenUEM's Notifications worker",
-				Action: stopWorker,
-			},
-		},
+		Name:        "notifications",
+		Usage:       "Manage OpenUEM's Notifications worker",
+		Subcommands: workerCommands("Notifications", common.NotificationWorkerRole, startNotificationsWorker, CommonFlags()),
 	}
 }
 
@@ -36,33 +23,37 @@ func startNotificationsWorker(cCtx *cli.Context) error {
 	var err error
 
 	worker := common.NewWorker("")
+	worker.Role = common.NotificationWorkerRole
 
 	if err := worker.CheckCLICommonRequisites(cCtx); err != nil {
-		log.Printf("[ERROR]: could not generate config for Notification Worker: %v", err)
+		slog.Error("could not generate config for Notification Worker", "error", err)
+		return err
 	}
 
 	// Start Task Scheduler
 	worker.TaskScheduler, err = gocron.NewScheduler()
 	if err != nil {
-		log.Fatalf("[FATAL]: could not create task scheduler, reason: %v", err)
+		slog.Error("could not create task scheduler", "error", err)
+		os.Exit(1)
 	}
 	worker.TaskScheduler.Start()
-	log.Println("[INFO]: task scheduler has been started")
+	slog.Info("task scheduler has been started")
 
 	worker.StartWorker(worker.SubscribeToNotificationWorkerQueues)
 
-	if err := os.WriteFile("PIDFILE", []byte(strconv.Itoa(os.Getpid())), 0666); err != nil {
+	if err := writePIDFile(cCtx.String("pidfile")); err != nil {
 		return err
 	}
+	defer removePIDFile(cCtx.String("pidfile"))
 
 	// Keep the connection alive
 	done := make(chan os.Signal, 1)
 	signal.Notify(done, syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
-	log.Printf("[INFO]: notification worker is ready and listening for requests\n\n")
+	slog.Info("notification worker is ready and listening for requests")
 	<-done
 
 	worker.StopWorker()
 
-	log.Printf("[INFO]: notification Worker has been shutdown\n\n")
+	slog.Info("notification Worker has been shutdown")
 	return nil
 }
@@ -0,0 +1,83 @@
+package commands
+
+import (
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/go-co-op/gocron/v2"
+	"github.com/open-uem/openuem-worker/internal/common"
+	"github.com/urfave/cli/v2"
+)
+
+func Workers() *cli.Command {
+	return &cli.Command{
+		Name:        "workers",
+		Usage:       "Manage several OpenUEM's workers running in a single process",
+		Subcommands: workersCommands(),
+	}
+}
+
+func workersCommands() []*cli.Command {
+	commands := workerCommands("combined", "workers", startWorkers, StartWorkersFlags())
+	commands[0].Usage = "Start the selected OpenUEM's workers sharing the NATS and database connections"
+	commands[1].Usage = "Stop the OpenUEM's workers"
+	return commands
+}
+
+func StartWorkersFlags() []cli.Flag {
+	flags := append(CommonFlags(), &cli.StringSliceFlag{
+		Name:    "roles",
+		Value:   cli.NewStringSlice("agents", "cert-manager", "notifications"),
+		Usage:   "the workers to run in this process: agents, cert-manager and/or notifications",
+		EnvVars: []string{"WORKER_ROLES"},
+	})
+
+	// the cert-manager settings are only checked if the role has been selected
+	return append(flags, CertManagerFlags()...)
+}
+
+func startWorkers(cCtx *cli.Context) error {
+	var err error
+
+	roles, err := common.ParseRoles(cCtx.StringSlice("roles"))
+	if err != nil {
+		return err
+	}
+
+	worker := common.NewWorker("")
+	worker.Role = strings.Join(roles, ",")
+
+	if err := worker.CheckCLICommonRequisites(cCtx); err != nil {
+		slog.Error("could not generate config for workers", "error", err)
+		return err
+	}
+
+	if err := writePIDFile(cCtx.String("pidfile")); err != nil {
+		return err
+	}
+	defer removePIDFile(cCtx.String("pidfile"))
+
+	// Start Task Scheduler
+	worker.TaskScheduler, err = gocron.NewScheduler()
+	if err != nil {
+		slog.Error("could not create task scheduler", "error", err)
+		os.Exit(1)
+	}
+	worker.TaskScheduler.Start()
+	slog.Info("task scheduler has been started")
+
+	worker.StartWorker(worker.SubscribeToRolesQueues)
+
+	// Keep the connection alive
+	done := make(chan os.Signal, 1)
+	signal.Notify(done, syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
+	slog.Info("workers are ready", "roles", roles)
+	<-done
+
+	worker.StopWorker()
+	slog.Info("workers have been shutdown")
+	return nil
+}
@@ -0,0 +1,92 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/open-uem/openuem-worker/internal/common"
+	"github.com/urfave/cli/v2"
+)
+
+func Status() *cli.Command {
+	return &cli.Command{
+		Name:   "status",
+		Usage:  "Show the state of the workers connected to NATS",
+		Action: status,
+		Flags: append(NATSFlags(),
+			&cli.DurationFlag{
+				Name:    "timeout",
+				Value:   2 * time.Second,
+				Usage:   "the time to wait for the workers' replies",
+				EnvVars: []string{"STATUS_TIMEOUT"},
+			},
+			&cli.BoolFlag{
+				Name:  "json",
+				Usage: "print the replies as JSON",
+			},
+		),
+	}
+}
+
+func status(cCtx *cli.Context) error {
+	nc, err := connectNATS(cCtx)
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+
+	replies, err := common.RequestStatus(nc, cCtx.Duration("timeout"))
+	if err != nil {
+		return fmt.Errorf("could not request the workers status, reason: %v", err)
+	}
+
+	slices.SortFunc(replies, func(a, b common.WorkerStatus) int {
+		if c := strings.Compare(a.Role, b.Role); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Hostname, b.Hostname)
+	})
+
+	if cCtx.Bool("json") {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(replies)
+	}
+
+	if len(replies) == 0 {
+		slog.Warn("no worker has replied")
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ROLE\tHOSTNAME\tINSTANCE\tVERSION\tUPTIME\tREADY\tDB\tNATS\tSUBSCRIPTIONS\tPROCESSED\tFAILED\tLEADER\tLAST ERROR")
+	for _, r := range replies {
+		lastError := ""
+		if r.LastError != nil {
+			lastError = fmt.Sprintf("%s (%s)", r.LastError.Message, r.LastError.Time.Format(time.RFC3339))
+		}
+		leaderOf := []string{}
+		for _, l := range r.Leaders {
+			if l.IsLeader {
+				leaderOf = append(leaderOf, l.Role)
+			}
+		}
+		leader := "-"
+		if len(leaderOf) > 0 {
+			leader = strings.Join(leaderOf, ",")
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s (%s)\t%s\t%t\t%s\t%s\t%d/%d\t%d\t%d\t%s\t%s\n",
+			r.Role, r.Hostname, r.InstanceID, r.Version, r.Channel,
+			(time.Duration(r.UptimeSeconds) * time.Second).String(),
+			r.Ready, r.DBState, r.NATSState,
+			len(r.ActiveSubscriptions), len(r.ActiveSubscriptions)+len(r.MissingSubscriptions),
+			r.MessagesProcessed, r.MessagesFailed, leader, lastError)
+	}
+	return tw.Flush()
+}
@@ -1,46 +1,16 @@
 package commands
 
 import (
-	"fmt"
-	"log"
-	"os"
-	"strconv"
+	"errors"
 
 	"github.com/urfave/cli/v2"
 )
 
-func StopWorker() *cli.Command {
-	return &cli.Command{
-		Name:   "stop",
-		Usage:  "Stop worker",
-		Action: stopWorker,
-	}
-}
-
+// stopWorker is the stop command of every role, the PID file is the role's one e.g (openuem-agent-worker.pid)
 func stopWorker(cCtx *cli.Context) error {
-	pidByte, err := os.ReadFile("PIDFILE")
-	if err != nil {
-		return fmt.Errorf("could not find the PIDFILE")
-	}
-
-	pid, err := strconv.Atoi(string(pidByte))
-	if err != nil {
-		return fmt.Errorf("could not parse the pid from PIDFILE")
-	}
-	p, err := os.FindProcess(pid)
-
-	if err != nil {
-		return fmt.Errorf("could not find process associated with worker")
-	}
-
-	if err := p.Signal(os.Interrupt); err != nil {
-		return fmt.Errorf("could not terminate the process associated with the worker, reason: %v", err)
-	}
-
-	log.Printf("👋 Done! Your worker has stopped listening\n\n")
-
-	if err := os.Remove("PIDFILE"); err != nil {
-		return err
+	err := stopRunningWorker(cCtx.String("pidfile"), cCtx.Bool("wait"), cCtx.Duration("wait-timeout"))
+	if errors.Is(err, errNotRunning) {
+		return cli.Exit("the worker is not running", 1)
 	}
-	return nil
+	return err
 }
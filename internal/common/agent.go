@@ -4,96 +4,88 @@ import (
 	"cmp"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"slices"
 	"strconv"
 	"strings"
 
 	"github.com/nats-io/nats.go"
 	"github.com/open-uem/ent"
-	"github.com/open-uem/ent/agent"
 	"github.com/open-uem/ent/task"
 	openuem_nats "github.com/open-uem/nats"
 	"github.com/open-uem/utils"
 	"github.com/open-uem/wingetcfg/wingetcfg"
+	"go.opentelemetry.io/otel/attribute"
 
 	ansiblecfg "github.com/open-uem/openuem-ansible-config/ansible"
 	"gopkg.in/yaml.v3"
 )
 
 func (w *Worker) SubscribeToAgentWorkerQueues() error {
-	_, err := w.NATSConnection.QueueSubscribe("report", "openuem-agents", w.ReportReceivedHandler)
-	if err != nil {
-		log.Printf("[ERROR]: could not subscribe to report NATS message, reason: %v", err)
-		return err
-	}
-	log.Printf("[INFO]: subscribed to message report")
-
-	_, err = w.NATSConnection.QueueSubscribe("deployresult", "openuem-agents", w.DeployResultReceivedHandler)
-	if err != nil {
-		log.Printf("[ERROR]: could not subscribe to deployresult NATS message, reason: %v", err)
-		return err
-	}
-	log.Printf("[INFO]: subscribed to message deployresult")
-
-	_, err = w.NATSConnection.QueueSubscribe("ping.agentworker", "openuem-agents", w.PingHandler)
-	if err != nil {
-		log.Printf("[ERROR]: could not subscribe to ping.agentworker NATS message, reason: %v", err)
-		return err
-	}
-	log.Printf("[INFO]: subscribed to message ping.agentworker")
+	subscriptions := w.agentWorkerSubscriptions()
 
-	_, err = w.NATSConnection.QueueSubscribe("agentconfig", "openuem-agents", w.AgentConfigHandler)
-	if err != nil {
-		log.Printf("[ERROR]: could not subscribe to agentconfig NATS message, reason: %v", err)
-		return err
-	}
-	log.Printf("[INFO]: subscribed to message agentconfig")
-
-	_, err = w.NATSConnection.QueueSubscribe("wingetcfg.profiles", "openuem-agents", w.ApplyWindowsEndpointProfiles)
-	if err != nil {
-		log.Printf("[ERROR]: could not subscribe to wingetcfg.profiles NATS message, reason: %v", err)
-		return err
-	}
-	log.Printf("[INFO]: subscribed to message wingetcfg.profiles")
-
-	_, err = w.NATSConnection.QueueSubscribe("ansiblecfg.profiles", "openuem-agents", w.ApplyUnixEndpointProfiles)
-	if err != nil {
-		log.Printf("[ERROR]: could not subscribe to ansiblecfg.profiles NATS message, reason: %v", err)
-		return err
-	}
-	log.Printf("[INFO]: subscribed to message ansiblecfg.profiles")
+	// Agents may also publish to the ingest subjects, their messages are kept until a worker processes them
+	if w.JetstreamEnabled {
+		if w.Jetstream == nil || w.Jetstream.Conn() != w.NATSConnection() {
+			if err := w.CreateAgentsStream(); err != nil {
+				return err
+			}
+		}
 
-	_, err = w.NATSConnection.QueueSubscribe("wingetcfg.deploy", "openuem-agents", w.WinGetCfgDeploymentReport)
-	if err != nil {
-		log.Printf("[ERROR]: could not subscribe to wingetcfg.deploy NATS message, reason: %v", err)
-		return err
+		subscriptions = append(subscriptions,
+			Subscription{Subject: IngestSubjectPrefix + "report", Stream: AgentsStream, Handler: w.ReportReceivedHandler},
+			Subscription{Subject: IngestSubjectPrefix + "deployresult", Stream: AgentsStream, Handler: w.DeployResultReceivedHandler},
+			Subscription{Subject: IngestSubjectPrefix + "wingetcfg.deploy", Stream: AgentsStream, Handler: w.WinGetCfgDeploymentReport},
+			Subscription{Subject: IngestSubjectPrefix + "wingetcfg.report", Stream: AgentsStream, Handler: w.ProfileReportResponseHandler},
+		)
 	}
-	log.Printf("[INFO]: subscribed to message wingetcfg.deploy")
 
-	_, err = w.NATSConnection.QueueSubscribe("wingetcfg.exclude", "openuem-agents", w.WinGetCfgMarkPackageAsExcluded)
-	if err != nil {
-		log.Printf("[ERROR]: could not subscribe to wingetcfg.exclude NATS message, reason: %v", err)
-		return err
-	}
-	log.Printf("[INFO]: subscribed to message wingetcfg.exclude")
+	return w.SubscribeTo(subscriptions)
+}
 
-	_, err = w.NATSConnection.QueueSubscribe("wingetcfg.report", "openuem-agents", w.ProfileReportResponseHandler)
-	if err != nil {
-		log.Printf("[ERROR]: could not subscribe to wingetcfg.report NATS message, reason: %v", err)
-		return err
+// agentWorkerSubscriptions returns the core NATS subscriptions of the agent worker
+func (w *Worker) agentWorkerSubscriptions() []Subscription {
+	return []Subscription{
+		{Subject: "report", Queue: "openuem-agents", Handler: w.ReportReceivedHandler},
+		{Subject: "deployresult", Queue: "openuem-agents", Handler: w.DeployResultReceivedHandler},
+		{Subject: "ping.agentworker", Queue: "openuem-agents", Handler: w.PingHandler, SkipDBCheck: true},
+		{Subject: StatusSubject, Handler: w.PingHandler, SkipDBCheck: true},
+		{Subject: "agentconfig", Queue: "openuem-agents", Handler: w.AgentConfigHandler},
+		{Subject: "wingetcfg.profiles", Queue: "openuem-agents", Handler: w.ApplyWindowsEndpointProfiles},
+		{Subject: "ansiblecfg.profiles", Queue: "openuem-agents", Handler: w.ApplyUnixEndpointProfiles},
+		{Subject: "wingetcfg.deploy", Queue: "openuem-agents", Handler: w.WinGetCfgDeploymentReport},
+		{Subject: "wingetcfg.exclude", Queue: "openuem-agents", Handler: w.WinGetCfgMarkPackageAsExcluded},
+		{Subject: "wingetcfg.report", Queue: "openuem-agents", Handler: w.ProfileReportResponseHandler},
 	}
-	log.Printf("[INFO]: subscribed to message wingetcfg.report")
-	return nil
 }
 
 func (w *Worker) ReportReceivedHandler(msg *nats.Msg) {
+	logger := messageLogger(msg)
+	ctx, cancel := w.MessageContext(msg)
+	defer cancel()
+
 	data := openuem_nats.AgentReport{}
 	tenantID := ""
 
 	if err := json.Unmarshal(msg.Data, &data); err != nil {
-		log.Printf("[ERROR]: could not unmarshal agent report, reason: %v\n", err)
+		logger.Error("could not unmarshal agent report", "error", err)
+		w.FailMessage(msg, Permanent(err))
+		if err := w.respond(msg, []byte(err.Error())); err != nil {
+			logger.Error("could not respond to report message", "error", err)
+		}
+		return
+	}
+	logger = logger.With("agent_id", data.AgentID, "tenant", data.Tenant)
+
+	if err := w.AllowAgent(msg, data.AgentID); err != nil {
+		w.Reject(msg, err)
+		return
+	}
+
+	if err := w.CheckReportItems(&data); err != nil {
+		w.Reject(msg, err)
+		return
 	}
 
 	requestConfig := openuem_nats.RemoteConfigRequest{
@@ -102,173 +94,192 @@ func (w *Worker) ReportReceivedHandler(msg *nats.Msg) {
 		SiteID:   data.Site,
 	}
 
-	autoAdmitAgents := false
+	// DB errors fail the message so JetStream delivers it again or dead-letters it
+	fail := func(method, message string, err error) {
+		w.Metrics.DBError(method)
+		logger.Error(message, "error", err)
+		w.FailMessage(msg, err)
+		if err := w.respond(msg, []byte(err.Error())); err != nil {
+			logger.Error("could not respond to report message", "error", err)
+		}
+	}
 
 	// Check if agent exists
-	exists, err := w.Model.Client.Agent.Query().Where(agent.ID(data.AgentID)).Exist(context.Background())
+	exists, err := w.Model().AgentExists(ctx, data.AgentID)
 	if err != nil {
-		log.Printf("[ERROR]: could not check if agent exists, reason: %v\n", err)
-	} else {
-		if exists {
-			id, err := w.Model.GetTenantFromAgentID(requestConfig)
-			if err != nil {
-				log.Printf("[ERROR]: could not get tenant ID, reason: %v\n", err)
-			} else {
-				tenantID = strconv.Itoa(id)
-			}
-		} else {
-			tenantID = data.Tenant
-		}
+		fail("AgentExists", "could not check if agent exists", err)
+		return
+	}
 
-		settings, err := w.Model.GetSettings(tenantID)
+	if exists {
+		id, err := w.Model().GetTenantFromAgentID(ctx, requestConfig)
 		if err != nil {
-			log.Printf("[ERROR]: could not get OpenUEM general settings, reason: %v\n", err)
-		} else {
-			autoAdmitAgents = settings.AutoAdmitAgents
+			fail("GetTenantFromAgentID", "could not get tenant ID", err)
+			return
 		}
+		tenantID = strconv.Itoa(id)
+	} else {
+		tenantID = data.Tenant
 	}
 
-	if err := w.Model.SaveAgentInfo(&data, w.NATSServers, autoAdmitAgents); err != nil {
-		log.Printf("[ERROR]: could not save agent info into database, reason: %v\n", err.Error())
-	}
-
-	if err := w.Model.SaveComputerInfo(&data); err != nil {
-		log.Printf("[ERROR]: could not save computer info into database, reason: %v\n", err)
-	}
-
-	if err := w.Model.SaveOSInfo(&data); err != nil {
-		log.Printf("[ERROR]: could not save operating system info into database, reason: %v\n", err)
-	}
-
-	if err := w.Model.SaveAntivirusInfo(&data); err != nil {
-		log.Printf("[ERROR]: could not save antivirus info into database, reason: %v\n", err)
-	}
-
-	if err := w.Model.SaveSystemUpdateInfo(&data); err != nil {
-		log.Printf("[ERROR]: could not save system updates info into database, reason: %v\n", err)
-	}
-
-	if err := w.Model.SaveAppsInfo(&data); err != nil {
-		log.Printf("[ERROR]: could not save apps info into database, reason: %v\n", err)
-	}
-
-	if err := w.Model.SaveMonitorsInfo(&data); err != nil {
-		log.Printf("[ERROR]: could not save monitors info into database, reason: %v\n", err)
-	}
-
-	if err := w.Model.SaveMemorySlotsInfo(&data); err != nil {
-		log.Printf("[ERROR]: could not save memory slots info into database, reason: %v\n", err)
-	}
-
-	if err := w.Model.SaveLogicalDisksInfo(&data); err != nil {
-		log.Printf("[ERROR]: could not save logical disks info into database, reason: %v\n", err)
-	}
-
-	if err := w.Model.SavePhysicalDisksInfo(&data); err != nil {
-		log.Printf("[ERROR]: could not save physical disks info into database, reason: %v\n", err)
-	}
-
-	if err := w.Model.SavePrintersInfo(&data); err != nil {
-		log.Printf("[ERROR]: could not save printers info into database, reason: %v\n", err)
-	}
-
-	if err := w.Model.SaveNetworkAdaptersInfo(&data); err != nil {
-		log.Printf("[ERROR]: could not save network adapters info into database, reason: %v\n", err)
-	}
-
-	if err := w.Model.SaveSharesInfo(&data); err != nil {
-		log.Printf("[ERROR]: could not save shares info into database, reason: %v\n", err)
-	}
-
-	if err := w.Model.SaveUpdatesInfo(&data); err != nil {
-		log.Printf("[ERROR]: could not save updates info into database, reason: %v\n", err)
+	autoAdmitAgents := false
+	settings, err := w.Model().GetSettings(ctx, tenantID)
+	switch {
+	case err == nil:
+		autoAdmitAgents = settings.AutoAdmitAgents
+	case ent.IsNotFound(err):
+		logger.Warn("no OpenUEM general settings found, agents won't be admitted automatically")
+	default:
+		fail("GetSettings", "could not get OpenUEM general settings", err)
+		return
 	}
 
-	if err := w.Model.SaveReleaseInfo(&data); err != nil {
-		log.Printf("[ERROR]: could not save release info into database, reason: %v\n", err)
+	// the agent is saved first as the rest of the report belongs to it, the report fails if it can't be saved
+	if err := w.Model().SaveAgentInfo(ctx, &data, w.liveSettings().NATSServers, autoAdmitAgents); err != nil {
+		fail("SaveAgentInfo", "could not save agent info into database", err)
+		return
 	}
 
-	if err := w.Model.SaveNetbirdInfo(&data); err != nil {
-		log.Printf("[ERROR]: could not save Netbird info into database, reason: %v\n", err)
+	// the sections are saved independently, one that can't be saved e.g (the release info when
+	// the releases endpoint can't be reached) doesn't prevent the others from being saved
+	saves := []struct {
+		method  string
+		message string
+		save    func(context.Context, *openuem_nats.AgentReport) error
+	}{
+		{"SaveComputerInfo", "could not save computer info into database", w.Model().SaveComputerInfo},
+		{"SaveOSInfo", "could not save operating system info into database", w.Model().SaveOSInfo},
+		{"SaveAntivirusInfo", "could not save antivirus info into database", w.Model().SaveAntivirusInfo},
+		{"SaveSystemUpdateInfo", "could not save system updates info into database", w.Model().SaveSystemUpdateInfo},
+		{"SaveAppsInfo", "could not save apps info into database", w.Model().SaveAppsInfo},
+		{"SaveMonitorsInfo", "could not save monitors info into database", w.Model().SaveMonitorsInfo},
+		{"SaveMemorySlotsInfo", "could not save memory slots info into database", w.Model().SaveMemorySlotsInfo},
+		{"SaveLogicalDisksInfo", "could not save logical disks info into database", w.Model().SaveLogicalDisksInfo},
+		{"SavePhysicalDisksInfo", "could not save physical disks info into database", w.Model().SavePhysicalDisksInfo},
+		{"SavePrintersInfo", "could not save printers info into database", w.Model().SavePrintersInfo},
+		{"SaveNetworkAdaptersInfo", "could not save network adapters info into database", w.Model().SaveNetworkAdaptersInfo},
+		{"SaveSharesInfo", "could not save shares info into database", w.Model().SaveSharesInfo},
+		{"SaveUpdatesInfo", "could not save updates info into database", w.Model().SaveUpdatesInfo},
+		{"SaveReleaseInfo", "could not save release info into database", w.Model().SaveReleaseInfo},
+		{"SaveNetbirdInfo", "could not save Netbird info into database", w.Model().SaveNetbirdInfo},
+	}
+	for _, s := range saves {
+		if err := s.save(ctx, &data); err != nil {
+			w.Metrics.DBError(s.method)
+			logger.Error(s.message, "error", err)
+		}
 	}
 
-	if err := msg.Respond([]byte("Report received!")); err != nil {
-		log.Printf("[ERROR]: could not respond to report message, reason: %v\n", err)
+	if err := w.respond(msg, []byte("Report received!")); err != nil {
+		logger.Error("could not respond to report message", "error", err)
 	}
 }
 
 func (w *Worker) DeployResultReceivedHandler(msg *nats.Msg) {
+	logger := messageLogger(msg)
+	ctx, cancel := w.MessageContext(msg)
+	defer cancel()
+
 	data := openuem_nats.DeployAction{}
 
 	if err := json.Unmarshal(msg.Data, &data); err != nil {
-		log.Printf("[ERROR]: could not unmarshal deploy message, reason: %v\n", err)
+		logger.Error("could not unmarshal deploy message", "error", err)
+		w.FailMessage(msg, Permanent(err))
+		if err := w.respond(msg, []byte(err.Error())); err != nil {
+			logger.Error("could not respond to deploy message", "error", err)
+		}
+		return
+	}
+	logger = logger.With("agent_id", data.AgentId)
+
+	if err := w.AllowAgent(msg, data.AgentId); err != nil {
+		w.Reject(msg, err)
+		return
 	}
 
-	if err := w.Model.SaveDeployInfo(&data); err != nil {
-		log.Printf("[ERROR]: could not save deployment info into database, reason: %v\n", err)
+	if err := w.Model().SaveDeployInfo(ctx, &data); err != nil {
+		w.Metrics.DBError("SaveDeployInfo")
+		logger.Error("could not save deployment info into database", "error", err)
+		w.FailMessage(msg, err)
 
-		if err := msg.Respond([]byte(err.Error())); err != nil {
-			log.Printf("[ERROR]: could not respond to deploy message, reason: %v\n", err)
+		if err := w.respond(msg, []byte(err.Error())); err != nil {
+			logger.Error("could not respond to deploy message", "error", err)
 		}
 		return
 	}
 
-	if err := msg.Respond([]byte("")); err != nil {
-		log.Printf("[ERROR]: could not respond to deploy message, reason: %v\n", err)
+	if err := w.respond(msg, []byte("")); err != nil {
+		logger.Error("could not respond to deploy message", "error", err)
 	}
 }
 
 func (w *Worker) ApplyWindowsEndpointProfiles(msg *nats.Msg) {
+	logger := messageLogger(msg)
+	ctx, cancel := w.MessageContext(msg)
+	defer cancel()
+
 	configurations := []openuem_nats.ProfileConfig{}
 	profileRequest := openuem_nats.CfgProfiles{}
 
-	// log.Println("[DEBUG]: received a wingetcfg.profiles message")
+	logger.Debug("received a wingetcfg.profiles message")
 
 	// Unmarshal data and get agentID
 	if err := json.Unmarshal(msg.Data, &profileRequest); err != nil {
-		log.Println("[ERROR]: could not unmarshall profile request", err.Error())
-		if err := msg.Respond(nil); err != nil {
-			log.Printf("[ERROR]: could not send response to the agent requesting a profile, reason: %v\n", err)
+		logger.Error("could not unmarshall profile request", "error", err)
+		w.FailMessage(msg, Permanent(err))
+		if err := w.respond(msg, nil); err != nil {
+			logger.Error("could not send response to the agent requesting a profile", "error", err)
 		}
 		return
 	}
 
+	logger = logger.With("agent_id", profileRequest.AgentID, "profile_id", profileRequest.ProfileID)
+
 	// Check agentID
 	if profileRequest.AgentID == "" {
-		log.Println("[ERROR]: agentID must not be empty")
-		if err := msg.Respond(nil); err != nil {
-			log.Printf("[ERROR]: could not send response to the agent requesting a profile, reason: %v\n", err)
+		logger.Error("agentID must not be empty")
+		w.FailMessage(msg, Permanent(errors.New("agentID must not be empty")))
+		if err := w.respond(msg, nil); err != nil {
+			logger.Error("could not send response to the agent requesting a profile", "error", err)
 		}
 		return
 	}
 
-	// log.Println("[DEBUG]: received a wingetcfg.profiles message for: ", profileRequest.AgentID)
+	if err := w.AllowAgent(msg, profileRequest.AgentID); err != nil {
+		w.Reject(msg, err)
+		return
+	}
 
 	// Get profiles that should apply to this agent
-	profiles, err := w.GetAppliedProfiles(profileRequest)
+	profiles, err := w.GetAppliedProfiles(ctx, profileRequest)
 	if err != nil {
-		log.Printf("[ERROR]: could not get applied profiles, reason: %v", err)
-		if err := msg.Respond(nil); err != nil {
-			log.Printf("[ERROR]: could not send response to the agent requesting a profile, reason: %v\n", err)
+		logger.Error("could not get applied profiles", "error", err)
+		w.FailMessage(msg, err)
+		if err := w.respond(msg, nil); err != nil {
+			logger.Error("could not send response to the agent requesting a profile", "error", err)
 		}
 		return
 	}
 
 	// Now inform which packages has been excluded to the agent
-	exclusions, err := w.Model.GetExcludedWinGetPackages(profileRequest.AgentID)
+	exclusions, err := w.Model().GetExcludedWinGetPackages(ctx, profileRequest.AgentID)
 	if err != nil {
-		log.Printf("[ERROR]: could not get WinGetCfg packages exclusions, reason: %v", err)
-		if err := msg.Respond(nil); err != nil {
-			log.Printf("[ERROR]: could not send response to the agent requesting a profile, reason: %v\n", err)
+		w.Metrics.DBError("GetExcludedWinGetPackages")
+		logger.Error("could not get WinGetCfg packages exclusions", "error", err)
+		w.FailMessage(msg, err)
+		if err := w.respond(msg, nil); err != nil {
+			logger.Error("could not send response to the agent requesting a profile", "error", err)
 		}
 		return
 	}
 
-	deployments, err := w.Model.GetDeployedPackages(profileRequest.AgentID)
+	deployments, err := w.Model().GetDeployedPackages(ctx, profileRequest.AgentID)
 	if err != nil {
-		log.Printf("[ERROR]: could not get deployed packages with WinGet, reason: %v", err)
-		if err := msg.Respond(nil); err != nil {
-			log.Printf("[ERROR]: could not send response to the agent requesting a profile, reason: %v\n", err)
+		w.Metrics.DBError("GetDeployedPackages")
+		logger.Error("could not get deployed packages with WinGet", "error", err)
+		w.FailMessage(msg, err)
+		if err := w.respond(msg, nil); err != nil {
+			logger.Error("could not send response to the agent requesting a profile", "error", err)
 		}
 		return
 	}
@@ -284,14 +295,14 @@ func (w *Worker) ApplyWindowsEndpointProfiles(msg *nats.Msg) {
 		// Generate WinGet config
 		p.WinGetConfig, err = w.GenerateWinGetConfig(profile)
 		if err != nil {
-			log.Printf("[ERROR]: could not generate config for profile: %s, reason: %v", profile.Name, err)
+			logger.Error("could not generate config for profile", "profile_id", profile.ID, "profile", profile.Name, "error", err)
 			continue
 		}
 
 		// Generate NetBird config
-		netbirdConfig, err := w.GenerateNetbirdConfig(profile, profileRequest.AgentID)
+		netbirdConfig, err := w.GenerateNetbirdConfig(ctx, profile, profileRequest.AgentID)
 		if err != nil {
-			log.Printf("[ERROR]: could not generate netbird config for profile: %s, reason: %v", profile.Name, err)
+			logger.Error("could not generate netbird config for profile", "profile_id", profile.ID, "profile", profile.Name, "error", err)
 			continue
 		}
 		p.NetBirdConfig = netbirdConfig
@@ -302,46 +313,55 @@ func (w *Worker) ApplyWindowsEndpointProfiles(msg *nats.Msg) {
 	// Send response
 	data, err := yaml.Marshal(configurations)
 	if err != nil {
-		log.Printf("[ERROR]: could not marshal configurations, reason: %v", err)
+		logger.Error("could not marshal configurations", "error", err)
 	}
 
-	// log.Println("[DEBUG]: going to respond wingetcfg.profiles message for: ", profileRequest.AgentID)
+	logger.Debug("going to respond wingetcfg.profiles message", "profiles", len(configurations))
 
-	if err := msg.Respond(data); err != nil {
-		log.Printf("[ERROR]: could not send wingetcfg message with profiles to the agent, reason: %v\n", err)
+	if err := w.respond(msg, data); err != nil {
+		logger.Error("could not send wingetcfg message with profiles to the agent", "error", err)
 	}
 
-	// log.Println("[DEBUG]: should have responded to wingetcfg.profiles message for: ", profileRequest.AgentID)
+	logger.Debug("responded to wingetcfg.profiles message")
 }
 
 func (w *Worker) ApplyUnixEndpointProfiles(msg *nats.Msg) {
+	logger := messageLogger(msg)
+	ctx, cancel := w.MessageContext(msg)
+	defer cancel()
+
 	configurations := []openuem_nats.ProfileConfig{}
 	profileRequest := openuem_nats.CfgProfiles{}
 
 	// Unmarshal data and get agentID
 	if err := json.Unmarshal(msg.Data, &profileRequest); err != nil {
-		log.Println("[ERROR]: could not unmarshall profile request")
-		if err := msg.Respond(nil); err != nil {
-			log.Printf("[ERROR]: could not send response to the agent requesting a profile, reason: %v\n", err)
+		logger.Error("could not unmarshall profile request", "error", err)
+		w.FailMessage(msg, Permanent(err))
+		if err := w.respond(msg, nil); err != nil {
+			logger.Error("could not send response to the agent requesting a profile", "error", err)
 		}
 		return
 	}
 
+	logger = logger.With("agent_id", profileRequest.AgentID, "profile_id", profileRequest.ProfileID)
+
 	// Check agentID
 	if profileRequest.AgentID == "" {
-		log.Println("[ERROR]: agentID must not be empty")
-		if err := msg.Respond(nil); err != nil {
-			log.Printf("[ERROR]: could not send response to the agent requesting a profile, reason: %v\n", err)
+		logger.Error("agentID must not be empty")
+		w.FailMessage(msg, Permanent(errors.New("agentID must not be empty")))
+		if err := w.respond(msg, nil); err != nil {
+			logger.Error("could not send response to the agent requesting a profile", "error", err)
 		}
 		return
 	}
 
 	// Get profiles that should apply to this agent
-	profiles, err := w.GetAppliedProfiles(profileRequest)
+	profiles, err := w.GetAppliedProfiles(ctx, profileRequest)
 	if err != nil {
-		log.Printf("[ERROR]: could not get applied profiles, reason: %v", err)
-		if err := msg.Respond(nil); err != nil {
-			log.Printf("[ERROR]: could not send response to the agent requesting a profile, reason: %v\n", err)
+		logger.Error("could not get applied profiles", "error", err)
+		w.FailMessage(msg, err)
+		if err := w.respond(msg, nil); err != nil {
+			logger.Error("could not send response to the agent requesting a profile", "error", err)
 		}
 		return
 	}
@@ -354,9 +374,9 @@ func (w *Worker) ApplyUnixEndpointProfiles(msg *nats.Msg) {
 		}
 
 		// Generate Ansible config
-		ansibleConfig, err := w.GenerateAnsibleConfig(profile, profileRequest.AgentID)
+		ansibleConfig, err := w.GenerateAnsibleConfig(ctx, profile, profileRequest.AgentID)
 		if err != nil {
-			log.Printf("[ERROR]: could not generate ansible config for profile: %s, reason: %v", profile.Name, err)
+			logger.Error("could not generate ansible config for profile", "profile_id", profile.ID, "profile", profile.Name, "error", err)
 			continue
 		}
 
@@ -365,9 +385,9 @@ func (w *Worker) ApplyUnixEndpointProfiles(msg *nats.Msg) {
 		}
 
 		// Generate NetBird config
-		netbirdConfig, err := w.GenerateNetbirdConfig(profile, profileRequest.AgentID)
+		netbirdConfig, err := w.GenerateNetbirdConfig(ctx, profile, profileRequest.AgentID)
 		if err != nil {
-			log.Printf("[ERROR]: could not generate netbird config for profile: %s, reason: %v", profile.Name, err)
+			logger.Error("could not generate netbird config for profile", "profile_id", profile.ID, "profile", profile.Name, "error", err)
 			continue
 		}
 		p.NetBirdConfig = netbirdConfig
@@ -378,17 +398,17 @@ func (w *Worker) ApplyUnixEndpointProfiles(msg *nats.Msg) {
 	// Send response
 	data, err := yaml.Marshal(configurations)
 	if err != nil {
-		log.Printf("[ERROR]: could not marshal configurations, reason: %v", err)
+		logger.Error("could not marshal configurations", "error", err)
 	}
 
-	if err := msg.Respond(data); err != nil {
-		log.Printf("[ERROR]: could not send wingetcfg message with profiles to the agent, reason: %v\n", err)
+	if err := w.respond(msg, data); err != nil {
+		logger.Error("could not send wingetcfg message with profiles to the agent", "error", err)
 	}
 }
 
-func (w *Worker) GetAppliedProfiles(cfg openuem_nats.CfgProfiles) ([]*ent.Profile, error) {
+func (w *Worker) GetAppliedProfiles(ctx context.Context, cfg openuem_nats.CfgProfiles) ([]*ent.Profile, error) {
 
-	a, err := w.Model.Client.Agent.Query().WithSite(func(q *ent.SiteQuery) { q.WithTenant().All(context.Background()) }).Where(agent.ID(cfg.AgentID)).Only(context.Background())
+	a, err := w.Model().GetAgentWithSite(ctx, cfg.AgentID)
 	if err != nil {
 		return nil, err
 	}
@@ -405,25 +425,29 @@ func (w *Worker) GetAppliedProfiles(cfg openuem_nats.CfgProfiles) ([]*ent.Profil
 
 	if cfg.ProfileID == 0 {
 
-		profilesAppliedToAll, err := w.Model.GetProfilesAppliedToAll(sites[0].ID, tenant.ID)
+		profilesAppliedToAll, err := w.Model().GetProfilesAppliedToAll(ctx, sites[0].ID, tenant.ID)
 		if err != nil {
+			w.Metrics.DBError("GetProfilesAppliedToAll")
 			return nil, err
 		}
 
-		profilesAppliedToAgent, err := w.Model.GetProfilesAppliedToAgent(sites[0].ID, cfg.AgentID, tenant.ID)
+		profilesAppliedToAgent, err := w.Model().GetProfilesAppliedToAgent(ctx, sites[0].ID, cfg.AgentID, tenant.ID)
 		if err != nil {
+			w.Metrics.DBError("GetProfilesAppliedToAgent")
 			return nil, err
 		}
 
 		return append(profilesAppliedToAll, profilesAppliedToAgent...), nil
 	} else {
-		profilesAppliedToAll, err := w.Model.GetProfilesAppliedToAllFilteredByProfile(sites[0].ID, cfg.ProfileID)
+		profilesAppliedToAll, err := w.Model().GetProfilesAppliedToAllFilteredByProfile(ctx, sites[0].ID, cfg.ProfileID)
 		if err != nil {
+			w.Metrics.DBError("GetProfilesAppliedToAllFilteredByProfile")
 			return nil, err
 		}
 
-		profilesAppliedToAgent, err := w.Model.GetProfilesAppliedToAgentFilteredByProfile(sites[0].ID, cfg.AgentID, cfg.ProfileID)
+		profilesAppliedToAgent, err := w.Model().GetProfilesAppliedToAgentFilteredByProfile(ctx, sites[0].ID, cfg.AgentID, cfg.ProfileID)
 		if err != nil {
+			w.Metrics.DBError("GetProfilesAppliedToAgentFilteredByProfile")
 			return nil, err
 		}
 
@@ -455,6 +479,11 @@ func (w *Worker) GenerateWinGetConfig(profile *ent.Profile) (*wingetcfg.WinGetCf
 			continue
 		}
 
+		t, err := w.SensitiveFields().Task(t)
+		if err != nil {
+			return nil, err
+		}
+
 		taskID := fmt.Sprintf("task_%d_%d", t.ID, t.Version)
 
 		switch t.Type {
@@ -501,19 +530,6 @@ func (w *Worker) GenerateWinGetConfig(profile *ent.Profile) (*wingetcfg.WinGetCf
 			}
 			cfg.AddResource(registryKey)
 		case task.TypeAddLocalUser:
-			// decrypt local user password if key is set
-			if w.EncryptionMasterKey != "" {
-				isPasswordEncrypted, err := utils.IsSensitiveFieldEncrypted(t.LocalUserPassword, w.EncryptionMasterKey)
-				if err != nil {
-					return nil, err
-				}
-
-				if isPasswordEncrypted {
-					t.LocalUserPassword, err = utils.DecryptSensitiveField(t.LocalUserPassword, w.EncryptionMasterKey)
-					return nil, err
-				}
-			}
-
 			localUser, err := wingetcfg.AddOrModifyLocalUser(taskID, t.LocalUserUsername, t.LocalUserDescription, t.LocalUserDisable, t.LocalUserFullname, t.LocalUserPassword, t.LocalUserPasswordChangeNotAllowed, t.LocalUserPasswordChangeRequired, t.LocalUserPasswordNeverExpires)
 			if err != nil {
 				return nil, err
@@ -572,14 +588,14 @@ func (w *Worker) GenerateWinGetConfig(profile *ent.Profile) (*wingetcfg.WinGetCf
 	return cfg, nil
 }
 
-func (w *Worker) GenerateAnsibleConfig(profile *ent.Profile, agentID string) (*ansiblecfg.AnsiblePlaybook, error) {
+func (w *Worker) GenerateAnsibleConfig(ctx context.Context, profile *ent.Profile, agentID string) (*ansiblecfg.AnsiblePlaybook, error) {
 	var err error
 
 	if len(profile.Edges.Tasks) == 0 {
 		return nil, nil
 	}
 
-	a, err := w.Model.Client.Agent.Get(context.Background(), agentID)
+	a, err := w.Model().GetAgent(ctx, agentID)
 	if err != nil {
 		return nil, err
 	}
@@ -615,6 +631,11 @@ func (w *Worker) GenerateAnsibleConfig(profile *ent.Profile, agentID string) (*a
 			continue
 		}
 
+		t, err := w.SensitiveFields().Task(t)
+		if err != nil {
+			return nil, err
+		}
+
 		switch t.Type {
 		case task.TypeAddUnixLocalGroup:
 			var gid int
@@ -706,19 +727,6 @@ func (w *Worker) GenerateAnsibleConfig(profile *ent.Profile, agentID string) (*a
 				}
 			}
 
-			// decrypt local user password if key is set
-			if w.EncryptionMasterKey != "" {
-				isAccessTokenEncrypted, err := utils.IsSensitiveFieldEncrypted(t.LocalUserPassword, w.EncryptionMasterKey)
-				if err != nil {
-					return nil, err
-				}
-
-				if isAccessTokenEncrypted {
-					t.LocalUserPassword, err = utils.DecryptSensitiveField(t.LocalUserPassword, w.EncryptionMasterKey)
-					return nil, err
-				}
-			}
-
 			addLinuxUser, err := ansiblecfg.AddLocalUser(fmt.Sprintf("task_%d", t.ID), t.LocalUserAppend, t.LocalUserDescription,
 				t.LocalUserCreateHome, expires, t.LocalUserForce, t.LocalUserGenerateSSHKey, t.LocalUserGroup, t.LocalUserGroups,
 				t.LocalUserHome, t.LocalUserUsername, t.LocalUserNonunique, t.LocalUserPassword, password_expire_account_disable, password_expire_max,
@@ -804,12 +812,12 @@ func (w *Worker) GenerateAnsibleConfig(profile *ent.Profile, agentID string) (*a
 	return pb, nil
 }
 
-func (w *Worker) GenerateNetbirdConfig(profile *ent.Profile, agentID string) ([]*openuem_nats.NetbirdTask, error) {
+func (w *Worker) GenerateNetbirdConfig(ctx context.Context, profile *ent.Profile, agentID string) ([]*openuem_nats.NetbirdTask, error) {
 	if len(profile.Edges.Tasks) == 0 {
 		return []*openuem_nats.NetbirdTask{}, nil
 	}
 
-	a, err := w.Model.Client.Agent.Query().WithNetbird().Where(agent.ID(agentID)).Only(context.Background())
+	a, err := w.Model().GetAgentWithNetbird(ctx, agentID)
 	if err != nil {
 		return nil, err
 	}
@@ -842,26 +850,21 @@ func (w *Worker) GenerateNetbirdConfig(profile *ent.Profile, agentID string) ([]
 				tasks = append(tasks, &nt)
 			}
 		case task.TypeNetbirdRegister:
-			ns, err := w.Model.GetNetbirdSettings(t.Tenant)
+			ns, err := w.Model().GetNetbirdSettings(ctx, t.Tenant)
 			if err != nil {
+				w.Metrics.DBError("GetNetbirdSettings")
 				return nil, err
 			}
 
-			// decrypt NetBird Access token if key is set
-			if w.EncryptionMasterKey != "" {
-				isAccessTokenEncrypted, err := utils.IsSensitiveFieldEncrypted(ns.AccessToken, w.EncryptionMasterKey)
-				if err != nil {
-					return nil, err
-				}
-
-				if isAccessTokenEncrypted {
-					ns.AccessToken, err = utils.DecryptSensitiveField(ns.AccessToken, w.EncryptionMasterKey)
-					return nil, err
-				}
+			ns, err = w.SensitiveFields().NetbirdSettings(ns)
+			if err != nil {
+				return nil, err
 			}
 
 			// check if a netbird peer with this name exists
+			_, span := startClientSpan(ctx, "netbird.PeerExists", attribute.String("netbird.management_url", ns.ManagementURL))
 			exists, err := utils.NetBirdPeerExists(strings.ToLower(a.Hostname), ns.ManagementURL, ns.AccessToken)
+			endSpan(span, err)
 			if err != nil {
 				return nil, err
 			}
@@ -871,7 +874,9 @@ func (w *Worker) GenerateNetbirdConfig(profile *ent.Profile, agentID string) ([]
 				nt.Register = true
 				nt.RegisterInfo = openuem_nats.NetbirdSettings{}
 
+				_, span := startClientSpan(ctx, "netbird.CreateSetupKey", attribute.String("netbird.management_url", ns.ManagementURL))
 				_, key, err := utils.CreateNetBirdOneOffSetupKeyAPI(ns.ManagementURL, agentID, t.NetbirdGroups, t.NetbirdAllowExtraDNSLabels, ns.AccessToken)
+				endSpan(span, err)
 				if err != nil {
 					return nil, err
 				}
@@ -887,67 +892,103 @@ func (w *Worker) GenerateNetbirdConfig(profile *ent.Profile, agentID string) ([]
 }
 
 func (w *Worker) WinGetCfgDeploymentReport(msg *nats.Msg) {
+	logger := messageLogger(msg)
+	ctx, cancel := w.MessageContext(msg)
+	defer cancel()
+
 	deploy := openuem_nats.DeployAction{}
 
-	// log.Println("[DEBUG]: received a wingetcfg.deploy message")
+	logger.Debug("received a wingetcfg.deploy message")
 
 	// Unmarshal data and get agentID
 	if err := json.Unmarshal(msg.Data, &deploy); err != nil {
-		log.Println("[ERROR]: could not unmarshall WinGetCfg deployment action report from agent")
+		logger.Error("could not unmarshall WinGetCfg deployment action report from agent", "error", err)
+		w.FailMessage(msg, Permanent(err))
+		if err := w.respond(msg, nil); err != nil {
+			logger.Error("could not respond to WinGetCfg deployment action report", "error", err)
+		}
+		return
 	}
+	logger = logger.With("agent_id", deploy.AgentId, "package_id", deploy.PackageId)
 
-	// log.Printf("[DEBUG]: deplou info: %v", deploy)
+	logger.Debug("deploy info", "action", deploy.Action, "failed", deploy.Failed)
 
-	if err := w.Model.SaveWinGetDeployInfo(deploy); err != nil {
-		log.Printf("[ERROR]: could not save WinGetCfg deployment action report from agent, reason: %v", err)
+	if err := w.Model().SaveWinGetDeployInfo(ctx, deploy); err != nil {
+		w.Metrics.DBError("SaveWinGetDeployInfo")
+		logger.Error("could not save WinGetCfg deployment action report from agent", "error", err)
+		w.FailMessage(msg, err)
 	}
 
-	if err := msg.Respond(nil); err != nil {
-		log.Printf("[ERROR]: could not respond to WinGetCfg deployment action report, reason: %v\n", err)
+	if err := w.respond(msg, nil); err != nil {
+		logger.Error("could not respond to WinGetCfg deployment action report", "error", err)
 	}
 
-	// log.Println("[DEBUG]: should have responded to wingetcfg.deploy message")
+	logger.Debug("responded to wingetcfg.deploy message")
 }
 
 func (w *Worker) WinGetCfgMarkPackageAsExcluded(msg *nats.Msg) {
+	logger := messageLogger(msg)
+	ctx, cancel := w.MessageContext(msg)
+	defer cancel()
+
 	deploy := openuem_nats.DeployAction{}
 
-	// log.Println("[DEBUG]: received a wingetcfg.deploy message")
+	logger.Debug("received a wingetcfg.exclude message")
 
 	if err := json.Unmarshal(msg.Data, &deploy); err != nil {
-		log.Println("[ERROR]: could not unmarshall WinGetCfg deployment action report from agent")
+		logger.Error("could not unmarshall WinGetCfg deployment action report from agent", "error", err)
+		w.FailMessage(msg, Permanent(err))
+		if err := w.respond(msg, nil); err != nil {
+			logger.Error("could not respond to WinGetCfg deployment action report", "error", err)
+		}
+		return
 	}
+	logger = logger.With("agent_id", deploy.AgentId, "package_id", deploy.PackageId)
 
-	if err := w.Model.MarkPackageAsExcluded(deploy); err != nil {
-		log.Printf("[ERROR]: could not mark package as excluded, reason: %v", err)
+	if err := w.Model().MarkPackageAsExcluded(ctx, deploy); err != nil {
+		w.Metrics.DBError("MarkPackageAsExcluded")
+		logger.Error("could not mark package as excluded", "error", err)
+		w.FailMessage(msg, err)
 	}
 
-	if err := msg.Respond(nil); err != nil {
-		log.Printf("[ERROR]: could not respond to WinGetCfg deployment action report, reason: %v\n", err)
+	if err := w.respond(msg, nil); err != nil {
+		logger.Error("could not respond to WinGetCfg deployment action report", "error", err)
 	}
 
-	// log.Println("[DEBUG]: should have responded to wingetcfg.deploy message")
+	logger.Debug("responded to wingetcfg.exclude message")
 }
 
 func (w *Worker) ProfileReportResponseHandler(msg *nats.Msg) {
+	logger := messageLogger(msg)
+	ctx, cancel := w.MessageContext(msg)
+	defer cancel()
+
 	report := openuem_nats.ProfileReport{}
 
-	// log.Println("[DEBUG]: received a wingetcfg.report message")
+	logger.Debug("received a wingetcfg.report message")
 
 	// Unmarshal data
 	if err := json.Unmarshal(msg.Data, &report); err != nil {
-		log.Println("[ERROR]: could not unmarshall Profile report from agent")
+		logger.Error("could not unmarshall Profile report from agent", "error", err)
+		w.FailMessage(msg, Permanent(err))
+		if err := w.respond(msg, nil); err != nil {
+			logger.Error("could not respond to Profile report", "error", err)
+		}
+		return
 	}
+	logger = logger.With("agent_id", report.AgentID, "profile_id", report.ProfileID)
 
-	// log.Printf("[DEBUG]: wingetcfg.report data, %v", report)
+	logger.Debug("wingetcfg.report data", "tasks", len(report.Tasks))
 
-	if err := w.Model.SaveProfileApplicationIssues(report); err != nil {
-		log.Printf("[ERROR]: could not save Profile report, reason: %v", err)
+	if err := w.Model().SaveProfileApplicationIssues(ctx, report); err != nil {
+		w.Metrics.DBError("SaveProfileApplicationIssues")
+		logger.Error("could not save Profile report", "error", err)
+		w.FailMessage(msg, err)
 	}
 
-	if err := msg.Respond(nil); err != nil {
-		log.Printf("[ERROR]: could not respond to Profile report, reason: %v\n", err)
+	if err := w.respond(msg, nil); err != nil {
+		logger.Error("could not respond to Profile report", "error", err)
 	}
 
-	// log.Println("[DEBUG]: should have responded to wingetcfg.report message")
+	logger.Debug("responded to wingetcfg.report message")
 }
@@ -0,0 +1,126 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+	"github.com/open-uem/ent"
+	openuem_nats "github.com/open-uem/nats"
+	"github.com/open-uem/openuem-worker/internal/models/memory"
+)
+
+// startAgentWorker runs the agent worker's handlers with an embedded NATS server and the memory store
+func startAgentWorker(t *testing.T, store *memory.Store) *nats.Conn {
+	t.Helper()
+
+	s := test.RunRandClientPortServer()
+	t.Cleanup(s.Shutdown)
+
+	nc, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		t.Fatalf("could not connect to the NATS server: %v", err)
+	}
+	t.Cleanup(nc.Close)
+
+	w := NewWorker("")
+	t.Cleanup(w.ContextCancel)
+	w.natsConnection.Store(nc)
+	w.setModel(store)
+	w.DBReady.Store(true)
+
+	if err := w.SubscribeTo(w.agentWorkerSubscriptions()); err != nil {
+		t.Fatalf("could not subscribe: %v", err)
+	}
+	if err := nc.Flush(); err != nil {
+		t.Fatalf("could not flush the subscriptions: %v", err)
+	}
+	return nc
+}
+
+func TestReportReceivedHandler(t *testing.T) {
+	report := openuem_nats.AgentReport{AgentID: "agent-1", Hostname: "host-1", OS: "windows", Netbird: openuem_nats.Netbird{Version: "0.30.0", Installed: true}}
+
+	tests := []struct {
+		name       string
+		dbErr      error
+		failMethod string
+		settings   *ent.Settings
+		wantReply  string
+		wantSaved  bool
+	}{
+		{
+			name:      "saved",
+			settings:  &ent.Settings{AutoAdmitAgents: true},
+			wantReply: "Report received!",
+			wantSaved: true,
+		},
+		{
+			name:      "no general settings",
+			wantReply: "Report received!",
+			wantSaved: true,
+		},
+		{
+			name:       "release info not saved",
+			failMethod: "SaveReleaseInfo",
+			wantReply:  "Report received!",
+			wantSaved:  true,
+		},
+		{
+			name:      "database error",
+			dbErr:     errors.New("connection refused"),
+			wantReply: "connection refused",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := memory.New()
+			if tt.settings != nil {
+				store.SetSettings("", tt.settings)
+			}
+			store.FailWith(tt.dbErr)
+			if tt.failMethod != "" {
+				store.FailMethodWith(tt.failMethod, errors.New("could not query the releases endpoint"))
+			}
+			nc := startAgentWorker(t, store)
+
+			data, err := json.Marshal(report)
+			if err != nil {
+				t.Fatalf("could not marshal the report: %v", err)
+			}
+
+			reply, err := nc.Request("report", data, 5*time.Second)
+			if err != nil {
+				t.Fatalf("no reply to the report: %v", err)
+			}
+			if string(reply.Data) != tt.wantReply {
+				t.Errorf("got reply %q, want %q", reply.Data, tt.wantReply)
+			}
+
+			saved, ok := store.Report(report.AgentID)
+			if ok != tt.wantSaved {
+				t.Fatalf("report saved: %t, want %t", ok, tt.wantSaved)
+			}
+			if !ok {
+				return
+			}
+			if saved.Hostname != report.Hostname {
+				t.Errorf("got hostname %q, want %q", saved.Hostname, report.Hostname)
+			}
+
+			// the sections after the one that failed are saved
+			a, err := store.GetAgent(context.Background(), report.AgentID)
+			if err != nil {
+				t.Fatalf("could not get the agent: %v", err)
+			}
+			if a.Edges.Netbird == nil || a.Edges.Netbird.Version != report.Netbird.Version {
+				t.Errorf("the NetBird info has not been saved")
+			}
+		})
+	}
+}
@@ -0,0 +1,402 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	DefaultCaptureMaxSize  = 100 << 20
+	DefaultCaptureMaxFiles = 5
+)
+
+// CaptureRecord is a message received by the worker and the replies it sent,
+// the capture file has a record per line
+type CaptureRecord struct {
+	Time    time.Time       `json:"time"`
+	Subject string          `json:"subject"`
+	ReplyTo string          `json:"reply_to,omitempty"`
+	AgentID string          `json:"agent_id,omitempty"`
+	Header  nats.Header     `json:"header,omitempty"`
+	Data    CapturePayload  `json:"data"`
+	Replies []CapturedReply `json:"replies,omitempty"`
+}
+
+// CapturedReply is a reply sent by the handler of a captured message
+type CapturedReply struct {
+	Header nats.Header    `json:"header,omitempty"`
+	Data   CapturePayload `json:"data"`
+}
+
+// CapturePayload is written as it is if it's a JSON object or array so the capture file
+// can be read, other payloads are base64 encoded
+type CapturePayload []byte
+
+func (p CapturePayload) MarshalJSON() ([]byte, error) {
+	trimmed := bytes.TrimSpace(p)
+	if len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') && json.Valid(trimmed) {
+		return trimmed, nil
+	}
+	return json.Marshal([]byte(p))
+}
+
+func (p *CapturePayload) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && (data[0] == '{' || data[0] == '[') {
+		*p = slices.Clone(data)
+		return nil
+	}
+
+	var b []byte
+	if err := json.Unmarshal(data, &b); err != nil {
+		return err
+	}
+	*p = b
+	return nil
+}
+
+// Equal reports if both payloads have the same content, JSON payloads are compared without their whitespace
+func (p CapturePayload) Equal(other CapturePayload) bool {
+	if bytes.Equal(p, other) {
+		return true
+	}
+
+	a, b := &bytes.Buffer{}, &bytes.Buffer{}
+	if json.Compact(a, p) != nil || json.Compact(b, other) != nil {
+		return false
+	}
+	return bytes.Equal(a.Bytes(), b.Bytes())
+}
+
+func (p CapturePayload) String() string {
+	if len(p) == 0 {
+		return "<empty>"
+	}
+	data, err := p.MarshalJSON()
+	if err != nil {
+		return strconv.Quote(string(p))
+	}
+	return string(data)
+}
+
+// CaptureFilter selects the messages that are captured or replayed, an empty filter selects them all
+type CaptureFilter struct {
+	Agents   []string
+	Subjects []string
+}
+
+// Matches reports if the message of the agent has been received on one of the subjects,
+// the subjects can use the * and > wildcards
+func (f CaptureFilter) Matches(subject, agentID string) bool {
+	if len(f.Agents) > 0 && !slices.Contains(f.Agents, agentID) {
+		return false
+	}
+	if len(f.Subjects) > 0 && !slices.ContainsFunc(f.Subjects, func(filter string) bool {
+		return SubjectMatches(filter, subject)
+	}) {
+		return false
+	}
+	return true
+}
+
+// messageAgentID returns the ID of the agent that sent the message, the agents'
+// messages have it in the id, agentid or agentID field
+func messageAgentID(data []byte) string {
+	ids := struct {
+		ID      string `json:"id"`
+		AgentID string `json:"agentid"`
+	}{}
+	if err := json.Unmarshal(data, &ids); err != nil {
+		return ""
+	}
+	if ids.AgentID != "" {
+		return ids.AgentID
+	}
+	return ids.ID
+}
+
+// captureEntry collects the replies of a message while its handler runs, the
+// replies of replayed messages are collected but not sent
+type captureEntry struct {
+	mu     sync.Mutex
+	record CaptureRecord
+	replay bool
+}
+
+func newCaptureEntry(msg *nats.Msg, agentID string, replay bool) *captureEntry {
+	header := nats.Header{}
+	for k, v := range msg.Header {
+		header[k] = slices.Clone(v)
+	}
+
+	return &captureEntry{
+		record: CaptureRecord{
+			Time:    time.Now().UTC(),
+			Subject: msg.Subject,
+			ReplyTo: msg.Reply,
+			AgentID: agentID,
+			Header:  header,
+			Data:    slices.Clone(msg.Data),
+		},
+		replay: replay,
+	}
+}
+
+func (e *captureEntry) addReply(reply *nats.Msg) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.record.Replies = append(e.record.Replies, CapturedReply{Header: reply.Header, Data: slices.Clone(reply.Data)})
+}
+
+func (e *captureEntry) replies() []CapturedReply {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return slices.Clone(e.record.Replies)
+}
+
+// captureFile writes the records to a file that is rotated when it reaches its max size,
+// the rotated files get a numeric suffix and the oldest one is removed
+type captureFile struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int
+	maxFiles int
+	filter   CaptureFilter
+	file     *os.File
+	size     int
+}
+
+func openCaptureFile(path string, maxSize, maxFiles int, filter CaptureFilter) (*captureFile, error) {
+	c := &captureFile{path: path, maxSize: maxSize, maxFiles: maxFiles, filter: filter}
+	if c.maxSize <= 0 {
+		c.maxSize = DefaultCaptureMaxSize
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return nil, fmt.Errorf("could not create the capture directory, reason: %v", err)
+	}
+	if err := c.open(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// open opens the capture file for appending, it may contain secrets so only the worker's user can read it
+func (c *captureFile) open() error {
+	f, err := os.OpenFile(c.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("could not open the capture file, reason: %v", err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("could not read the capture file size, reason: %v", err)
+	}
+
+	c.file = f
+	c.size = int(info.Size())
+	return nil
+}
+
+func (c *captureFile) write(r CaptureRecord) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.file == nil {
+		return fmt.Errorf("the capture file has been closed")
+	}
+
+	if c.size > 0 && c.size+len(line) > c.maxSize {
+		if err := c.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := c.file.Write(line)
+	c.size += n
+	return err
+}
+
+// rotate renames the capture file to path.1, the previous rotated files are shifted
+func (c *captureFile) rotate() error {
+	if err := c.file.Close(); err != nil {
+		slog.Warn("could not close the capture file", "error", err)
+	}
+	c.file = nil
+
+	if c.maxFiles <= 0 {
+		if err := os.Remove(c.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("could not remove the capture file, reason: %v", err)
+		}
+		return c.open()
+	}
+
+	if err := os.Remove(c.rotatedPath(c.maxFiles)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("could not remove the oldest capture file, reason: %v", err)
+	}
+	for i := c.maxFiles - 1; i >= 1; i-- {
+		if err := os.Rename(c.rotatedPath(i), c.rotatedPath(i+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("could not rotate the capture file, reason: %v", err)
+		}
+	}
+	if err := os.Rename(c.path, c.rotatedPath(1)); err != nil {
+		return fmt.Errorf("could not rotate the capture file, reason: %v", err)
+	}
+
+	return c.open()
+}
+
+func (c *captureFile) rotatedPath(i int) string {
+	return c.path + "." + strconv.Itoa(i)
+}
+
+func (c *captureFile) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.file == nil {
+		return nil
+	}
+	err := c.file.Close()
+	c.file = nil
+	return err
+}
+
+// StartCapture writes the messages selected by the capture filter and their replies to the capture
+// file, the previous capture file is closed. Nothing is captured if the capture file hasn't been set
+func (w *Worker) StartCapture() error {
+	var c *captureFile
+	if w.CaptureFile != "" {
+		var err error
+		c, err = openCaptureFile(w.CaptureFile, w.CaptureMaxSize, w.CaptureMaxFiles, CaptureFilter{Agents: w.CaptureAgents, Subjects: w.CaptureSubjects})
+		if err != nil {
+			return err
+		}
+		slog.Warn("the messages are being captured, the capture file may contain secrets", "file", w.CaptureFile, "agents", w.CaptureAgents, "subjects", w.CaptureSubjects)
+	}
+
+	if old := w.capture.Swap(c); old != nil {
+		if err := old.close(); err != nil {
+			slog.Error("could not close the capture file", "error", err)
+		}
+	}
+	return nil
+}
+
+// StopCapture closes the capture file
+func (w *Worker) StopCapture() {
+	if c := w.capture.Swap(nil); c != nil {
+		if err := c.close(); err != nil {
+			slog.Error("could not close the capture file", "error", err)
+		}
+	}
+}
+
+// Capture wraps a NATS handler so the message and the replies sent by the handler
+// are written to the capture file if the message matches the capture filter
+func (w *Worker) Capture(handler nats.MsgHandler) nats.MsgHandler {
+	return func(msg *nats.Msg) {
+		c := w.capture.Load()
+		if c == nil {
+			handler(msg)
+			return
+		}
+
+		agentID := messageAgentID(msg.Data)
+		if !c.filter.Matches(msg.Subject, agentID) {
+			handler(msg)
+			return
+		}
+
+		entry := newCaptureEntry(msg, agentID, false)
+		w.captures.Store(msg, entry)
+		handler(msg)
+		w.captures.Delete(msg)
+
+		entry.mu.Lock()
+		record := entry.record
+		entry.mu.Unlock()
+		if err := c.write(record); err != nil {
+			messageLogger(msg).Warn("could not write the message to the capture file", "error", err)
+		}
+	}
+}
+
+// respond replies to request/reply messages, messages consumed from JetStream have no reply subject
+func (w *Worker) respond(msg *nats.Msg, data []byte) error {
+	return w.respondMsg(msg, &nats.Msg{Data: data})
+}
+
+// respondMsg replies with a message that may have headers, the reply is added to the
+// capture of the message and it's not sent if the message is being replayed
+func (w *Worker) respondMsg(msg *nats.Msg, reply *nats.Msg) error {
+	if msg.Reply == "" {
+		return nil
+	}
+
+	if e, ok := w.captures.Load(msg); ok {
+		entry := e.(*captureEntry)
+		entry.addReply(reply)
+		if entry.replay {
+			return nil
+		}
+	}
+	return msg.RespondMsg(reply)
+}
+
+// isReplay reports if the message is being replayed from a capture file
+func (w *Worker) isReplay(msg *nats.Msg) bool {
+	e, ok := w.captures.Load(msg)
+	return ok && e.(*captureEntry).replay
+}
+
+// ReadCaptureFile calls fn with every record of the capture file in order
+func ReadCaptureFile(path string, fn func(CaptureRecord) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("could not open the capture file, reason: %v", err)
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for line := 1; ; line++ {
+		data, err := r.ReadBytes('\n')
+		if len(bytes.TrimSpace(data)) > 0 {
+			record := CaptureRecord{}
+			if err := json.Unmarshal(data, &record); err != nil {
+				return fmt.Errorf("could not parse the line %d of the capture file, reason: %v", line, err)
+			}
+			if err := fn(record); err != nil {
+				return err
+			}
+		}
+
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("could not read the capture file, reason: %v", err)
+		}
+	}
+}
@@ -3,14 +3,15 @@ package common
 import (
 	"archive/zip"
 	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"os"
 	"strings"
 	"time"
@@ -24,38 +25,24 @@ import (
 )
 
 func (w *Worker) SubscribeToCertManagerWorkerQueues() error {
+	return w.SubscribeTo(w.certManagerWorkerSubscriptions())
+}
 
-	_, err := w.NATSConnection.QueueSubscribe("certificates.user", "openuem-cert-manager", w.NewUserCertificateHandler)
-	if err != nil {
-		log.Printf("[ERROR]: could not subscribe to certificates.user, reason: %v", err)
-		return err
-	}
-	log.Printf("[INFO]: subscribed to queue certificates.user")
-
-	_, err = w.NATSConnection.QueueSubscribe("certificates.revoke", "openuem-cert-manager", w.RevokeCertificateHandler)
-	if err != nil {
-		log.Printf("[ERROR]: could not subscribe to certificates.revoke, reason: %v", err)
-		return err
-	}
-	log.Printf("[INFO]: subscribed to queue certificates.revoke")
-
-	_, err = w.NATSConnection.QueueSubscribe("certificates.agent.*", "openuem-cert-manager", w.NewAgentCertificateHandler)
-	if err != nil {
-		log.Printf("[ERROR]: could not subscribe to certificates.agent.*, reason: %v", err)
-		return err
+// certManagerWorkerSubscriptions returns the subscriptions of the cert-manager worker
+// the certificate handlers issue certificates, write files and publish emails so they can't be replayed
+func (w *Worker) certManagerWorkerSubscriptions() []Subscription {
+	return []Subscription{
+		{Subject: "certificates.user", Queue: "openuem-cert-manager", Handler: w.NewUserCertificateHandler, Serial: true, NoReplay: true},
+		{Subject: "certificates.revoke", Queue: "openuem-cert-manager", Handler: w.RevokeCertificateHandler, SkipDBCheck: true, NoReplay: true},
+		{Subject: "certificates.agent.*", Queue: "openuem-cert-manager", Handler: w.NewAgentCertificateHandler, Serial: true, NoReplay: true},
+		{Subject: "ping.certmanagerworker", Queue: "openuem-cert-manager", Handler: w.PingHandler, SkipDBCheck: true},
+		{Subject: StatusSubject, Handler: w.PingHandler, SkipDBCheck: true},
 	}
-	log.Printf("[INFO]: subscribed to queue certificates.agent")
-
-	_, err = w.NATSConnection.QueueSubscribe("ping.certmanagerworker", "openuem-cert-manager", w.PingHandler)
-	if err != nil {
-		log.Printf("[ERROR]: could not subscribe to ping.certmanagerworker, reason: %v", err)
-		return err
-	}
-	log.Printf("[INFO]: subscribed to queue ping.certmanagerworker")
-	return nil
 }
 
 func (w *Worker) GenerateUserCertificate() error {
+	settings := w.liveSettings()
+
 	var err error
 	template, err := w.NewX509UserCertificateTemplate()
 	if err != nil {
@@ -67,7 +54,7 @@ func (w *Worker) GenerateUserCertificate() error {
 		return err
 	}
 
-	certBytes, err := x509.CreateCertificate(rand.Reader, template, w.CACert, &certPrivKey.PublicKey, w.CAPrivateKey)
+	certBytes, err := x509.CreateCertificate(rand.Reader, template, settings.CACert, &certPrivKey.PublicKey, settings.CAPrivateKey)
 	if err != nil {
 		return err
 	}
@@ -82,7 +69,7 @@ func (w *Worker) GenerateUserCertificate() error {
 		password = pkcs12.DefaultPassword
 	}
 
-	w.PKCS12, err = pkcs12.Modern.Encode(certPrivKey, w.Cert, []*x509.Certificate{w.CACert}, password)
+	w.PKCS12, err = pkcs12.Modern.Encode(certPrivKey, w.Cert, []*x509.Certificate{settings.CACert}, password)
 	if err != nil {
 		return err
 	}
@@ -91,6 +78,8 @@ func (w *Worker) GenerateUserCertificate() error {
 }
 
 func (w *Worker) GenerateAgentCertificate() error {
+	settings := w.liveSettings()
+
 	var err error
 	template, err := w.NewX509AgentCertificateTemplate()
 	if err != nil {
@@ -102,7 +91,7 @@ func (w *Worker) GenerateAgentCertificate() error {
 		return err
 	}
 
-	certBytes, err := x509.CreateCertificate(rand.Reader, template, w.CACert, &w.PrivateKey.PublicKey, w.CAPrivateKey)
+	certBytes, err := x509.CreateCertificate(rand.Reader, template, settings.CACert, &w.PrivateKey.PublicKey, settings.CAPrivateKey)
 	if err != nil {
 		return err
 	}
@@ -117,6 +106,8 @@ func (w *Worker) GenerateAgentCertificate() error {
 }
 
 func (w *Worker) NewX509UserCertificateTemplate() (*x509.Certificate, error) {
+	settings := w.liveSettings()
+
 	serialNumber, err := utils.GenerateSerialNumber()
 	if err != nil {
 		return nil, err
@@ -133,16 +124,18 @@ func (w *Worker) NewX509UserCertificateTemplate() (*x509.Certificate, error) {
 			StreetAddress: []string{w.CertRequest.Address},
 			PostalCode:    []string{w.CertRequest.PostalCode},
 		},
-		Issuer:      w.CACert.Subject,
+		Issuer:      settings.CACert.Subject,
 		NotBefore:   time.Now().Add(-5 * time.Minute).UTC(),
 		NotAfter:    time.Now().AddDate(w.CertRequest.YearsValid, w.CertRequest.MonthsValid, w.CertRequest.DaysValid),
 		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
 		KeyUsage:    x509.KeyUsageDigitalSignature,
-		OCSPServer:  w.OCSPResponders,
+		OCSPServer:  settings.OCSPResponders,
 	}, nil
 }
 
 func (w *Worker) NewX509AgentCertificateTemplate() (*x509.Certificate, error) {
+	settings := w.liveSettings()
+
 	serialNumber, err := utils.GenerateSerialNumber()
 	if err != nil {
 		return nil, err
@@ -159,83 +152,104 @@ func (w *Worker) NewX509AgentCertificateTemplate() (*x509.Certificate, error) {
 			StreetAddress: []string{w.CertRequest.Address},
 			PostalCode:    []string{w.CertRequest.PostalCode},
 		},
-		Issuer:      w.CACert.Subject,
+		Issuer:      settings.CACert.Subject,
 		DNSNames:    []string{strings.ToLower(w.CertRequest.DNSName)},
 		NotBefore:   time.Now().Add(-5 * time.Minute).UTC(),
 		NotAfter:    time.Now().AddDate(w.CertRequest.YearsValid, w.CertRequest.MonthsValid, w.CertRequest.DaysValid),
 		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 		KeyUsage:    x509.KeyUsageDigitalSignature,
-		OCSPServer:  w.OCSPResponders,
+		OCSPServer:  settings.OCSPResponders,
 	}, nil
 }
 
 func (w *Worker) NewUserCertificateHandler(msg *nats.Msg) {
+	logger := messageLogger(msg)
+	ctx, cancel := w.MessageContext(msg)
+	defer cancel()
 
 	// Read message
 	cr := openuem_nats.CertificateRequest{}
 	if err := json.Unmarshal(msg.Data, &cr); err != nil {
-		log.Printf("[ERROR]: could not unmarshall new certificate request, reason: %v", err)
-		msg.NakWithDelay(5 * time.Minute)
+		logger.Error("could not unmarshall new certificate request", "error", err)
+		w.FailMessage(msg, Permanent(err))
 		return
 	}
 	w.CertRequest = &cr
+	logger = logger.With("username", cr.Username)
 
 	if err := w.GenerateUserCertificate(); err != nil {
-		log.Printf("[ERROR]: could not generate the user certificate, reason: %v", err)
+		logger.Error("could not generate the user certificate", "error", err)
+		w.FailMessage(msg, err)
 		msg.NakWithDelay(5 * time.Minute)
 		return
 	}
+	logger = logger.With("serial", w.Cert.SerialNumber.String())
 
-	if err := w.SendCertificate(); err != nil {
-		log.Printf("[ERROR]: could not send the user certificate, reason: %v", err)
+	if err := w.SendCertificate(ctx); err != nil {
+		logger.Error("could not send the user certificate", "error", err)
+		w.FailMessage(msg, err)
 		msg.NakWithDelay(5 * time.Minute)
 		return
 	}
 
 	certDescription := w.CertRequest.Username + " client certificate"
-	if err := w.Model.SaveCertificate(w.Cert.SerialNumber.Int64(), certificate.Type("user"), w.CertRequest.Username, certDescription, w.Cert.NotAfter); err != nil {
-		log.Println("[ERROR]: error saving certificate status", err.Error())
+	if err := w.Model().SaveCertificate(ctx, w.Cert.SerialNumber.Int64(), certificate.Type("user"), w.CertRequest.Username, certDescription, w.Cert.NotAfter); err != nil {
+		w.Metrics.DBError("SaveCertificate")
+		logger.Error("error saving certificate status", "error", err)
+		w.FailMessage(msg, err)
 		msg.NakWithDelay(5 * time.Minute)
 		return
 	}
 
-	if err := w.Model.SetCertificateSent(w.CertRequest.Username); err != nil {
-		log.Println("[ERROR]: error saving certificate status", err.Error())
+	if err := w.Model().SetCertificateSent(ctx, w.CertRequest.Username); err != nil {
+		w.Metrics.DBError("SetCertificateSent")
+		logger.Error("error saving certificate status", "error", err)
+		w.FailMessage(msg, err)
 		msg.NakWithDelay(5 * time.Minute)
 		return
 	}
 
 	// If certificate has been sent we also set email as verified in case it wasn't (import users)
-	if err := w.Model.SetEmailVerified(w.CertRequest.Username); err != nil {
-		log.Println("[ERROR]: error saving certificate status", err.Error())
+	if err := w.Model().SetEmailVerified(ctx, w.CertRequest.Username); err != nil {
+		w.Metrics.DBError("SetEmailVerified")
+		logger.Error("error saving certificate status", "error", err)
+		w.FailMessage(msg, err)
 		msg.NakWithDelay(5 * time.Minute)
 		return
 	}
 
 	if err := msg.Ack(); err != nil {
-		log.Println("[ERROR]: could not send response", err.Error())
+		logger.Error("could not send response", "error", err)
 		return
 	}
 }
 
 func (w *Worker) NewAgentCertificateHandler(msg *nats.Msg) {
+	logger := messageLogger(msg)
+	ctx, cancel := w.MessageContext(msg)
+	defer cancel()
+
 	// Read message
 	cr := openuem_nats.CertificateRequest{}
 	if err := json.Unmarshal(msg.Data, &cr); err != nil {
-		log.Printf("[ERROR]: could not unmarshall new certificate request, reason: %v", err)
-		msg.Ack()
+		logger.Error("could not unmarshall new certificate request", "error", err)
+		w.FailMessage(msg, Permanent(err))
 		return
 	}
 	w.CertRequest = &cr
+	logger = logger.With("agent_id", cr.AgentId)
 
 	if err := w.GenerateAgentCertificate(); err != nil {
-		log.Printf("[ERROR]: could not generate the agent certificate, reason: %v", err)
+		logger.Error("could not generate the agent certificate", "error", err)
+		w.FailMessage(msg, err)
 		msg.Ack()
 		return
 	}
+	logger = logger.With("serial", w.Cert.SerialNumber.String())
 
-	if w.NATSConnection == nil || !w.NATSConnection.IsConnected() {
-		log.Println("[ERROR]: could not send the agent certificate to the agent, reason: NATS is not connected")
+	if nc := w.NATSConnection(); nc == nil || !nc.IsConnected() {
+		logger.Error("could not send the agent certificate to the agent, reason: NATS is not connected")
+		w.FailMessage(msg, errors.New("NATS is not connected"))
 		msg.NakWithDelay(10 * time.Minute)
 		return
 	}
@@ -245,39 +259,44 @@ func (w *Worker) NewAgentCertificateHandler(msg *nats.Msg) {
 		PrivateKeyBytes: x509.MarshalPKCS1PrivateKey(w.PrivateKey),
 	})
 	if err != nil {
-		log.Println("[ERROR]: could not marshal data with agent certificate, reason: NATS is not connected")
+		logger.Error("could not marshal data with agent certificate", "error", err)
+		w.FailMessage(msg, err)
 		msg.Ack()
 		return
 	}
 
-	err = w.NATSConnection.Publish("agent.certificate."+cr.AgentId, certData)
-	if err != nil {
-		log.Printf("[ERROR]: could not publish the agent certificate message, reason: %v", err)
+	if err := w.Publish(ctx, "agent.certificate."+cr.AgentId, certData); err != nil {
+		logger.Error("could not publish the agent certificate message", "error", err)
+		w.FailMessage(msg, err)
 		msg.NakWithDelay(10 * time.Minute)
 		return
 	}
 
 	certDescription := w.CertRequest.DNSName + " agent certificate"
 
-	if err := w.Model.RevokePreviousCertificates(certDescription); err != nil {
-		log.Printf("[ERROR]: could not revoke previous certificate, reason: %v", err)
+	if err := w.Model().RevokePreviousCertificates(ctx, certDescription); err != nil {
+		w.Metrics.DBError("RevokePreviousCertificates")
+		logger.Error("could not revoke previous certificate", "error", err)
 	}
 
-	if err := w.Model.SaveCertificate(w.Cert.SerialNumber.Int64(), certificate.Type("agent"), "", certDescription, w.Cert.NotAfter); err != nil {
-		log.Println("[ERROR]: error saving certificate status", err.Error())
+	if err := w.Model().SaveCertificate(ctx, w.Cert.SerialNumber.Int64(), certificate.Type("agent"), "", certDescription, w.Cert.NotAfter); err != nil {
+		w.Metrics.DBError("SaveCertificate")
+		logger.Error("error saving certificate status", "error", err)
+		w.FailMessage(msg, err)
 		msg.NakWithDelay(10 * time.Minute)
 		return
 	}
 }
 
 func (w *Worker) RevokeCertificateHandler(msg *nats.Msg) {
+	logger := messageLogger(msg)
 	if err := msg.Ack(); err != nil {
-		log.Println("[ERROR]: could not send response", err.Error())
+		logger.Error("could not send response", "error", err)
 		return
 	}
 }
 
-func (w *Worker) SendCertificate() error {
+func (w *Worker) SendCertificate(ctx context.Context) error {
 
 	// Read the CA certificate file to attach it to the message
 	caCert, err := os.ReadFile(w.CACertPath)
@@ -322,11 +341,7 @@ func (w *Worker) SendCertificate() error {
 		return err
 	}
 
-	if w.NATSConnection == nil || !w.NATSConnection.IsConnected() {
-		return err
-	}
-
-	if err := w.NATSConnection.Publish("notification.send_certificate", data); err != nil {
+	if err := w.Publish(ctx, "notification.send_certificate", data); err != nil {
 		return err
 	}
 
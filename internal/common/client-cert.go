@@ -0,0 +1,243 @@
+package common
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-co-op/gocron/v2"
+	"github.com/open-uem/ent/certificate"
+	"github.com/open-uem/utils"
+)
+
+const (
+	CertWatchInterval      = 1 * time.Minute
+	DefaultCertRenewBefore = 30 * 24 * time.Hour
+)
+
+// DefaultCertExpiryWarnings are the times before the client certificate expires
+// when a warning is logged
+var DefaultCertExpiryWarnings = []time.Duration{30 * 24 * time.Hour, 7 * 24 * time.Hour, 24 * time.Hour}
+
+// StartCertWatchJob checks the worker's NATS client certificate periodically, it warns when
+// the certificate is about to expire and reconnects to NATS when the files are replaced
+func (w *Worker) StartCertWatchJob() {
+	if w.TaskScheduler == nil {
+		return
+	}
+
+	w.CheckClientCertificate()
+
+	var err error
+	w.CertWatchJob, err = w.TaskScheduler.NewJob(
+		gocron.DurationJob(CertWatchInterval),
+		gocron.NewTask(w.CheckClientCertificate),
+		gocron.WithSingletonMode(gocron.LimitModeReschedule),
+	)
+	if err != nil {
+		slog.Error("could not start the client certificate watch job", "error", err)
+		return
+	}
+	slog.Info("new client certificate watch job has been scheduled", "every", CertWatchInterval)
+}
+
+func (w *Worker) CheckClientCertificate() {
+	w.natsMu.Lock()
+	certPath, keyPath := w.ClientCertPath, w.ClientKeyPath
+	w.natsMu.Unlock()
+
+	if certPath == "" || keyPath == "" {
+		return
+	}
+
+	state := fileState(certPath) + ":" + fileState(keyPath)
+	if state != w.clientCertState {
+		pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			// the files may be being replaced, they're checked again in the next run
+			slog.Warn("could not load the client certificate", "cert", certPath, "key", keyPath, "error", err)
+			return
+		}
+
+		cert, err := x509.ParseCertificate(pair.Certificate[0])
+		if err != nil {
+			slog.Error("could not parse the client certificate", "cert", certPath, "error", err)
+			return
+		}
+
+		replaced := w.clientCertState != ""
+		w.clientCertState = state
+		w.clientCertNotAfter.Store(cert.NotAfter.Unix())
+		w.certWarnedThreshold = 0
+
+		if replaced {
+			w.Metrics.ClientCertReloads.Inc()
+			slog.Info("client certificate has been replaced", "serial", cert.SerialNumber.String(), "not_after", cert.NotAfter)
+
+			// the NATS client reads the certificate files on every connection,
+			// the subscriptions and queue groups are kept when it reconnects
+			if nc := w.NATSConnection(); nc != nil && nc.IsConnected() {
+				if err := nc.ForceReconnect(); err != nil {
+					slog.Error("could not reconnect to NATS with the new client certificate", "error", err)
+				}
+			}
+		}
+	}
+
+	remaining := time.Until(time.Unix(w.clientCertNotAfter.Load(), 0))
+	w.warnClientCertExpiry(remaining)
+
+	if w.HasRole(CertManagerWorkerRole) && w.CertSelfRenew && remaining < w.CertRenewBefore {
+		if err := w.RenewClientCertificate(); err != nil {
+			slog.Error("could not renew the client certificate", "error", err)
+		}
+	}
+}
+
+// warnClientCertExpiry logs a warning once for each threshold reached
+func (w *Worker) warnClientCertExpiry(remaining time.Duration) {
+	notAfter := time.Unix(w.clientCertNotAfter.Load(), 0)
+
+	if remaining <= 0 {
+		if w.certWarnedThreshold != -1 {
+			slog.Error("client certificate has expired, the worker can't connect to NATS", "not_after", notAfter)
+			w.certWarnedThreshold = -1
+		}
+		return
+	}
+
+	threshold := time.Duration(0)
+	for _, t := range w.CertExpiryWarnings {
+		if remaining <= t && (threshold == 0 || t < threshold) {
+			threshold = t
+		}
+	}
+
+	if threshold == 0 || threshold == w.certWarnedThreshold {
+		return
+	}
+	w.certWarnedThreshold = threshold
+
+	slog.Warn("client certificate is about to expire", "expires_in", remaining.Round(time.Minute), "not_after", notAfter, "threshold", threshold)
+}
+
+// ClientCertExpiring reports if the client certificate has reached any of the warning thresholds
+func (w *Worker) ClientCertExpiring() bool {
+	notAfter := w.clientCertNotAfter.Load()
+	if notAfter == 0 || len(w.CertExpiryWarnings) == 0 {
+		return false
+	}
+	return time.Until(time.Unix(notAfter, 0)) <= slices.Max(w.CertExpiryWarnings)
+}
+
+// RenewClientCertificate issues a new client certificate for the worker using the CA
+// held by the cert-manager, the new files are detected by the certificate watch job
+func (w *Worker) RenewClientCertificate() error {
+	settings := w.liveSettings()
+
+	if settings.CACert == nil || settings.CAPrivateKey == nil {
+		return fmt.Errorf("the CA certificate and private key are required to renew the client certificate")
+	}
+
+	current, err := utils.ReadPEMCertificate(w.ClientCertPath)
+	if err != nil {
+		return err
+	}
+
+	serialNumber, err := utils.GenerateSerialNumber()
+	if err != nil {
+		return err
+	}
+
+	validity := current.NotAfter.Sub(current.NotBefore)
+	if validity <= w.CertRenewBefore {
+		return fmt.Errorf("the certificate is valid for %s which is not longer than the renewal period %s", validity, w.CertRenewBefore)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      current.Subject,
+		Issuer:       settings.CACert.Subject,
+		DNSNames:     current.DNSNames,
+		IPAddresses:  current.IPAddresses,
+		NotBefore:    time.Now().Add(-5 * time.Minute).UTC(),
+		NotAfter:     time.Now().Add(validity).UTC(),
+		ExtKeyUsage:  current.ExtKeyUsage,
+		KeyUsage:     current.KeyUsage,
+		OCSPServer:   settings.OCSPResponders,
+	}
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, 4096)
+	if err != nil {
+		return err
+	}
+
+	certBytes, err := x509.CreateCertificate(rand.Reader, template, settings.CACert, &privateKey.PublicKey, settings.CAPrivateKey)
+	if err != nil {
+		return err
+	}
+
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certBytes})
+
+	if err := writeFileAtomic(w.ClientKeyPath, keyPEM, 0600); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(w.ClientCertPath, certPEM, 0644); err != nil {
+		return err
+	}
+
+	slog.Info("client certificate has been renewed", "serial", serialNumber.String(), "not_after", template.NotAfter)
+
+	if w.Model() != nil && w.DBReady.Load() {
+		ctx, cancel := context.WithTimeout(w.Context, 10*time.Second)
+		defer cancel()
+
+		description := strings.TrimSpace(current.Subject.CommonName + " worker certificate")
+		if err := w.Model().SaveCertificate(ctx, serialNumber.Int64(), certificate.TypeWorker, "", description, template.NotAfter); err != nil {
+			w.Metrics.DBError("SaveCertificate")
+			slog.Error("could not save the renewed client certificate", "error", err)
+		}
+	}
+
+	// connect with the new certificate now instead of waiting for the next check
+	w.CheckClientCertificate()
+
+	return nil
+}
+
+// writeFileAtomic writes the file in a temporary file that replaces the original
+// so readers never see a partially written file
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Chmod(tmp, perm); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,321 @@
+package common
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/open-uem/openuem-worker/internal/models"
+)
+
+// configKey describes a setting and the places where it can be set, its name is
+// the CLI flag and the YAML key, INIKey may contain {role} that is replaced with
+// the prefix of the worker's role e.g (AgentWorker)
+type configKey struct {
+	Name    string
+	Env     string
+	Section string
+	INIKey  string
+	Default string
+	// Secret values are redacted when the configuration is printed and
+	// they can be references to a secret provider e.g (vault://secret/data/openuem#db_password)
+	Secret bool
+	// Required settings must be set in one of the layers
+	Required bool
+	// Role settings are only read by that role, every role reads them if empty
+	Role string
+	// Allowed contains the valid values, any value is valid if empty
+	Allowed []string
+	value   configValue
+}
+
+// configValue converts the setting between its text form and its field in Config
+type configValue struct {
+	set func(c *Config, v string) error
+	get func(c *Config) string
+}
+
+// configKeys contains every setting of the worker in the order they're printed
+var configKeys = []configKey{
+	{Name: "nats-servers", Env: "NATS_SERVERS", Section: "NATS", INIKey: "NATSServers", Required: true,
+		value: stringSetting(func(c *Config) *string { return &c.NATSServers })},
+	{Name: "cacert", Env: "CA_CRT_FILENAME", Section: "Certificates", INIKey: "CACert", Default: "certificates/ca.cer",
+		value: pathSetting(func(c *Config) *string { return &c.CACertPath })},
+	{Name: "cert", Env: "CERT_FILENAME", Section: "Certificates", INIKey: "{role}Cert", Default: "certificates/worker.cer",
+		value: pathSetting(func(c *Config) *string { return &c.ClientCertPath })},
+	{Name: "key", Env: "KEY_FILENAME", Section: "Certificates", INIKey: "{role}Key", Default: "certificates/worker.key",
+		value: pathSetting(func(c *Config) *string { return &c.ClientKeyPath })},
+	{Name: "dburl", Env: "DATABASE_URL", Section: "DB", Required: true, Secret: true,
+		value: stringSetting(func(c *Config) *string { return &c.DBUrl })},
+	{Name: "db-password", Env: "DATABASE_PASSWORD", Secret: true,
+		value: stringSetting(func(c *Config) *string { return &c.DBPassword })},
+	{Name: "db-max-open-conns", Env: "DB_MAX_OPEN_CONNS", Section: "Workers", INIKey: "DBMaxOpenConns", Default: strconv.Itoa(models.DefaultPoolConfig().MaxOpenConns),
+		value: intSetting(func(c *Config) *int { return &c.DBPool.MaxOpenConns })},
+	{Name: "db-max-idle-conns", Env: "DB_MAX_IDLE_CONNS", Section: "Workers", INIKey: "DBMaxIdleConns", Default: strconv.Itoa(models.DefaultPoolConfig().MaxIdleConns),
+		value: intSetting(func(c *Config) *int { return &c.DBPool.MaxIdleConns })},
+	{Name: "db-conn-max-lifetime", Env: "DB_CONN_MAX_LIFETIME", Section: "Workers", INIKey: "DBConnMaxLifetime", Default: formatDuration(models.DefaultPoolConfig().ConnMaxLifetime),
+		value: durationSetting(func(c *Config) *time.Duration { return &c.DBPool.ConnMaxLifetime })},
+	{Name: "db-conn-max-idle-time", Env: "DB_CONN_MAX_IDLE_TIME", Section: "Workers", INIKey: "DBConnMaxIdleTime", Default: formatDuration(models.DefaultPoolConfig().ConnMaxIdleTime),
+		value: durationSetting(func(c *Config) *time.Duration { return &c.DBPool.ConnMaxIdleTime })},
+	{Name: "auto-migrate", Env: "AUTO_MIGRATE", Section: "Workers", INIKey: "AutoMigrate", Default: "false",
+		value: boolSetting(func(c *Config) *bool { return &c.AutoMigrate })},
+	{Name: "encryption-master-key", Env: "ENCRYPTION_MASTER_KEY", Secret: true,
+		value: stringSetting(func(c *Config) *string { return &c.EncryptionMasterKey })},
+	{Name: "encryption-key-id", Env: "ENCRYPTION_KEY_ID", Default: DefaultEncryptionKeyID,
+		value: stringSetting(func(c *Config) *string { return &c.EncryptionKeyID })},
+	{Name: "encryption-retired-keys", Env: "ENCRYPTION_RETIRED_KEYS", Secret: true,
+		value: parsedSetting(func(c *Config) *map[string]string { return &c.EncryptionRetiredKeys }, ParseEncryptionKeys, mapFormatter(func(s string) string { return s }))},
+	{Name: "vault-address", Env: "VAULT_ADDR", Section: "Workers", INIKey: "VaultAddress",
+		value: stringSetting(func(c *Config) *string { return &c.VaultAddress })},
+	{Name: "vault-token", Env: "VAULT_TOKEN", Secret: true,
+		value: stringSetting(func(c *Config) *string { return &c.VaultToken })},
+	{Name: "secrets-refresh-interval", Env: "SECRETS_REFRESH_INTERVAL", Section: "Workers", INIKey: "SecretsRefreshInterval",
+		value: durationSetting(func(c *Config) *time.Duration { return &c.SecretsRefreshInterval })},
+	{Name: "capture-file", Env: "CAPTURE_FILE", Section: "Workers", INIKey: "CaptureFile",
+		value: pathSetting(func(c *Config) *string { return &c.CaptureFile })},
+	{Name: "capture-max-size", Env: "CAPTURE_MAX_SIZE", Section: "Workers", INIKey: "CaptureMaxSize", Default: formatSize(DefaultCaptureMaxSize),
+		value: parsedSetting(func(c *Config) *int { return &c.CaptureMaxSize }, ParseSize, formatSize)},
+	{Name: "capture-max-files", Env: "CAPTURE_MAX_FILES", Section: "Workers", INIKey: "CaptureMaxFiles", Default: strconv.Itoa(DefaultCaptureMaxFiles),
+		value: intSetting(func(c *Config) *int { return &c.CaptureMaxFiles })},
+	{Name: "capture-agents", Env: "CAPTURE_AGENTS", Section: "Workers", INIKey: "CaptureAgents",
+		value: listSetting(func(c *Config) *[]string { return &c.CaptureAgents })},
+	{Name: "capture-subjects", Env: "CAPTURE_SUBJECTS", Section: "Workers", INIKey: "CaptureSubjects",
+		value: listSetting(func(c *Config) *[]string { return &c.CaptureSubjects })},
+	{Name: "smtp-password", Env: "SMTP_PASSWORD", Secret: true, Role: NotificationWorkerRole,
+		value: stringSetting(func(c *Config) *string { return &c.SMTPPassword })},
+	{Name: "ocsp", Env: "OCSP", Section: "Certificates", INIKey: "OCSPUrls", Required: true, Role: CertManagerWorkerRole,
+		value: listSetting(func(c *Config) *[]string { return &c.OCSPResponders })},
+	{Name: "cakey", Env: "CA_KEY_FILENAME", Section: "Certificates", INIKey: "CAKey", Default: "certificates/ca.key", Role: CertManagerWorkerRole,
+		value: pathSetting(func(c *Config) *string { return &c.CAKeyPath })},
+	{Name: "cakey-passphrase", Env: "CA_KEY_PASSPHRASE", Secret: true, Role: CertManagerWorkerRole,
+		value: stringSetting(func(c *Config) *string { return &c.CAKeyPassphrase })},
+	{Name: "cert-self-renew", Env: "CERT_SELF_RENEW", Section: "Workers", INIKey: "CertManagerWorkerSelfRenew", Default: "false", Role: CertManagerWorkerRole,
+		value: boolSetting(func(c *Config) *bool { return &c.CertSelfRenew })},
+	{Name: "cert-renew-before", Env: "CERT_RENEW_BEFORE", Section: "Workers", INIKey: "CertManagerWorkerRenewBefore", Default: formatDuration(DefaultCertRenewBefore), Role: CertManagerWorkerRole,
+		value: durationSetting(func(c *Config) *time.Duration { return &c.CertRenewBefore })},
+	{Name: "metrics-address", Env: "METRICS_ADDRESS", Section: "Workers", INIKey: "{role}MetricsAddress",
+		value: stringSetting(func(c *Config) *string { return &c.MetricsAddress })},
+	{Name: "health-address", Env: "HEALTH_ADDRESS", Section: "Workers", INIKey: "{role}HealthAddress",
+		value: stringSetting(func(c *Config) *string { return &c.HealthAddress })},
+	{Name: "handler-timeout", Env: "HANDLER_TIMEOUT", Section: "Workers", INIKey: "HandlerTimeout", Default: formatDuration(DefaultHandlerTimeout),
+		value: durationSetting(func(c *Config) *time.Duration { return &c.HandlerTimeout })},
+	{Name: "handler-timeouts", Env: "HANDLER_TIMEOUTS", Section: "Workers", INIKey: "HandlerTimeouts",
+		value: parsedSetting(func(c *Config) *map[string]time.Duration { return &c.HandlerTimeouts }, ParseHandlerTimeouts, mapFormatter(formatDuration))},
+	{Name: "handler-concurrency", Env: "HANDLER_CONCURRENCY", Section: "Workers", INIKey: "HandlerConcurrency",
+		value: parsedSetting(func(c *Config) *map[string]int { return &c.HandlerConcurrency }, ParseSubjectLimits, mapFormatter(strconv.Itoa))},
+	{Name: "handler-max-pending", Env: "HANDLER_MAX_PENDING", Section: "Workers", INIKey: "HandlerMaxPending",
+		value: parsedSetting(func(c *Config) *map[string]int { return &c.HandlerMaxPending }, ParseSubjectLimits, mapFormatter(strconv.Itoa))},
+	{Name: "rate-limits", Env: "RATE_LIMITS", Section: "Workers", INIKey: "RateLimits",
+		value: parsedSetting(func(c *Config) *map[string]RateLimit { return &c.RateLimits }, ParseRateLimits, mapFormatter(RateLimit.String))},
+	{Name: "max-payload-sizes", Env: "MAX_PAYLOAD_SIZES", Section: "Workers", INIKey: "MaxPayloadSizes",
+		value: parsedSetting(func(c *Config) *map[string]int { return &c.MaxPayloadSizes }, ParseSizes, mapFormatter(formatSize))},
+	{Name: "max-report-items", Env: "MAX_REPORT_ITEMS", Section: "Workers", INIKey: "MaxReportItems",
+		value: parsedSetting(func(c *Config) *map[string]int { return &c.MaxReportItems }, ParseSubjectLimits, mapFormatter(strconv.Itoa))},
+	{Name: "shutdown-grace-period", Env: "SHUTDOWN_GRACE_PERIOD", Section: "Workers", INIKey: "ShutdownGracePeriod", Default: formatDuration(DefaultShutdownGracePeriod),
+		value: durationSetting(func(c *Config) *time.Duration { return &c.ShutdownGracePeriod })},
+	{Name: "jetstream", Env: "JETSTREAM", Section: "Workers", INIKey: "AgentWorkerJetstream", Default: "false",
+		value: boolSetting(func(c *Config) *bool { return &c.JetstreamEnabled })},
+	{Name: "jetstream-max-deliver", Env: "JETSTREAM_MAX_DELIVER", Section: "Workers", INIKey: "JetstreamMaxDeliver", Default: strconv.Itoa(DefaultJetstreamMaxDeliver),
+		value: intSetting(func(c *Config) *int { return &c.JetstreamMaxDeliver })},
+	{Name: "cert-expiry-warnings", Env: "CERT_EXPIRY_WARNINGS", Section: "Workers", INIKey: "CertExpiryWarnings", Default: formatDurations(DefaultCertExpiryWarnings),
+		value: parsedSetting(func(c *Config) *[]time.Duration { return &c.CertExpiryWarnings }, ParseDurations, formatDurations)},
+	{Name: "leader-lease-ttl", Env: "LEADER_LEASE_TTL", Section: "Workers", INIKey: "LeaderLeaseTTL", Default: formatDuration(DefaultLeaderLeaseTTL),
+		value: durationSetting(func(c *Config) *time.Duration { return &c.LeaderLeaseTTL })},
+	{Name: "tracing-exporter", Env: "TRACING_EXPORTER", Section: "Workers", INIKey: "TracingExporter", Default: TracingExporterNone,
+		Allowed: []string{TracingExporterNone, TracingExporterOTLP, TracingExporterStdout},
+		value:   stringSetting(func(c *Config) *string { return &c.TracingExporter })},
+	{Name: "tracing-endpoint", Env: "TRACING_ENDPOINT", Section: "Workers", INIKey: "TracingEndpoint",
+		value: stringSetting(func(c *Config) *string { return &c.TracingEndpoint })},
+	{Name: "tracing-protocol", Env: "TRACING_PROTOCOL", Section: "Workers", INIKey: "TracingProtocol", Default: TracingProtocolGRPC,
+		Allowed: []string{TracingProtocolGRPC, TracingProtocolHTTP},
+		value:   stringSetting(func(c *Config) *string { return &c.TracingProtocol })},
+	{Name: "tracing-insecure", Env: "TRACING_INSECURE", Section: "Workers", INIKey: "TracingInsecure", Default: "false",
+		value: boolSetting(func(c *Config) *bool { return &c.TracingInsecure })},
+	{Name: "tracing-sample-ratio", Env: "TRACING_SAMPLE_RATIO", Section: "Workers", INIKey: "TracingSampleRatio", Default: "1",
+		value: floatSetting(func(c *Config) *float64 { return &c.TracingSampleRatio })},
+	{Name: "log-format", Env: "LOG_FORMAT", Section: "Workers", INIKey: "LogFormat", Default: "text",
+		Allowed: []string{"text", "json"},
+		value:   stringSetting(func(c *Config) *string { return &c.LogFormat })},
+	{Name: "log-level", Env: "LOG_LEVEL", Section: "Workers", INIKey: "LogLevel", Default: "info",
+		value: parsedSetting(func(c *Config) *string { return &c.LogLevel }, func(s string) (string, error) {
+			_, err := ParseLogLevel(s)
+			return s, err
+		}, func(s string) string { return s })},
+}
+
+// ConfigDefault returns the default value of the setting, the CLI flags show it in their help
+func ConfigDefault(name string) string {
+	if k, ok := lookupConfigKey(name); ok {
+		return k.Default
+	}
+	return ""
+}
+
+func lookupConfigKey(name string) (configKey, bool) {
+	i := slices.IndexFunc(configKeys, func(k configKey) bool { return k.Name == name })
+	if i < 0 {
+		return configKey{}, false
+	}
+	return configKeys[i], true
+}
+
+// iniKey returns the key in the INI file, every role has its own certificate
+// and its own addresses so several workers can run on the same host
+func (k configKey) iniKey(role string) string {
+	prefix := "Worker"
+	switch role {
+	case AgentWorkerRole:
+		prefix = "AgentWorker"
+	case CertManagerWorkerRole:
+		prefix = "CertManagerWorker"
+	case NotificationWorkerRole:
+		prefix = "NotificationWorker"
+	}
+	return strings.ReplaceAll(k.INIKey, "{role}", prefix)
+}
+
+// set parses the value and stores it in the config, the error names the setting and where it was set
+func (k configKey) set(c *Config, v, source string) error {
+	if len(k.Allowed) > 0 && !slices.Contains(k.Allowed, v) {
+		return fmt.Errorf("invalid value %q for %s (%s), valid values are %s", v, k.Name, source, strings.Join(k.Allowed, ", "))
+	}
+	if err := k.value.set(c, v); err != nil {
+		return fmt.Errorf("invalid value %q for %s (%s), reason: %v", v, k.Name, source, err)
+	}
+	return nil
+}
+
+// normalize returns the value as it's printed so values written differently can be compared
+func (k configKey) normalize(v string) string {
+	c := Config{}
+	if err := k.value.set(&c, v); err != nil {
+		return v
+	}
+	return k.value.get(&c)
+}
+
+func parsedSetting[T any](field func(*Config) *T, parse func(string) (T, error), format func(T) string) configValue {
+	return configValue{
+		set: func(c *Config, v string) error {
+			parsed, err := parse(strings.TrimSpace(v))
+			if err != nil {
+				return err
+			}
+			*field(c) = parsed
+			return nil
+		},
+		get: func(c *Config) string { return format(*field(c)) },
+	}
+}
+
+func stringSetting(field func(*Config) *string) configValue {
+	return configValue{
+		set: func(c *Config, v string) error { *field(c) = strings.TrimSpace(v); return nil },
+		get: func(c *Config) string { return *field(c) },
+	}
+}
+
+// pathSetting stores the path relative to the working directory
+func pathSetting(field func(*Config) *string) configValue {
+	return parsedSetting(field, func(s string) (string, error) {
+		if s == "" || filepath.IsAbs(s) {
+			return s, nil
+		}
+		cwd, err := os.Getwd()
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(cwd, s), nil
+	}, func(s string) string { return s })
+}
+
+func boolSetting(field func(*Config) *bool) configValue {
+	return parsedSetting(field, parseBool, strconv.FormatBool)
+}
+
+func intSetting(field func(*Config) *int) configValue {
+	return parsedSetting(field, strconv.Atoi, strconv.Itoa)
+}
+
+func floatSetting(field func(*Config) *float64) configValue {
+	return parsedSetting(field, func(s string) (float64, error) {
+		return strconv.ParseFloat(s, 64)
+	}, func(f float64) string { return strconv.FormatFloat(f, 'g', -1, 64) })
+}
+
+func durationSetting(field func(*Config) *time.Duration) configValue {
+	return parsedSetting(field, time.ParseDuration, formatDuration)
+}
+
+// listSetting stores a comma-separated list
+func listSetting(field func(*Config) *[]string) configValue {
+	return parsedSetting(field, func(s string) ([]string, error) {
+		list := []string{}
+		for item := range strings.SplitSeq(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		return list, nil
+	}, func(l []string) string { return strings.Join(l, ",") })
+}
+
+// parseBool accepts the same values as the INI files e.g (true, yes, on, 1)
+func parseBool(s string) (bool, error) {
+	switch strings.ToLower(s) {
+	case "1", "t", "true", "y", "yes", "on":
+		return true, nil
+	case "0", "f", "false", "n", "no", "off":
+		return false, nil
+	}
+	return false, fmt.Errorf("%q is not a boolean", s)
+}
+
+// formatDuration drops the zero units e.g (720h instead of 720h0m0s)
+func formatDuration(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
+
+func formatDurations(durations []time.Duration) string {
+	items := []string{}
+	for _, d := range durations {
+		items = append(items, formatDuration(d))
+	}
+	return strings.Join(items, ",")
+}
+
+// formatSize uses the biggest unit that keeps the size a whole number
+func formatSize(n int) string {
+	for _, unit := range []struct {
+		suffix string
+		size   int
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}} {
+		if n >= unit.size && n%unit.size == 0 {
+			return strconv.Itoa(n/unit.size) + unit.suffix
+		}
+	}
+	return strconv.Itoa(n)
+}
+
+// mapFormatter formats a subject map as it's parsed e.g (*=2,report=16)
+func mapFormatter[V any](format func(V) string) func(map[string]V) string {
+	return func(m map[string]V) string {
+		items := []string{}
+		for _, k := range slices.Sorted(maps.Keys(m)) {
+			items = append(items, k+"="+format(m[k]))
+		}
+		return strings.Join(items, ",")
+	}
+}
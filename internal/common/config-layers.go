@@ -0,0 +1,434 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/open-uem/utils"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/ini.v1"
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigFileEnv contains the path of the YAML config file if the --config flag hasn't been set
+const ConfigFileEnv = "WORKER_CONFIG_FILE"
+
+// secretProviderKeys are the settings the secret providers need
+var secretProviderKeys = []string{"vault-address", "vault-token"}
+
+// ConfigOptions tell LoadConfig where to read the settings from
+type ConfigOptions struct {
+	// Role is the worker's role, or the comma-separated roles of a combined worker
+	Role string
+	// INIFile is the OpenUEM config file, utils.GetConfigFile() is used if empty
+	INIFile string
+	// Flags contains the CLI flags, services don't have flags
+	Flags *cli.Context
+	// Keys restricts the settings that are read, commands that only need
+	// some settings (e.g the NATS connection) set them, all are read if empty
+	Keys []string
+}
+
+// ConfigSources tells where the value of each setting comes from e.g (env NATS_SERVERS)
+type ConfigSources map[string]string
+
+// configLayer returns the settings it contains and where they come from
+type configLayer func(opts ConfigOptions) (map[string]string, ConfigSources, error)
+
+// LoadConfig reads the settings from the defaults, the INI file, the YAML file,
+// the environment variables and the CLI flags, each layer overrides the previous ones.
+// The config and the sources are returned even if some settings aren't valid so they
+// can be printed, the error lists every setting that isn't valid
+func LoadConfig(opts ConfigOptions) (*Config, ConfigSources, error) {
+	values := map[string]string{}
+	sources := ConfigSources{}
+
+	for _, layer := range []configLayer{defaultsLayer, iniLayer, yamlLayer, envLayer, flagsLayer} {
+		v, s, err := layer(opts)
+		if err != nil {
+			return nil, nil, err
+		}
+		maps.Copy(values, v)
+		maps.Copy(sources, s)
+	}
+
+	config := Config{}
+	errs, unresolved := resolveSecrets(opts.keys(), values, sources)
+	for _, k := range opts.keys() {
+		if slices.Contains(unresolved, k.Name) {
+			continue
+		}
+
+		v, ok := values[k.Name]
+		if !ok || v == "" {
+			if k.Required {
+				errs = append(errs, fmt.Errorf("%s is required, set the flag --%s, the env var %s, the YAML key %s%s", k.Name, k.Name, k.Env, k.Name, k.iniHint(opts.Role)))
+			}
+			continue
+		}
+
+		if err := k.set(&config, v, sources[k.Name]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if config.DBPassword != "" && config.DBUrl != "" {
+		dbURL, err := withDBPassword(config.DBUrl, config.DBPassword)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("could not set db-password (%s), reason: %v", sources["db-password"], err))
+		} else {
+			config.DBUrl = dbURL
+		}
+	}
+
+	errs = append(errs, validateConfig(&config, opts)...)
+
+	return &config, sources, errors.Join(errs...)
+}
+
+// resolveSecrets replaces the secret references with the secrets they point to and adds the
+// reference to the source, it returns the settings that couldn't be resolved. The Vault token
+// is resolved first so it can be read from a file or from systemd-creds
+func resolveSecrets(keys []configKey, values map[string]string, sources ConfigSources) ([]error, []string) {
+	errs := []error{}
+	unresolved := []string{}
+
+	resolve := func(r *SecretResolver, k configKey) {
+		ref := values[k.Name]
+		if !k.Secret || !IsSecretReference(ref) {
+			return
+		}
+		secret, err := r.Resolve(context.Background(), ref)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("could not resolve the secret of %s (%s), reason: %v", k.Name, sources[k.Name], err))
+			unresolved = append(unresolved, k.Name)
+			return
+		}
+		values[k.Name] = secret
+		sources[k.Name] = fmt.Sprintf("%s (%s)", sources[k.Name], ref)
+	}
+
+	if k, ok := lookupConfigKey("vault-token"); ok {
+		resolve(NewSecretResolver("", ""), k)
+	}
+
+	token := values["vault-token"]
+	if slices.Contains(unresolved, "vault-token") {
+		token = ""
+	}
+
+	r := NewSecretResolver(values["vault-address"], token)
+	for _, k := range keys {
+		if k.Name != "vault-token" {
+			resolve(r, k)
+		}
+	}
+
+	return errs, unresolved
+}
+
+// Files returns the config files that are read so they can be watched for changes
+func (opts ConfigOptions) Files() []string {
+	files := []string{}
+	for _, f := range []string{opts.iniFile(), opts.yamlFile()} {
+		if f == "" {
+			continue
+		}
+		if _, err := os.Stat(f); err == nil {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// keys returns the settings read by the role, the secret provider settings are
+// always read as any secret may be a reference
+func (opts ConfigOptions) keys() []configKey {
+	roles := strings.Split(opts.Role, ",")
+	return slices.DeleteFunc(slices.Clone(configKeys), func(k configKey) bool {
+		if k.Role != "" && !slices.Contains(roles, k.Role) {
+			return true
+		}
+		return len(opts.Keys) > 0 && !slices.Contains(opts.Keys, k.Name) && !slices.Contains(secretProviderKeys, k.Name)
+	})
+}
+
+func (opts ConfigOptions) iniFile() string {
+	if opts.INIFile != "" {
+		return opts.INIFile
+	}
+	return utils.GetConfigFile()
+}
+
+func (opts ConfigOptions) yamlFile() string {
+	if opts.Flags != nil && opts.Flags.String("config") != "" {
+		return opts.Flags.String("config")
+	}
+	return os.Getenv(ConfigFileEnv)
+}
+
+func (k configKey) iniHint(role string) string {
+	if k.Section == "" {
+		return ""
+	}
+	if k.INIKey == "" {
+		return fmt.Sprintf(" or the INI section [%s]", k.Section)
+	}
+	return fmt.Sprintf(" or the INI key [%s] %s", k.Section, k.iniKey(role))
+}
+
+func defaultsLayer(opts ConfigOptions) (map[string]string, ConfigSources, error) {
+	values := map[string]string{}
+	sources := ConfigSources{}
+	for _, k := range opts.keys() {
+		if k.Default != "" {
+			values[k.Name] = k.Default
+			sources[k.Name] = "default"
+		}
+	}
+	return values, sources, nil
+}
+
+// iniLayer reads the OpenUEM config file shared with the rest of the OpenUEM components,
+// it's skipped if the file doesn't exist
+func iniLayer(opts ConfigOptions) (map[string]string, ConfigSources, error) {
+	values := map[string]string{}
+	sources := ConfigSources{}
+
+	path := opts.iniFile()
+	if _, err := os.Stat(path); err != nil {
+		slog.Debug("the INI config file is not available", "file", path, "error", err)
+		return values, sources, nil
+	}
+
+	cfg, err := ini.Load(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read the INI config file %s, reason: %v", path, err)
+	}
+
+	for _, k := range opts.keys() {
+		if k.Section == "" {
+			continue
+		}
+
+		// the database url is built from the [DB] section and, on Windows, the Credential Manager
+		if k.Name == "dburl" {
+			if !cfg.HasSection("DB") {
+				continue
+			}
+			dbURL, err := utils.CreatePostgresDatabaseURL()
+			if err != nil {
+				slog.Warn("could not create the database url from the INI config file", "file", path, "error", err)
+				continue
+			}
+			values[k.Name] = dbURL
+			sources[k.Name] = "ini [DB]"
+			continue
+		}
+
+		key := k.iniKey(opts.Role)
+		if !cfg.Section(k.Section).HasKey(key) {
+			continue
+		}
+		if v := cfg.Section(k.Section).Key(key).String(); v != "" {
+			values[k.Name] = v
+			sources[k.Name] = fmt.Sprintf("ini [%s] %s", k.Section, key)
+		}
+	}
+
+	return values, sources, nil
+}
+
+// yamlLayer reads the YAML file set with --config or WORKER_CONFIG_FILE, its keys are the flag names,
+// lists and maps can be used for the settings that take comma-separated values
+func yamlLayer(opts ConfigOptions) (map[string]string, ConfigSources, error) {
+	values := map[string]string{}
+	sources := ConfigSources{}
+
+	path := opts.yamlFile()
+	if path == "" {
+		return values, sources, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read the YAML config file %s, reason: %v", path, err)
+	}
+
+	doc := map[string]any{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, nil, fmt.Errorf("could not parse the YAML config file %s, reason: %v", path, err)
+	}
+
+	for name, value := range doc {
+		if _, ok := lookupConfigKey(name); !ok {
+			return nil, nil, fmt.Errorf("unknown key %s in the YAML config file %s", name, path)
+		}
+		if v := yamlValue(value); v != "" {
+			values[name] = v
+			sources[name] = "yaml " + filepath.Base(path)
+		}
+	}
+
+	return values, sources, nil
+}
+
+// yamlValue converts a YAML value to the text form used by the flags
+func yamlValue(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case []any:
+		items := []string{}
+		for _, item := range v {
+			items = append(items, yamlValue(item))
+		}
+		return strings.Join(items, ",")
+	case map[string]any:
+		items := []string{}
+		for _, k := range slices.Sorted(maps.Keys(v)) {
+			items = append(items, k+"="+yamlValue(v[k]))
+		}
+		return strings.Join(items, ",")
+	case time.Time:
+		return v.Format(time.RFC3339)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func envLayer(opts ConfigOptions) (map[string]string, ConfigSources, error) {
+	values := map[string]string{}
+	sources := ConfigSources{}
+
+	for _, k := range opts.keys() {
+		if v := os.Getenv(k.Env); k.Env != "" && v != "" {
+			values[k.Name] = v
+			sources[k.Name] = "env " + k.Env
+		}
+	}
+
+	// systemd-creds passes the master key as a file in the credentials directory
+	readsKey := slices.ContainsFunc(opts.keys(), func(k configKey) bool { return k.Name == "encryption-master-key" })
+	if readsKey && runtime.GOOS == "linux" && os.Getenv("CREDENTIALS_DIRECTORY") != "" {
+		path := filepath.Join(os.Getenv("CREDENTIALS_DIRECTORY"), "openuem")
+		if data, err := os.ReadFile(path); err == nil {
+			values["encryption-master-key"] = strings.TrimSpace(string(data))
+			sources["encryption-master-key"] = "systemd-creds " + path
+		}
+	}
+
+	return values, sources, nil
+}
+
+// flagsLayer reads the flags that have been set, urfave/cli also reports as set the flags
+// whose environment variable exists so they're left to the env layer if the value is the same
+func flagsLayer(opts ConfigOptions) (map[string]string, ConfigSources, error) {
+	values := map[string]string{}
+	sources := ConfigSources{}
+
+	if opts.Flags == nil {
+		return values, sources, nil
+	}
+
+	for _, k := range opts.keys() {
+		if !opts.Flags.IsSet(k.Name) {
+			continue
+		}
+
+		v := flagValue(opts.Flags.Value(k.Name))
+		if env := os.Getenv(k.Env); k.Env != "" && env != "" && k.normalize(env) == k.normalize(v) {
+			continue
+		}
+
+		values[k.Name] = v
+		sources[k.Name] = "flag --" + k.Name
+	}
+
+	return values, sources, nil
+}
+
+func flagValue(value any) string {
+	switch v := value.(type) {
+	case time.Duration:
+		return v.String()
+	case []string:
+		return strings.Join(v, ",")
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// validateConfig checks that the certificates and keys can be read, the errors name the setting
+func validateConfig(config *Config, opts ConfigOptions) []error {
+	errs := []error{}
+
+	files := []struct {
+		name string
+		path string
+		read func(string) error
+	}{
+		{"cacert", config.CACertPath, func(p string) error { _, err := utils.ReadPEMCertificate(p); return err }},
+		{"cert", config.ClientCertPath, func(p string) error { _, err := utils.ReadPEMCertificate(p); return err }},
+		{"key", config.ClientKeyPath, func(p string) error { _, err := utils.ReadPEMPrivateKey(p); return err }},
+		{"cakey", config.CAKeyPath, func(p string) error { _, err := readPrivateKey(p, config.CAKeyPassphrase); return err }},
+	}
+	for _, f := range files {
+		if f.path == "" {
+			continue
+		}
+		if err := f.read(f.path); err != nil {
+			errs = append(errs, fmt.Errorf("could not read %s (%s), reason: %v", f.name, f.path, err))
+		}
+	}
+
+	if _, err := NewKeyring(config.EncryptionKeyID, config.EncryptionMasterKey, config.EncryptionRetiredKeys); err != nil {
+		errs = append(errs, fmt.Errorf("invalid encryption keys, reason: %v", err))
+	}
+
+	return errs
+}
+
+// FormatConfig returns the settings read by the role as YAML, secrets are redacted
+// and, if sources is set, each line has a comment telling where its value comes from
+func FormatConfig(config *Config, sources ConfigSources, opts ConfigOptions, withSources bool) ([]byte, error) {
+	doc := &yaml.Node{Kind: yaml.MappingNode}
+
+	for _, k := range opts.keys() {
+		v := k.value.get(config)
+		if k.Secret && v != "" {
+			v = redact(v)
+		}
+
+		value := &yaml.Node{Kind: yaml.ScalarNode, Value: v}
+		if withSources {
+			source := sources[k.Name]
+			if source == "" {
+				source = "not set"
+			}
+			value.LineComment = source
+		}
+
+		doc.Content = append(doc.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: k.Name}, value)
+	}
+
+	return yaml.Marshal(doc)
+}
+
+// redact hides the password of urls and the whole value of other secrets
+func redact(v string) string {
+	if u, err := url.Parse(v); err == nil && u.Scheme != "" && u.User != nil {
+		return u.Redacted()
+	}
+	return "[redacted]"
+}
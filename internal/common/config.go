@@ -1,147 +1,229 @@
 package common
 
 import (
-	"log"
+	"crypto/rsa"
+	"crypto/x509"
+	"log/slog"
 	"os"
-	"path/filepath"
-	"runtime"
 	"strings"
 	"time"
 
 	"github.com/go-co-op/gocron/v2"
+	"github.com/open-uem/openuem-worker/internal/models"
 	"github.com/open-uem/utils"
-	"gopkg.in/ini.v1"
+	"github.com/urfave/cli/v2"
 )
 
-func (w *Worker) GenerateCommonWorkerConfig(c string) error {
-	var err error
+// Config contains the worker settings for every role, LoadConfig fills it from the defaults, the config files,
+// the environment and the CLI flags, and it can be read again while the worker is running to reload it
+type Config struct {
+	DBUrl                  string
+	DBPassword             string
+	DBPool                 models.PoolConfig
+	AutoMigrate            bool
+	NATSServers            string
+	CACertPath             string
+	ClientCertPath         string
+	ClientKeyPath          string
+	CAKeyPath              string
+	CAKeyPassphrase        string
+	OCSPResponders         []string
+	EncryptionMasterKey    string
+	EncryptionKeyID        string
+	EncryptionRetiredKeys  map[string]string
+	SMTPPassword           string
+	VaultAddress           string
+	VaultToken             string
+	SecretsRefreshInterval time.Duration
+	CaptureFile            string
+	CaptureMaxSize         int
+	CaptureMaxFiles        int
+	CaptureAgents          []string
+	CaptureSubjects        []string
+	MetricsAddress         string
+	HealthAddress          string
+	HandlerTimeout         time.Duration
+	HandlerTimeouts        map[string]time.Duration
+	HandlerConcurrency     map[string]int
+	HandlerMaxPending      map[string]int
+	RateLimits             map[string]RateLimit
+	MaxPayloadSizes        map[string]int
+	MaxReportItems         map[string]int
+	ShutdownGracePeriod    time.Duration
+	LogFormat              string
+	LogLevel               string
+	JetstreamEnabled       bool
+	JetstreamMaxDeliver    int
+	CertExpiryWarnings     []time.Duration
+	CertSelfRenew          bool
+	CertRenewBefore        time.Duration
+	TracingExporter        string
+	TracingEndpoint        string
+	TracingProtocol        string
+	TracingInsecure        bool
+	TracingSampleRatio     float64
+	LeaderLeaseTTL         time.Duration
+}
 
-	// Get conf file
-	configFile := utils.GetConfigFile()
+func (w *Worker) GenerateCommonWorkerConfig(c string) error {
+	w.Role = c
 
-	// Open ini file
-	cfg, err := ini.Load(configFile)
-	if err != nil {
-		return err
-	}
+	// Services don't have flags, the settings come from the config files and the environment
+	return w.ReadConfig(nil)
+}
 
-	w.DBUrl, err = utils.CreatePostgresDatabaseURL()
-	if err != nil {
-		log.Printf("[ERROR]: %v", err)
-		return err
-	}
+func (w *Worker) GenerateCertManagerWorkerConfig() error {
+	return w.GenerateCommonWorkerConfig(CertManagerWorkerRole)
+}
 
-	key, err := cfg.Section("Certificates").GetKey("CACert")
-	if err != nil {
-		log.Printf("[ERROR]: could not get CA cert path, reason: %v\n", err)
-		return err
-	}
-	w.CACertPath = key.String()
-
-	certKey := ""
-	privateKey := ""
-	switch c {
-	case "agent-worker":
-		certKey = "AgentWorkerCert"
-		privateKey = "AgentWorkerKey"
-	case "cert-manager-worker":
-		certKey = "CertManagerWorkerCert"
-		privateKey = "CertManagerWorkerKey"
-	case "notification-worker":
-		certKey = "NotificationWorkerCert"
-		privateKey = "NotificationWorkerKey"
+// ReadConfig reads the settings of the worker's roles and applies them, the config files
+// are read again when they change or the worker receives a SIGHUP
+func (w *Worker) ReadConfig(cCtx *cli.Context) error {
+	opts := ConfigOptions{Role: w.Role, Flags: cCtx}
+	load := func() (*Config, error) {
+		config, _, err := LoadConfig(opts)
+		return config, err
 	}
+	w.SetConfigSource(load, opts.Files()...)
 
-	key, err = cfg.Section("Certificates").GetKey(certKey)
+	config, err := load()
 	if err != nil {
-		log.Printf("[ERROR]: could not get Worker cert path, reason: %v\n", err)
 		return err
 	}
-	w.ClientCertPath = key.String()
 
-	key, err = cfg.Section("Certificates").GetKey(privateKey)
-	if err != nil {
-		log.Printf("[ERROR]: could not get Worker key path, reason: %v\n", err)
-		return err
-	}
-	w.ClientKeyPath = key.String()
+	return w.ApplyConfig(config)
+}
 
-	key, err = cfg.Section("NATS").GetKey("NATSServers")
+// ApplyConfig sets the worker's settings before it's started, the certificates
+// and private keys are read to check that they're valid
+func (w *Worker) ApplyConfig(config *Config) error {
+	caCert, caPrivateKey, err := readCAFiles(config)
 	if err != nil {
-		log.Println("[ERROR]: could not get NATS servers urls")
 		return err
 	}
-	w.NATSServers = key.String()
-
-	w.Replicas = len(strings.Split(w.NATSServers, ","))
 
-	w.EncryptionMasterKey = os.Getenv("ENCRYPTION_MASTER_KEY")
+	w.setConfig(config, caCert, caPrivateKey)
 
-	if runtime.GOOS == "linux" {
-		// if using systemd-creds
-		if os.Getenv("CREDENTIALS_DIRECTORY") != "" {
-			credentialFilePath := filepath.Join(os.Getenv("CREDENTIALS_DIRECTORY"), "openuem")
-			if _, err := os.Stat(credentialFilePath); err == nil {
-				data, err := os.ReadFile(credentialFilePath)
-				if err == nil {
-					w.EncryptionMasterKey = strings.TrimSpace(string(data))
-				}
-			}
-		}
+	if err := w.SetLogger(); err != nil {
+		slog.Error("could not set the logger", "error", err)
+		return err
 	}
 
 	return nil
 }
 
-func (w *Worker) GenerateCertManagerWorkerConfig() error {
-	var err error
-
-	// Get conf file
-	configFile := utils.GetConfigFile()
+// setConfig copies the settings and the CA files to the worker's fields, the CA private key
+// is kept if the role doesn't read it. The handlers read the settings that can be reloaded
+// while they run with liveSettings
+func (w *Worker) setConfig(config *Config, caCert *x509.Certificate, caPrivateKey *rsa.PrivateKey) {
+	w.settingsMu.Lock()
+	defer w.settingsMu.Unlock()
 
-	// Open ini file
-	cfg, err := ini.Load(configFile)
-	if err != nil {
-		return err
+	w.CACert = caCert
+	if caPrivateKey != nil {
+		w.CAPrivateKey = caPrivateKey
 	}
+	w.DBUrl = config.DBUrl
+	w.DBPool = config.DBPool
+	w.AutoMigrate = config.AutoMigrate
+	w.NATSServers = config.NATSServers
+	w.Replicas = len(strings.Split(config.NATSServers, ","))
+	w.CACertPath = config.CACertPath
+	w.ClientCertPath = config.ClientCertPath
+	w.ClientKeyPath = config.ClientKeyPath
+	w.CAKeyPath = config.CAKeyPath
+	w.OCSPResponders = config.OCSPResponders
+	w.EncryptionMasterKey = config.EncryptionMasterKey
+	// the keys have been validated when the settings were read
+	w.Keyring, _ = NewKeyring(config.EncryptionKeyID, config.EncryptionMasterKey, config.EncryptionRetiredKeys)
+	w.SMTPPassword = config.SMTPPassword
+	w.SecretsRefreshInterval = config.SecretsRefreshInterval
+	w.CaptureFile = config.CaptureFile
+	w.CaptureMaxSize = config.CaptureMaxSize
+	w.CaptureMaxFiles = config.CaptureMaxFiles
+	w.CaptureAgents = config.CaptureAgents
+	w.CaptureSubjects = config.CaptureSubjects
+	w.MetricsAddress = config.MetricsAddress
+	w.HealthAddress = config.HealthAddress
+	w.HandlerTimeout = config.HandlerTimeout
+	w.HandlerTimeouts = config.HandlerTimeouts
+	w.HandlerConcurrency = config.HandlerConcurrency
+	w.HandlerMaxPending = config.HandlerMaxPending
+	w.RateLimits = config.RateLimits
+	w.MaxPayloadSizes = config.MaxPayloadSizes
+	w.MaxReportItems = config.MaxReportItems
+	w.ShutdownGracePeriod = config.ShutdownGracePeriod
+	w.LogFormat = config.LogFormat
+	w.LogLevel = config.LogLevel
+	w.JetstreamEnabled = config.JetstreamEnabled
+	w.JetstreamMaxDeliver = config.JetstreamMaxDeliver
+	w.CertExpiryWarnings = config.CertExpiryWarnings
+	w.CertSelfRenew = config.CertSelfRenew
+	w.CertRenewBefore = config.CertRenewBefore
+	w.LeaderLeaseTTL = config.LeaderLeaseTTL
+	w.TracingExporter = config.TracingExporter
+	w.TracingEndpoint = config.TracingEndpoint
+	w.TracingProtocol = config.TracingProtocol
+	w.TracingInsecure = config.TracingInsecure
+	w.TracingSampleRatio = config.TracingSampleRatio
+	w.config = config
+}
 
-	if err := w.GenerateCommonWorkerConfig("cert-manager-worker"); err != nil {
-		return err
-	}
+// liveSettings are the settings read by the handlers and the jobs that a reload may replace while they run
+type liveSettings struct {
+	HandlerTimeout  time.Duration
+	HandlerTimeouts map[string]time.Duration
+	RateLimits      map[string]RateLimit
+	MaxPayloadSizes map[string]int
+	MaxReportItems  map[string]int
+	Keyring         *Keyring
+	SMTPPassword    string
+	CACert          *x509.Certificate
+	CAPrivateKey    *rsa.PrivateKey
+	OCSPResponders  []string
+	NATSServers     string
+}
 
-	key, err := cfg.Section("Certificates").GetKey("CAKey")
-	if err != nil {
-		log.Println("[ERROR]: could not get CA key path")
-		return err
+// liveSettings returns the current settings, a reload replaces the maps and the
+// keys instead of modifying them so they can be read without the lock
+func (w *Worker) liveSettings() liveSettings {
+	w.settingsMu.RLock()
+	defer w.settingsMu.RUnlock()
+
+	return liveSettings{
+		HandlerTimeout:  w.HandlerTimeout,
+		HandlerTimeouts: w.HandlerTimeouts,
+		RateLimits:      w.RateLimits,
+		MaxPayloadSizes: w.MaxPayloadSizes,
+		MaxReportItems:  w.MaxReportItems,
+		Keyring:         w.Keyring,
+		SMTPPassword:    w.SMTPPassword,
+		CACert:          w.CACert,
+		CAPrivateKey:    w.CAPrivateKey,
+		OCSPResponders:  w.OCSPResponders,
+		NATSServers:     w.NATSServers,
 	}
-	w.CAKeyPath = key.String()
+}
 
-	key, err = cfg.Section("Certificates").GetKey("OCSPUrls")
+// readCAFiles reads the CA certificate and, if the role needs it, the CA private key
+func readCAFiles(config *Config) (*x509.Certificate, *rsa.PrivateKey, error) {
+	caCert, err := utils.ReadPEMCertificate(config.CACertPath)
 	if err != nil {
-		log.Println("[ERROR]: could not get OCSP Responder url")
-		return err
+		slog.Error("could not read CA cert file", "error", err)
+		return nil, nil, err
 	}
-	ocspServers := []string{}
-	servers := key.String()
-	for ocsp := range strings.SplitSeq(servers, ",") {
-		ocspServers = append(ocspServers, strings.TrimSpace(ocsp))
-	}
-	w.OCSPResponders = ocspServers
 
-	// read required certificates and private keys
-	w.CACert, err = utils.ReadPEMCertificate(w.CACertPath)
-	if err != nil {
-		log.Println("[ERROR]: could not read CA cert file")
-		return err
+	if config.CAKeyPath == "" {
+		return caCert, nil, nil
 	}
 
-	w.CAPrivateKey, err = utils.ReadPEMPrivateKey(w.CAKeyPath)
+	caPrivateKey, err := readPrivateKey(config.CAKeyPath, config.CAKeyPassphrase)
 	if err != nil {
-		log.Println("[ERROR]: could not read CA private key file")
-		return err
+		slog.Error("could not read CA private key file", "error", err)
+		return nil, nil, err
 	}
 
-	return nil
+	return caCert, caPrivateKey, nil
 }
 
 func (w *Worker) StartGenerateWorkerConfigJob(workerName string, common bool) error {
@@ -160,11 +242,11 @@ func (w *Worker) StartGenerateWorkerConfigJob(workerName string, common bool) er
 					err = w.GenerateCertManagerWorkerConfig()
 				}
 				if err != nil {
-					log.Printf("[ERROR]: could not generate config for worker, reason: %v", err)
+					slog.Error("could not generate config for worker", "error", err)
 					return
 				}
 
-				log.Println("[INFO]: worker's config has been successfully generated")
+				slog.Info("worker's config has been successfully generated")
 				if err := w.TaskScheduler.RemoveJob(w.ConfigJob.ID()); err != nil {
 					return
 				}
@@ -172,9 +254,10 @@ func (w *Worker) StartGenerateWorkerConfigJob(workerName string, common bool) er
 		),
 	)
 	if err != nil {
-		log.Fatalf("[FATAL]: could not start the generate worker config job: %v", err)
+		slog.Error("could not start the generate worker config job", "error", err)
+		os.Exit(1)
 		return err
 	}
-	log.Printf("[INFO]: new generate worker config job has been scheduled every %d minute", 1)
+	slog.Info("new generate worker config job has been scheduled", "every", 1*time.Minute)
 	return nil
 }
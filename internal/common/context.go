@@ -0,0 +1,92 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const DefaultHandlerTimeout = 30 * time.Second
+
+// DefaultHandlerTimeouts contains the deadlines for subjects whose handlers usually need more time
+// than DefaultHandlerTimeout, an agent report is saved with many queries and an HTTP request
+var DefaultHandlerTimeouts = map[string]time.Duration{
+	"report":              2 * time.Minute,
+	"wingetcfg.profiles":  1 * time.Minute,
+	"ansiblecfg.profiles": 1 * time.Minute,
+}
+
+// MessageContext returns a context derived from the worker's root context with the deadline
+// configured for the subject of the message, it's cancelled when the worker stops and
+// carries the message's span so the database and HTTP calls are traced as its children
+func (w *Worker) MessageContext(msg *nats.Msg) (context.Context, context.CancelFunc) {
+	ctx := trace.ContextWithSpan(w.Context, w.messageSpan(msg))
+	return context.WithTimeout(ctx, w.HandlerTimeoutFor(subscriptionSubject(msg)))
+}
+
+// HandlerTimeoutFor returns the deadline configured for the subject
+func (w *Worker) HandlerTimeoutFor(subject string) time.Duration {
+	settings := w.liveSettings()
+	timeout := settings.HandlerTimeout
+	if t, ok := settings.HandlerTimeouts[subject]; ok {
+		timeout = t
+	} else if t, ok := DefaultHandlerTimeouts[subject]; ok {
+		timeout = t
+	}
+
+	if timeout <= 0 {
+		timeout = DefaultHandlerTimeout
+	}
+
+	return timeout
+}
+
+// ParseHandlerTimeouts parses a comma-separated list of subject=duration pairs
+// e.g (report=2m,wingetcfg.profiles=45s)
+func ParseHandlerTimeouts(s string) (map[string]time.Duration, error) {
+	timeouts := map[string]time.Duration{}
+
+	for item := range strings.SplitSeq(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		subject, value, found := strings.Cut(item, "=")
+		if !found {
+			return nil, fmt.Errorf("handler timeout %q must have the format subject=duration", item)
+		}
+
+		timeout, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("could not parse handler timeout for subject %s, reason: %v", subject, err)
+		}
+		timeouts[strings.TrimSpace(subject)] = timeout
+	}
+
+	return timeouts, nil
+}
+
+// ParseDurations parses a comma-separated list of durations e.g (720h,168h,24h)
+func ParseDurations(s string) ([]time.Duration, error) {
+	durations := []time.Duration{}
+
+	for item := range strings.SplitSeq(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		d, err := time.ParseDuration(item)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse duration %q, reason: %v", item, err)
+		}
+		durations = append(durations, d)
+	}
+
+	return durations, nil
+}
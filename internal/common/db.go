@@ -1,27 +1,111 @@
 package common
 
 import (
-	"log"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
 	"time"
 
 	"github.com/go-co-op/gocron/v2"
+	"github.com/nats-io/nats.go"
 	"github.com/open-uem/openuem-worker/internal/models"
 )
 
+const DBLivenessInterval = 15 * time.Second
+
+// connectDB connects with the database, the schema is migrated if auto-migration has been
+// enabled but columns and indexes are never dropped, use the migrate command to drop them
+func (w *Worker) connectDB(url string) (models.Store, error) {
+	model, err := models.New(w.Context, url, w.DBPool)
+	if err != nil {
+		return nil, err
+	}
+
+	if w.AutoMigrate {
+		if err := model.Migrate(w.Context, models.MigrateOptions{}); err != nil {
+			model.Close()
+			return nil, fmt.Errorf("could not migrate the database schema: %v", err)
+		}
+		slog.Info("database schema has been migrated")
+	}
+
+	return model, nil
+}
+
+// modelHandle counts the handlers using a database connection so it's
+// closed once they have finished if the worker connects with another database
+type modelHandle struct {
+	store models.Store
+	users sync.WaitGroup
+}
+
+// Model returns the database connection, it's nil until the worker has connected
+func (w *Worker) Model() models.Store {
+	w.modelMu.RLock()
+	defer w.modelMu.RUnlock()
+
+	if w.model == nil {
+		return nil
+	}
+	return w.model.store
+}
+
+// setModel replaces the database connection and returns the previous one
+func (w *Worker) setModel(store models.Store) *modelHandle {
+	w.modelMu.Lock()
+	defer w.modelMu.Unlock()
+
+	previous := w.model
+	w.model = &modelHandle{store: store}
+	return previous
+}
+
+// HoldModel wraps a NATS handler so the database connection it may use
+// isn't closed by a reload until the handler has finished
+func (w *Worker) HoldModel(handler nats.MsgHandler) nats.MsgHandler {
+	return func(msg *nats.Msg) {
+		w.modelMu.RLock()
+		h := w.model
+		if h != nil {
+			h.users.Add(1)
+		}
+		w.modelMu.RUnlock()
+
+		if h != nil {
+			defer h.users.Done()
+		}
+		handler(msg)
+	}
+}
+
+// close closes the connection once the handlers that held it have finished
+func (h *modelHandle) close() {
+	go func() {
+		h.users.Wait()
+		h.store.Close()
+	}()
+}
+
 func (w *Worker) StartDBConnectJob(subscription func() error) error {
 	var err error
 
-	w.Model, err = models.New(w.DBUrl)
+	model, err := w.connectDB(w.DBUrl)
 	if err == nil {
-		log.Println("[INFO]: connection established with database")
+		w.setModel(model)
+		slog.Info("connection established with database")
+		w.StartDBLivenessJob()
 
 		// Start a job to try to connect with NATS
 		if err := w.StartNATSConnectJob(subscription); err != nil {
-			log.Fatalf("[FATAL]: could not start NATS connect job, reason: %v", err)
+			slog.Error("could not start NATS connect job", "error", err)
+			os.Exit(1)
 		}
 		return nil
 	}
-	log.Printf("[ERROR]: could not connect with database %v", err)
+	slog.Error("could not connect with database", "error", err)
 
 	// Create task for running the agent
 	w.DBConnectJob, err = w.TaskScheduler.NewJob(
@@ -30,27 +114,92 @@ func (w *Worker) StartDBConnectJob(subscription func() error) error {
 		),
 		gocron.NewTask(
 			func() {
-				w.Model, err = models.New(w.DBUrl)
+				model, err := w.connectDB(w.DBUrl)
 				if err != nil {
-					log.Printf("[ERROR]: could not connect with database %v", err)
+					slog.Error("could not connect with database", "error", err)
 					return
 				}
-				log.Println("[INFO]: connection established with database")
+				w.setModel(model)
+				slog.Info("connection established with database")
 
 				if err := w.TaskScheduler.RemoveJob(w.DBConnectJob.ID()); err != nil {
 					return
 				}
+				w.StartDBLivenessJob()
 
 				if err := w.StartNATSConnectJob(subscription); err != nil {
-					log.Fatalf("[FATAL]: could not start NATS connect job, reason: %v", err)
+					slog.Error("could not start NATS connect job", "error", err)
+					os.Exit(1)
 				}
 			},
 		),
 	)
 	if err != nil {
-		log.Fatalf("[FATAL]: could not start the DB connect job: %v", err)
-		return err
+		slog.Error("could not start the DB connect job", "error", err)
+		os.Exit(1)
 	}
-	log.Printf("[INFO]: new DB connect job has been scheduled every %d minutes", 2)
+	slog.Info("new DB connect job has been scheduled", "every", 2*time.Minute)
 	return nil
 }
+
+// StartDBLivenessJob pings the database periodically so handlers can fail fast
+// and the worker reports itself as not ready while the database is unreachable
+func (w *Worker) StartDBLivenessJob() {
+	var err error
+
+	w.DBReady.Store(true)
+
+	w.DBLivenessJob, err = w.TaskScheduler.NewJob(
+		gocron.DurationJob(DBLivenessInterval),
+		gocron.NewTask(w.CheckDBLiveness),
+		gocron.WithSingletonMode(gocron.LimitModeReschedule),
+	)
+	if err != nil {
+		slog.Error("could not start the DB liveness job", "error", err)
+		return
+	}
+	slog.Info("new DB liveness job has been scheduled", "every", DBLivenessInterval)
+}
+
+func (w *Worker) CheckDBLiveness() {
+	ctx, cancel := context.WithTimeout(w.Context, 5*time.Second)
+	defer cancel()
+
+	err := w.Model().Ping(ctx)
+	wasReady := w.DBReady.Swap(err == nil)
+
+	switch {
+	case err != nil && wasReady:
+		slog.Error("database is not reachable, the worker is not ready", "error", err)
+	case err == nil && !wasReady:
+		slog.Info("database is reachable again, the worker is ready")
+	}
+}
+
+// RequireDB wraps a NATS handler so messages fail fast while the database is unreachable
+// instead of waiting for the handler's deadline
+func (w *Worker) RequireDB(handler nats.MsgHandler) nats.MsgHandler {
+	return func(msg *nats.Msg) {
+		if w.DBReady.Load() {
+			handler(msg)
+			return
+		}
+
+		messageLogger(msg).Warn("database is not reachable, the message has been rejected")
+		w.FailMessage(msg, errors.New("database is not reachable"))
+
+		// JetStream messages are redelivered later, core NATS requests get an empty response
+		if _, err := msg.Metadata(); err == nil {
+			if err := msg.NakWithDelay(DBLivenessInterval); err != nil {
+				messageLogger(msg).Error("could not nak the message", "error", err)
+			}
+			return
+		}
+
+		if msg.Reply != "" {
+			if err := w.respond(msg, nil); err != nil {
+				messageLogger(msg).Error("could not respond to the message", "error", err)
+			}
+		}
+	}
+}
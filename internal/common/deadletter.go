@@ -0,0 +1,228 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/open-uem/ent"
+	"github.com/wneessen/go-mail"
+)
+
+const (
+	// DeadLetterStream keeps the messages that failed permanently so they can be inspected and replayed
+	DeadLetterStream        = "DEAD_LETTERS"
+	DeadLetterSubjectPrefix = "deadletter."
+	deadLetterMaxAge        = 30 * 24 * time.Hour
+
+	DeadLetterErrorHeader     = "Openuem-Dead-Letter-Error"
+	DeadLetterSubjectHeader   = "Openuem-Dead-Letter-Subject"
+	DeadLetterDeliveredHeader = "Openuem-Dead-Letter-Delivered"
+	DeadLetterWorkerHeader    = "Openuem-Dead-Letter-Worker"
+	DeadLetterTimeHeader      = "Openuem-Dead-Letter-Time"
+
+	// ingestSubjectHeader keeps the subject a JetStream message was published to
+	ingestSubjectHeader = "Openuem-Worker-Ingest-Subject"
+)
+
+// PermanentError is a failure that will happen again if the message is processed again,
+// e.g an unparsable request or a rejected recipient
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+// Permanent marks the error as a permanent failure
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &PermanentError{Err: err}
+}
+
+// IsPermanent reports if processing the message again won't succeed, errors are transient unless
+// they've been marked as permanent, ent rejected the data or the SMTP server rejected the email
+func IsPermanent(err error) bool {
+	var permanent *PermanentError
+	if errors.As(err, &permanent) {
+		return true
+	}
+
+	if ent.IsValidationError(err) {
+		return true
+	}
+
+	var sendErr *mail.SendError
+	if errors.As(err, &sendErr) {
+		return !sendErr.IsTemp()
+	}
+
+	return false
+}
+
+// FailMessage records a message that could not be processed, permanent failures are
+// dead-lettered and JetStream won't deliver them again
+func (w *Worker) FailMessage(msg *nats.Msg, err error) {
+	w.Metrics.MessageFailed(msg)
+
+	if err == nil {
+		err = errors.New("unknown error")
+	}
+	w.setOutcome(msg, err)
+	w.recordError(msg, err)
+
+	if !IsPermanent(err) {
+		return
+	}
+
+	delivered := uint64(1)
+	if md, mdErr := msg.Metadata(); mdErr == nil {
+		delivered = md.NumDelivered
+	}
+	w.DeadLetter(msg, err.Error(), delivered)
+
+	// JetStream messages delivered to a core subscription
+	if _, mdErr := msg.Metadata(); mdErr == nil {
+		if err := msg.Term(); err != nil {
+			messageLogger(msg).Error("could not terminate the message", "error", err)
+		}
+	}
+}
+
+// DeadLetter publishes the message with the reason of the failure to the dead-letter stream
+func (w *Worker) DeadLetter(msg *nats.Msg, reason string, delivered uint64) {
+	logger := messageLogger(msg)
+
+	if w.isReplay(msg) {
+		logger.Info("replayed message would have been dead-lettered", "reason", reason)
+		return
+	}
+
+	subject := msg.Subject
+	if isIngested(msg) {
+		subject = msg.Header.Get(ingestSubjectHeader)
+	}
+
+	dl := nats.NewMsg(DeadLetterSubjectPrefix + subject)
+	dl.Data = msg.Data
+	for k, v := range msg.Header {
+		if k == ingestSubjectHeader {
+			continue
+		}
+		dl.Header[k] = v
+	}
+	dl.Header.Set(DeadLetterErrorHeader, reason)
+	dl.Header.Set(DeadLetterSubjectHeader, subject)
+	dl.Header.Set(DeadLetterDeliveredHeader, strconv.FormatUint(delivered, 10))
+	dl.Header.Set(DeadLetterWorkerHeader, strings.TrimSpace(w.Role+" "+w.InstanceID))
+	dl.Header.Set(DeadLetterTimeHeader, time.Now().UTC().Format(time.RFC3339))
+
+	w.Metrics.DeadLetters.WithLabelValues(subscriptionSubject(msg)).Inc()
+
+	js, err := w.deadLetterJetstream()
+	if err != nil {
+		logger.Error("could not dead-letter the message", "reason", reason, "error", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(w.Context, 10*time.Second)
+	defer cancel()
+
+	if _, err := js.PublishMsg(ctx, dl); err != nil {
+		logger.Error("could not dead-letter the message", "reason", reason, "error", err)
+		return
+	}
+
+	logger.Warn("message has failed permanently and has been dead-lettered", "reason", reason, "delivered", delivered)
+}
+
+// deadLetterJetstream returns a JetStream context for the current connection,
+// the dead-letter stream is created the first time it's used with the connection
+func (w *Worker) deadLetterJetstream() (jetstream.JetStream, error) {
+	w.deadLetterMu.Lock()
+	defer w.deadLetterMu.Unlock()
+
+	nc := w.NATSConnection()
+	if nc == nil || nc.IsClosed() {
+		return nil, fmt.Errorf("NATS is not connected")
+	}
+
+	if w.deadLetters != nil && w.deadLetters.Conn() == nc {
+		return w.deadLetters, nil
+	}
+
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := CreateDeadLetterStream(w.Context, js, w.Replicas); err != nil {
+		return nil, err
+	}
+
+	w.deadLetters = js
+	return js, nil
+}
+
+func CreateDeadLetterStream(ctx context.Context, js jetstream.JetStream, replicas int) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	_, err := js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:      DeadLetterStream,
+		Subjects:  []string{DeadLetterSubjectPrefix + ">"},
+		Retention: jetstream.LimitsPolicy,
+		Storage:   jetstream.FileStorage,
+		MaxAge:    deadLetterMaxAge,
+		Replicas:  max(1, min(replicas, 5)),
+	})
+	if err != nil {
+		return fmt.Errorf("could not create the %s stream, reason: %v", DeadLetterStream, err)
+	}
+	return nil
+}
+
+// ReplayDeadLetter publishes a dead-lettered message to its original subject
+// with its original headers
+func ReplayDeadLetter(ctx context.Context, nc *nats.Conn, raw *jetstream.RawStreamMsg) (string, error) {
+	subject := raw.Header.Get(DeadLetterSubjectHeader)
+	if subject == "" {
+		subject = strings.TrimPrefix(raw.Subject, DeadLetterSubjectPrefix)
+	}
+
+	msg := nats.NewMsg(subject)
+	msg.Data = raw.Data
+	for k, v := range raw.Header {
+		if strings.HasPrefix(k, "Openuem-Dead-Letter-") || strings.HasPrefix(k, "Nats-") {
+			continue
+		}
+		msg.Header[k] = v
+	}
+
+	// ingest subjects are stored in JetStream so the publication is confirmed
+	if strings.HasPrefix(subject, IngestSubjectPrefix) {
+		js, err := jetstream.New(nc)
+		if err != nil {
+			return subject, err
+		}
+		_, err = js.PublishMsg(ctx, msg)
+		return subject, err
+	}
+
+	if err := nc.PublishMsg(msg); err != nil {
+		return subject, err
+	}
+	return subject, nc.FlushWithContext(ctx)
+}
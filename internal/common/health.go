@@ -0,0 +1,35 @@
+package common
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/open-uem/utils"
+)
+
+// PingSubjects contains the subject each worker replies to, it's used to check that
+// a live instance is consuming messages
+var PingSubjects = map[string]string{
+	AgentWorkerRole:        "ping.agentworker",
+	CertManagerWorkerRole:  "ping.certmanagerworker",
+	NotificationWorkerRole: "ping.notificationworker",
+}
+
+// CheckCertificateExpiry returns an error if the PEM certificate can't be read
+// or it's not valid at the current time
+func CheckCertificateExpiry(path string) error {
+	cert, err := utils.ReadPEMCertificate(path)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if now.Before(cert.NotBefore) {
+		return fmt.Errorf("certificate %s is not valid until %s", path, cert.NotBefore.Format(time.RFC3339))
+	}
+	if now.After(cert.NotAfter) {
+		return fmt.Errorf("certificate %s expired on %s", path, cert.NotAfter.Format(time.RFC3339))
+	}
+
+	return nil
+}
@@ -0,0 +1,98 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+type ReadinessStatus struct {
+	Ready                bool     `json:"ready"`
+	Database             bool     `json:"database"`
+	NATS                 string   `json:"nats"`
+	MissingSubscriptions []string `json:"missing_subscriptions,omitempty"`
+}
+
+// StartHTTPServers serves the Prometheus metrics and the health endpoints,
+// they share the same server if both use the same address
+func (w *Worker) StartHTTPServers() {
+	muxes := map[string]*http.ServeMux{}
+	getMux := func(address string) *http.ServeMux {
+		if _, ok := muxes[address]; !ok {
+			muxes[address] = http.NewServeMux()
+		}
+		return muxes[address]
+	}
+
+	if w.MetricsAddress != "" {
+		getMux(w.MetricsAddress).Handle("/metrics", promhttp.HandlerFor(w.Metrics.Registry, promhttp.HandlerOpts{}))
+		slog.Info("metrics are served", "address", w.MetricsAddress, "path", "/metrics")
+	}
+
+	if w.HealthAddress != "" {
+		mux := getMux(w.HealthAddress)
+		mux.HandleFunc("/livez", w.LivezHandler)
+		mux.HandleFunc("/readyz", w.ReadyzHandler)
+		slog.Info("health endpoints are served", "address", w.HealthAddress, "paths", []string{"/livez", "/readyz"})
+	}
+
+	for address, mux := range muxes {
+		server := &http.Server{
+			Addr:              address,
+			Handler:           mux,
+			ReadHeaderTimeout: 5 * time.Second,
+		}
+		w.HTTPServers = append(w.HTTPServers, server)
+
+		go func() {
+			if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("could not start HTTP server", "address", address, "error", err)
+			}
+		}()
+	}
+}
+
+func (w *Worker) StopHTTPServers() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, server := range w.HTTPServers {
+		if err := server.Shutdown(ctx); err != nil {
+			slog.Error("could not stop HTTP server", "address", server.Addr, "error", err)
+		}
+	}
+	w.HTTPServers = nil
+}
+
+// LivezHandler reports that the worker process is running and hasn't started shutting down
+func (w *Worker) LivezHandler(rw http.ResponseWriter, r *http.Request) {
+	if w.Stopping.Load() {
+		http.Error(rw, "stopping", http.StatusServiceUnavailable)
+		return
+	}
+	rw.Write([]byte("ok"))
+}
+
+// ReadyzHandler reports if the worker can process messages
+func (w *Worker) ReadyzHandler(rw http.ResponseWriter, r *http.Request) {
+	status := ReadinessStatus{
+		Ready:                w.IsReady() && !w.Stopping.Load(),
+		Database:             w.DBReady.Load(),
+		NATS:                 w.NATSState(),
+		MissingSubscriptions: w.MissingSubscriptions(),
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	if !status.Ready {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	if err := json.NewEncoder(rw).Encode(status); err != nil {
+		slog.Error("could not encode readiness status", "error", err)
+	}
+}
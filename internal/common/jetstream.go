@@ -0,0 +1,221 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	// AgentsStream stores the messages agents publish to the ingest subjects
+	// so they're processed even if no agent worker is running
+	AgentsStream = "AGENTS_INGEST"
+	// IngestSubjectPrefix is prepended to the agent subjects consumed from JetStream,
+	// the subjects without prefix keep working as request/reply
+	IngestSubjectPrefix = "ingest."
+
+	DefaultJetstreamMaxDeliver = 5
+	agentsStreamMaxAge         = 7 * 24 * time.Hour
+	// ackWaitMargin is added to the handler timeout so a message isn't redelivered while it's processed
+	ackWaitMargin = 30 * time.Second
+	maxNakDelay   = 5 * time.Minute
+)
+
+// AgentsStreamSubjects are the agent subjects that can be consumed from JetStream
+var AgentsStreamSubjects = []string{"report", "deployresult", "wingetcfg.deploy", "wingetcfg.report"}
+
+// messageOutcome is the error a handler has failed a JetStream message with, settle
+// acks the message if there's none
+type messageOutcome struct {
+	mu  sync.Mutex
+	err error
+}
+
+type consumer struct {
+	cc   jetstream.ConsumeContext
+	conn *nats.Conn
+}
+
+func (c *consumer) IsValid(nc *nats.Conn) bool {
+	select {
+	case <-c.cc.Closed():
+		return false
+	default:
+		return c.conn == nc && !nc.IsClosed()
+	}
+}
+
+// CreateAgentsStream creates or updates the stream with the agent ingest subjects,
+// it has as many replicas as NATS servers (JetStream supports up to 5)
+func (w *Worker) CreateAgentsStream() error {
+	var err error
+
+	if w.JetstreamContextCancel != nil {
+		w.JetstreamContextCancel()
+	}
+
+	w.Jetstream, err = jetstream.New(w.NATSConnection())
+	if err != nil {
+		return fmt.Errorf("could not create the JetStream context, reason: %v", err)
+	}
+
+	subjects := []string{}
+	for _, s := range AgentsStreamSubjects {
+		subjects = append(subjects, IngestSubjectPrefix+s)
+	}
+
+	ctx, cancel := context.WithTimeout(w.Context, 30*time.Second)
+	w.JetstreamContextCancel = cancel
+
+	_, err = w.Jetstream.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:      AgentsStream,
+		Subjects:  subjects,
+		Retention: jetstream.WorkQueuePolicy,
+		Storage:   jetstream.FileStorage,
+		MaxAge:    agentsStreamMaxAge,
+		Replicas:  max(1, min(w.Replicas, 5)),
+	})
+	if err != nil {
+		return fmt.Errorf("could not create the %s stream, reason: %v", AgentsStream, err)
+	}
+
+	slog.Info("JetStream stream is ready", "stream", AgentsStream, "subjects", subjects, "replicas", max(1, min(w.Replicas, 5)))
+	return nil
+}
+
+// consume creates a durable consumer for the subject and processes its messages with the handler,
+// messages are acked once the handler returns and redelivered with a backoff if it has failed
+func (w *Worker) consume(s Subscription, handler nats.MsgHandler, concurrency, maxPending int) (*consumer, error) {
+	if w.Jetstream == nil {
+		return nil, fmt.Errorf("JetStream has not been initialized")
+	}
+
+	subject := strings.TrimPrefix(s.Subject, IngestSubjectPrefix)
+	durable := "agent-worker-" + strings.ReplaceAll(subject, ".", "-")
+	ackWait := w.HandlerTimeoutFor(subject) + ackWaitMargin
+	maxDeliver := w.JetstreamMaxDeliver
+	if maxDeliver <= 0 {
+		maxDeliver = DefaultJetstreamMaxDeliver
+	}
+
+	ctx, cancel := context.WithTimeout(w.Context, 30*time.Second)
+	defer cancel()
+
+	c, err := w.Jetstream.CreateOrUpdateConsumer(ctx, s.Stream, jetstream.ConsumerConfig{
+		Durable:       durable,
+		FilterSubject: s.Subject,
+		AckPolicy:     jetstream.AckExplicitPolicy,
+		AckWait:       ackWait,
+		MaxDeliver:    maxDeliver,
+		MaxAckPending: maxPending,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	pool := w.handlerPool(s.Subject, concurrency)
+	cc, err := c.Consume(func(m jetstream.Msg) {
+		// handlers get a core NATS message with the subject they're subscribed to in request/reply,
+		// it has no reply subject so their responses are skipped
+		msg := &nats.Msg{
+			Subject: strings.TrimPrefix(m.Subject(), IngestSubjectPrefix),
+			Data:    m.Data(),
+			Header:  nats.Header{},
+		}
+		for k, v := range m.Headers() {
+			msg.Header[k] = v
+		}
+		msg.Header.Set(ingestSubjectHeader, m.Subject())
+
+		outcome := &messageOutcome{}
+		w.outcomes.Store(msg, outcome)
+
+		pool(func() {
+			handler(msg)
+			w.outcomes.Delete(msg)
+			w.settle(m, msg, outcome, maxDeliver)
+		})
+	},
+		jetstream.PullMaxMessages(max(1, min(maxPending, 1000))),
+		jetstream.ConsumeErrHandler(func(_ jetstream.ConsumeContext, err error) {
+			slog.Warn("JetStream consumer error", "subject", s.Subject, "error", err)
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Info("consuming from JetStream", "stream", s.Stream, "subject", s.Subject, "durable", durable, "ack_wait", ackWait, "max_deliver", maxDeliver)
+	return &consumer{cc: cc, conn: w.NATSConnection()}, nil
+}
+
+// isIngested reports if the message has been consumed from JetStream
+func isIngested(msg *nats.Msg) bool {
+	return msg.Header != nil && msg.Header.Get(ingestSubjectHeader) != ""
+}
+
+// setOutcome records the failure of a JetStream message, the first permanent
+// error wins over the transient ones
+func (w *Worker) setOutcome(msg *nats.Msg, err error) {
+	o, ok := w.outcomes.Load(msg)
+	if !ok {
+		return
+	}
+	outcome := o.(*messageOutcome)
+
+	outcome.mu.Lock()
+	defer outcome.mu.Unlock()
+	if outcome.err == nil || (!IsPermanent(outcome.err) && IsPermanent(err)) {
+		outcome.err = err
+	}
+}
+
+// settle acks the message if the handler succeeded or asks for a redelivery with an exponential
+// backoff, the message is dead-lettered once it has been delivered maxDeliver times
+func (w *Worker) settle(m jetstream.Msg, msg *nats.Msg, outcome *messageOutcome, maxDeliver int) {
+	logger := messageLogger(msg)
+
+	outcome.mu.Lock()
+	failure := outcome.err
+	outcome.mu.Unlock()
+
+	if failure == nil {
+		if err := m.Ack(); err != nil {
+			logger.Error("could not ack the message", "error", err)
+		}
+		return
+	}
+
+	// permanent failures have already been dead-lettered
+	if IsPermanent(failure) {
+		if err := m.Term(); err != nil {
+			logger.Error("could not terminate the message", "error", err)
+		}
+		return
+	}
+
+	delivered := uint64(1)
+	if md, err := m.Metadata(); err == nil {
+		delivered = md.NumDelivered
+	}
+
+	if delivered >= uint64(maxDeliver) {
+		w.DeadLetter(msg, "max deliveries reached, last error: "+failure.Error(), delivered)
+		if err := m.Term(); err != nil {
+			logger.Error("could not terminate the message", "error", err)
+		}
+		return
+	}
+
+	delay := min(10*time.Second<<min(delivered-1, 10), maxNakDelay)
+	logger.Warn("message could not be processed, it will be redelivered", "delivered", delivered, "retry_in", delay)
+	if err := m.NakWithDelay(delay); err != nil {
+		logger.Error("could not nak the message", "error", err)
+	}
+}
@@ -0,0 +1,254 @@
+package common
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/open-uem/utils"
+)
+
+const (
+	// DefaultEncryptionKeyID is the ID of the encryption master key if none has been set
+	DefaultEncryptionKeyID = "1"
+
+	// ciphertextPrefix starts the sensitive fields encrypted with a keyring, it's followed by
+	// the key ID and the hex ciphertext e.g (enc:2:6f70...), fields without it have been encrypted
+	// with the encryption master key before keyrings were supported. The console only reads
+	// the fields without key ID so they're only written if the rotation is asked to
+	ciphertextPrefix = "enc:"
+
+	// minCiphertextLen is the length of the hex ciphertext of an empty value,
+	// the 12 bytes nonce followed by the 16 bytes GCM tag
+	minCiphertextLen = 2 * (12 + 16)
+)
+
+// Keyring contains the key that encrypts the sensitive fields and the retired keys
+// that can still decrypt them until they're rotated
+type Keyring struct {
+	activeID string
+	keys     map[string]string
+}
+
+// NewKeyring returns a keyring whose active key is the encryption master key, the
+// retired keys are kept by their IDs
+func NewKeyring(activeID, activeKey string, retired map[string]string) (*Keyring, error) {
+	if activeKey == "" {
+		if len(retired) > 0 {
+			return nil, fmt.Errorf("retired encryption keys have been set without an encryption master key")
+		}
+		return nil, nil
+	}
+
+	if activeID == "" {
+		activeID = DefaultEncryptionKeyID
+	}
+
+	keys := map[string]string{activeID: activeKey}
+	for id, key := range retired {
+		if id == activeID {
+			return nil, fmt.Errorf("the retired key %s has the ID of the encryption master key", id)
+		}
+		keys[id] = key
+	}
+
+	for id, key := range keys {
+		if id == "" || strings.ContainsAny(id, ":,= ") {
+			return nil, fmt.Errorf("invalid encryption key ID %q, it can't be empty or contain colons, commas, equal signs or spaces", id)
+		}
+		if _, err := aes.NewCipher([]byte(key)); err != nil {
+			return nil, fmt.Errorf("the encryption key %s must be 32 bytes long, it has %d bytes", id, len(key))
+		}
+	}
+
+	return &Keyring{activeID: activeID, keys: keys}, nil
+}
+
+// ActiveID returns the ID of the key that encrypts the sensitive fields
+func (k *Keyring) ActiveID() string {
+	if k == nil {
+		return ""
+	}
+	return k.activeID
+}
+
+// Encrypt encrypts the value with the active key and adds its ID to the ciphertext
+func (k *Keyring) Encrypt(plaintext string) (string, error) {
+	if k == nil {
+		return "", fmt.Errorf("no encryption master key has been set")
+	}
+
+	enc, err := utils.EncryptSensitiveField(plaintext, k.keys[k.activeID])
+	if err != nil {
+		return "", fmt.Errorf("could not encrypt the sensitive field, reason: %v", err)
+	}
+	return ciphertextPrefix + k.activeID + ":" + enc, nil
+}
+
+// Decrypt returns the plaintext of an encrypted field. Fields that don't have a key ID are
+// decrypted with the first key that can open them. Values that don't look like a ciphertext
+// are plaintext and returned as they are, but ciphertexts that no key can open are an error
+// so they're never used as plaintext. A nil keyring returns the value as it is
+func (k *Keyring) Decrypt(v string) (string, error) {
+	if k == nil || v == "" {
+		return v, nil
+	}
+
+	if id, enc, ok := keyedCiphertext(v); ok {
+		key, found := k.keys[id]
+		if !found {
+			return "", fmt.Errorf("the sensitive field has been encrypted with the key %s that is not in the keyring", id)
+		}
+		plaintext, err := utils.DecryptSensitiveField(enc, key)
+		if err != nil {
+			return "", fmt.Errorf("could not decrypt the sensitive field with the key %s, reason: %v", id, err)
+		}
+		return plaintext, nil
+	}
+
+	if id, ok := k.legacyKey(v); ok {
+		plaintext, err := utils.DecryptSensitiveField(v, k.keys[id])
+		if err != nil {
+			return "", fmt.Errorf("could not decrypt the sensitive field with the key %s, reason: %v", id, err)
+		}
+		return plaintext, nil
+	}
+
+	if looksEncrypted(v) {
+		return "", fmt.Errorf("no key of the keyring can decrypt the sensitive field, the key that encrypted it may have been retired")
+	}
+
+	return v, nil
+}
+
+// IsEncrypted reports if a key of the keyring has encrypted the field
+func (k *Keyring) IsEncrypted(v string) bool {
+	if k == nil {
+		return false
+	}
+	if _, _, ok := keyedCiphertext(v); ok {
+		return true
+	}
+	_, ok := k.legacyKey(v)
+	return ok
+}
+
+// Rotate encrypts the field again with the active key, it reports if the value has changed.
+// The key ID is only added if keyIDs is set, otherwise the fields are written in the format the
+// console reads and the fields with key ID are converted to it. Empty and plaintext values are
+// left as they are
+func (k *Keyring) Rotate(v string, keyIDs bool) (string, bool, error) {
+	if k == nil {
+		return "", false, fmt.Errorf("no encryption master key has been set")
+	}
+
+	id, _, keyed := keyedCiphertext(v)
+	switch {
+	case !keyed && !looksEncrypted(v):
+		return v, false, nil
+	case keyIDs && keyed && id == k.activeID:
+		return v, false, nil
+	case !keyIDs && !keyed && canDecrypt(v, k.keys[k.activeID]):
+		return v, false, nil
+	}
+
+	plaintext, err := k.Decrypt(v)
+	if err != nil {
+		return "", false, err
+	}
+
+	if keyIDs {
+		enc, err := k.Encrypt(plaintext)
+		if err != nil {
+			return "", false, err
+		}
+		return enc, true, nil
+	}
+
+	enc, err := utils.EncryptSensitiveField(plaintext, k.keys[k.activeID])
+	if err != nil {
+		return "", false, fmt.Errorf("could not encrypt the sensitive field, reason: %v", err)
+	}
+	return enc, true, nil
+}
+
+// legacyKey returns the ID of the key that opens a field without key ID, the active key is tried first
+func (k *Keyring) legacyKey(v string) (string, bool) {
+	ids := slices.Sorted(maps.Keys(k.keys))
+	ids = slices.DeleteFunc(ids, func(id string) bool { return id == k.activeID })
+	for _, id := range append([]string{k.activeID}, ids...) {
+		if canDecrypt(v, k.keys[id]) {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+// keyedCiphertext splits a field encrypted with a keyring in its key ID and its ciphertext,
+// plaintexts that start with the prefix but aren't followed by a ciphertext aren't split
+func keyedCiphertext(v string) (string, string, bool) {
+	rest, ok := strings.CutPrefix(v, ciphertextPrefix)
+	if !ok {
+		return "", "", false
+	}
+	id, enc, ok := strings.Cut(rest, ":")
+	if !ok || id == "" || strings.ContainsAny(id, ",= ") || !looksEncrypted(enc) {
+		return "", "", false
+	}
+	return id, enc, true
+}
+
+// looksEncrypted reports if the value has the format of a ciphertext, an hex string
+// long enough to hold the nonce and the GCM tag
+func looksEncrypted(v string) bool {
+	if len(v) < minCiphertextLen || len(v)%2 != 0 {
+		return false
+	}
+	_, err := hex.DecodeString(v)
+	return err == nil
+}
+
+// canDecrypt reports if the key opens the hex ciphertext, utils.IsSensitiveFieldEncrypted
+// panics with values shorter than the nonce so they're checked here
+func canDecrypt(v, key string) bool {
+	block, err := aes.NewCipher([]byte(key))
+	if err != nil {
+		return false
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return false
+	}
+
+	data, err := hex.DecodeString(v)
+	if err != nil || len(data) < gcm.NonceSize()+gcm.Overhead() {
+		return false
+	}
+
+	_, err = gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	return err == nil
+}
+
+// ParseEncryptionKeys parses a comma-separated list of id=key pairs, the keys
+// can't contain commas e.g (1=<32 bytes key>,2=<32 bytes key>)
+func ParseEncryptionKeys(s string) (map[string]string, error) {
+	keys := map[string]string{}
+
+	for item := range strings.SplitSeq(s, ",") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+
+		id, key, found := strings.Cut(item, "=")
+		if !found {
+			return nil, fmt.Errorf("encryption key must have the format id=key")
+		}
+		keys[strings.TrimSpace(id)] = key
+	}
+
+	return keys, nil
+}
@@ -0,0 +1,71 @@
+package common
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/open-uem/utils"
+)
+
+func TestKeyringRotate(t *testing.T) {
+	keyring, err := NewKeyring("2", testActiveKey, map[string]string{"1": testRetiredKey})
+	if err != nil {
+		t.Fatalf("could not create the keyring: %v", err)
+	}
+
+	retired, err := utils.EncryptSensitiveField("secret", testRetiredKey)
+	if err != nil {
+		t.Fatalf("could not encrypt with the retired key: %v", err)
+	}
+	active, err := utils.EncryptSensitiveField("secret", testActiveKey)
+	if err != nil {
+		t.Fatalf("could not encrypt with the active key: %v", err)
+	}
+	keyed, err := keyring.Encrypt("secret")
+	if err != nil {
+		t.Fatalf("could not encrypt with the keyring: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		value       string
+		keyIDs      bool
+		wantChanged bool
+		wantKeyed   bool
+	}{
+		{name: "plaintext", value: "secret"},
+		{name: "retired key", value: retired, wantChanged: true},
+		{name: "active key", value: active},
+		{name: "key ID converted for the console", value: keyed, wantChanged: true},
+		{name: "retired key with key IDs", value: retired, keyIDs: true, wantChanged: true, wantKeyed: true},
+		{name: "active key with key IDs", value: keyed, keyIDs: true, wantKeyed: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, changed, err := keyring.Rotate(tt.value, tt.keyIDs)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if changed != tt.wantChanged {
+				t.Errorf("got changed %t, want %t", changed, tt.wantChanged)
+			}
+			if !changed && got != tt.value {
+				t.Errorf("the value has been modified without being reported")
+			}
+			if tt.value == "secret" {
+				return
+			}
+
+			if keyed := strings.HasPrefix(got, ciphertextPrefix); keyed != tt.wantKeyed {
+				t.Errorf("got %q with key ID %t, want %t", got, keyed, tt.wantKeyed)
+			}
+			if !tt.wantKeyed && !canDecrypt(got, testActiveKey) {
+				t.Errorf("the console can't decrypt %q with the active key", got)
+			}
+			if plaintext, err := keyring.Decrypt(got); err != nil || plaintext != "secret" {
+				t.Errorf("got plaintext %q and error %v, want %q", plaintext, err, "secret")
+			}
+		})
+	}
+}
@@ -0,0 +1,348 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-co-op/gocron/v2"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	// LeaderBucket is the NATS KV bucket where each role's leader keeps its lease
+	LeaderBucket           = "OPENUEM_WORKER_LEADERS"
+	DefaultLeaderLeaseTTL  = 15 * time.Second
+	minLeaderLeaseTTL      = 3 * time.Second
+	leaderOperationTimeout = 5 * time.Second
+)
+
+var ErrNotLeader = errors.New("this worker is not the leader")
+
+// LeaderInfo is the value of the lease, it identifies the worker that holds it
+type LeaderInfo struct {
+	InstanceID string    `json:"instance_id"`
+	Hostname   string    `json:"hostname"`
+	Since      time.Time `json:"since"`
+}
+
+// LeaderStatus is the state of a role's election shown in ping replies
+type LeaderStatus struct {
+	Role           string     `json:"role"`
+	IsLeader       bool       `json:"is_leader"`
+	Leader         string     `json:"leader,omitempty"`
+	LeaderHostname string     `json:"leader_hostname,omitempty"`
+	LeaderSince    *time.Time `json:"leader_since,omitempty"`
+}
+
+// LeaderElection elects one replica of a role as the leader. The leader renews its lease
+// every third of the TTL, if it dies the lease expires and another replica takes it over,
+// if it stops the lease is deleted and the replicas watching the key take it over at once
+type LeaderElection struct {
+	Role string
+
+	w        *Worker
+	ttl      time.Duration
+	leader   atomic.Bool
+	mu       sync.Mutex
+	current  *LeaderInfo
+	since    time.Time
+	revision uint64
+	kv       jetstream.KeyValue
+	kvConn   *nats.Conn
+	watcher  jetstream.KeyWatcher
+	wake     chan struct{}
+}
+
+// StartLeaderElections starts an election for each role run by the worker
+func (w *Worker) StartLeaderElections() {
+	w.electionsMu.Lock()
+	defer w.electionsMu.Unlock()
+
+	if w.elections != nil {
+		return
+	}
+
+	ttl := w.LeaderLeaseTTL
+	if ttl < minLeaderLeaseTTL {
+		ttl = DefaultLeaderLeaseTTL
+	}
+
+	var ctx context.Context
+	ctx, w.electionsCancel = context.WithCancel(w.Context)
+	w.elections = map[string]*LeaderElection{}
+	for role := range strings.SplitSeq(w.Role, ",") {
+		e := &LeaderElection{Role: role, w: w, ttl: ttl, wake: make(chan struct{}, 1)}
+		w.elections[role] = e
+
+		w.electionsWG.Add(1)
+		go func() {
+			defer w.electionsWG.Done()
+			e.run(ctx)
+		}()
+	}
+}
+
+// StopLeaderElections resigns the leaderships so other replicas take them over without waiting for the leases to expire
+func (w *Worker) StopLeaderElections() {
+	w.electionsMu.Lock()
+	cancel := w.electionsCancel
+	w.electionsMu.Unlock()
+
+	if cancel == nil {
+		return
+	}
+	cancel()
+	w.electionsWG.Wait()
+}
+
+// IsLeader reports if this worker is the leader of the role
+func (w *Worker) IsLeader(role string) bool {
+	w.electionsMu.Lock()
+	e, ok := w.elections[role]
+	w.electionsMu.Unlock()
+
+	return ok && e.leader.Load()
+}
+
+// LeaderStatus returns the state of the elections of the worker's roles
+func (w *Worker) LeaderStatus() []LeaderStatus {
+	w.electionsMu.Lock()
+	defer w.electionsMu.Unlock()
+
+	status := []LeaderStatus{}
+	for _, role := range strings.Split(w.Role, ",") {
+		e, ok := w.elections[role]
+		if !ok {
+			continue
+		}
+		status = append(status, e.Status())
+	}
+	return status
+}
+
+// NewSingletonJob schedules a job that only runs on the leader of the role, the
+// replicas that aren't the leader skip its runs
+func (w *Worker) NewSingletonJob(role string, definition gocron.JobDefinition, task gocron.Task, options ...gocron.JobOption) (gocron.Job, error) {
+	options = append(options,
+		gocron.WithSingletonMode(gocron.LimitModeReschedule),
+		gocron.WithEventListeners(gocron.BeforeJobRunsSkipIfBeforeFuncErrors(func(_ uuid.UUID, name string) error {
+			if !w.IsLeader(role) {
+				slog.Debug("skipping singleton job, this worker is not the leader", "job", name, "role", role)
+				return ErrNotLeader
+			}
+			return nil
+		})),
+	)
+	return w.TaskScheduler.NewJob(definition, task, options...)
+}
+
+// IsLeader implements gocron.Elector so the election can be used by a scheduler
+// whose jobs must all run on the leader
+func (e *LeaderElection) IsLeader(context.Context) error {
+	if !e.leader.Load() {
+		return ErrNotLeader
+	}
+	return nil
+}
+
+func (e *LeaderElection) Status() LeaderStatus {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	status := LeaderStatus{Role: e.Role, IsLeader: e.leader.Load()}
+	if e.current != nil {
+		status.Leader = e.current.InstanceID
+		status.LeaderHostname = e.current.Hostname
+		since := e.current.Since
+		status.LeaderSince = &since
+	}
+	return status
+}
+
+func (e *LeaderElection) run(ctx context.Context) {
+	ticker := time.NewTicker(e.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		e.campaign(ctx)
+
+		select {
+		case <-ctx.Done():
+			e.resign()
+			return
+		case <-ticker.C:
+		case <-e.wake:
+		}
+	}
+}
+
+// campaign renews the lease if this worker is the leader or tries to take it
+func (e *LeaderElection) campaign(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, leaderOperationTimeout)
+	defer cancel()
+
+	kv, err := e.keyValue(ctx)
+	if err != nil {
+		e.stepDown("could not reach the leader election bucket", err)
+		return
+	}
+
+	if e.leader.Load() {
+		data, _ := json.Marshal(LeaderInfo{InstanceID: e.w.InstanceID, Hostname: e.w.Hostname, Since: e.since})
+		rev, err := kv.Update(ctx, e.Role, data, e.revision)
+		if err == nil {
+			e.mu.Lock()
+			e.revision = rev
+			e.mu.Unlock()
+			return
+		}
+		e.stepDown("could not renew the leader lease", err)
+	}
+
+	since := time.Now().UTC()
+	data, _ := json.Marshal(LeaderInfo{InstanceID: e.w.InstanceID, Hostname: e.w.Hostname, Since: since})
+	rev, err := kv.Create(ctx, e.Role, data)
+	if err == nil {
+		e.mu.Lock()
+		e.revision = rev
+		e.since = since
+		e.current = &LeaderInfo{InstanceID: e.w.InstanceID, Hostname: e.w.Hostname, Since: since}
+		e.mu.Unlock()
+		e.leader.Store(true)
+		e.w.Metrics.Leader.WithLabelValues(e.Role).Set(1)
+		e.w.Metrics.LeaderChanges.WithLabelValues(e.Role).Inc()
+		slog.Info("this worker is now the leader", "role", e.Role)
+		return
+	}
+	if !errors.Is(err, jetstream.ErrKeyExists) {
+		slog.Warn("could not campaign for the leadership", "role", e.Role, "error", err)
+	}
+
+	if entry, err := kv.Get(ctx, e.Role); err == nil {
+		e.setCurrent(entry.Value())
+	}
+}
+
+func (e *LeaderElection) stepDown(reason string, err error) {
+	if e.leader.Swap(false) {
+		e.w.Metrics.Leader.WithLabelValues(e.Role).Set(0)
+		slog.Warn("this worker is no longer the leader", "role", e.Role, "reason", reason, "error", err)
+		e.mu.Lock()
+		e.current = nil
+		e.mu.Unlock()
+	}
+}
+
+// resign deletes the lease if this worker still holds it
+func (e *LeaderElection) resign() {
+	if !e.leader.Swap(false) {
+		return
+	}
+	e.w.Metrics.Leader.WithLabelValues(e.Role).Set(0)
+
+	e.mu.Lock()
+	kv, revision := e.kv, e.revision
+	e.mu.Unlock()
+	if kv == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), leaderOperationTimeout)
+	defer cancel()
+	if err := kv.Delete(ctx, e.Role, jetstream.LastRevision(revision)); err != nil {
+		slog.Warn("could not resign the leadership, it will expire", "role", e.Role, "error", err)
+		return
+	}
+	slog.Info("this worker has resigned the leadership", "role", e.Role)
+}
+
+func (e *LeaderElection) setCurrent(data []byte) {
+	info := LeaderInfo{}
+	if err := json.Unmarshal(data, &info); err != nil {
+		return
+	}
+
+	e.mu.Lock()
+	e.current = &info
+	e.mu.Unlock()
+}
+
+// keyValue returns the leader bucket of the current NATS connection, the bucket is
+// created the first time and its lease key is watched to campaign as soon as it's deleted
+func (e *LeaderElection) keyValue(ctx context.Context) (jetstream.KeyValue, error) {
+	nc := e.w.NATSConnection()
+	if nc == nil || !nc.IsConnected() {
+		return nil, fmt.Errorf("NATS is not connected")
+	}
+
+	e.mu.Lock()
+	kv, kvConn, previous := e.kv, e.kvConn, e.watcher
+	e.mu.Unlock()
+
+	if kv != nil && kvConn == nc {
+		return kv, nil
+	}
+
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return nil, err
+	}
+
+	kv, err = js.CreateOrUpdateKeyValue(ctx, jetstream.KeyValueConfig{
+		Bucket:      LeaderBucket,
+		Description: "Leases of the OpenUEM workers leaders",
+		TTL:         e.ttl,
+		History:     1,
+		Storage:     jetstream.MemoryStorage,
+		Replicas:    max(1, min(e.w.Replicas, 5)),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if previous != nil {
+		_ = previous.Stop()
+	}
+	watcher, err := kv.Watch(context.Background(), e.Role, jetstream.UpdatesOnly())
+	if err != nil {
+		return nil, err
+	}
+	go e.watch(watcher)
+
+	e.mu.Lock()
+	e.kv, e.kvConn, e.watcher = kv, nc, watcher
+	e.mu.Unlock()
+	return kv, nil
+}
+
+func (e *LeaderElection) watch(watcher jetstream.KeyWatcher) {
+	for entry := range watcher.Updates() {
+		if entry == nil {
+			continue
+		}
+
+		switch entry.Operation() {
+		case jetstream.KeyValueDelete, jetstream.KeyValuePurge:
+			e.mu.Lock()
+			e.current = nil
+			e.mu.Unlock()
+
+			// the leader has resigned, campaign now
+			select {
+			case e.wake <- struct{}{}:
+			default:
+			}
+		case jetstream.KeyValuePut:
+			e.setCurrent(entry.Value())
+		}
+	}
+}
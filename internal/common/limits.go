@@ -0,0 +1,330 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	openuem_nats "github.com/open-uem/nats"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// LimitErrorHeader and LimitErrorCodeHeader are set in the reply to a rejected message,
+	// the code follows the HTTP status codes (413 or 429)
+	LimitErrorHeader     = "Openuem-Error"
+	LimitErrorCodeHeader = "Openuem-Error-Code"
+
+	RejectRateLimited     = "rate_limited"
+	RejectPayloadTooLarge = "payload_too_large"
+	RejectTooManyItems    = "too_many_items"
+
+	// limiters of the agents that haven't sent a message lately are removed this often
+	limiterSweepInterval = 5 * time.Minute
+)
+
+// DefaultRateLimits contains the number of messages an agent can send per period to the
+// ingestion subjects, agents send a report every few minutes so these are generous
+var DefaultRateLimits = map[string]RateLimit{
+	"report":             {Count: 10, Period: time.Minute},
+	"deployresult":       {Count: 120, Period: time.Minute},
+	"wingetcfg.profiles": {Count: 10, Period: time.Minute},
+	"agentconfig":        {Count: 10, Period: time.Minute},
+}
+
+// DefaultMaxPayloadSizes contains the maximum size in bytes of the messages of a subject,
+// the NATS server rejects anything bigger than its max_payload anyway
+var DefaultMaxPayloadSizes = map[string]int{
+	"report":             16 << 20,
+	"deployresult":       1 << 20,
+	"wingetcfg.profiles": 1 << 20,
+	"agentconfig":        64 << 10,
+}
+
+// DefaultMaxReportItems contains the maximum number of items of each list in an agent report,
+// keys are the JSON names of the lists and "*" applies to the lists not listed
+var DefaultMaxReportItems = map[string]int{
+	"*":       1000,
+	"apps":    20000,
+	"updates": 10000,
+}
+
+// RateLimit lets an agent send Count messages per Period, up to Count at once
+type RateLimit struct {
+	Count  int
+	Period time.Duration
+}
+
+func (l RateLimit) String() string {
+	return fmt.Sprintf("%d/%s", l.Count, formatDuration(l.Period))
+}
+
+// LimitError is the reason a message has been rejected without being processed
+type LimitError struct {
+	Reason string
+	Code   int
+	Err    error
+}
+
+func (e *LimitError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *LimitError) Unwrap() error {
+	return e.Err
+}
+
+// agentLimiters keeps a token bucket per subject and agent
+type agentLimiters struct {
+	mu        sync.Mutex
+	limiters  map[string]*agentLimiter
+	lastSweep time.Time
+}
+
+type agentLimiter struct {
+	limit    RateLimit
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// allow takes a token from the agent's bucket, the bucket is created again if the limit has changed
+func (l *agentLimiters) allow(subject, agentID string, limit RateLimit) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if l.limiters == nil {
+		l.limiters = map[string]*agentLimiter{}
+		l.lastSweep = now
+	}
+
+	key := subject + "/" + agentID
+	al, ok := l.limiters[key]
+	if !ok || al.limit != limit {
+		al = &agentLimiter{
+			limit:   limit,
+			limiter: rate.NewLimiter(rate.Every(limit.Period/time.Duration(limit.Count)), limit.Count),
+		}
+		l.limiters[key] = al
+	}
+	al.lastSeen = now
+
+	// a bucket untouched for a whole period is full again, removing it changes nothing
+	if now.Sub(l.lastSweep) > limiterSweepInterval {
+		for k, v := range l.limiters {
+			if now.Sub(v.lastSeen) > v.limit.Period {
+				delete(l.limiters, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	return al.limiter.AllowN(now, 1)
+}
+
+// LimitPayload wraps a NATS handler so messages bigger than the size configured for their subject
+// are rejected before they're unmarshalled
+func (w *Worker) LimitPayload(handler nats.MsgHandler) nats.MsgHandler {
+	return func(msg *nats.Msg) {
+		subject := subscriptionSubject(msg)
+		maxPayloadSizes := w.liveSettings().MaxPayloadSizes
+		maxSize, ok := maxPayloadSizes[subject]
+		if !ok {
+			maxSize, ok = DefaultMaxPayloadSizes[subject]
+		}
+		if !ok {
+			maxSize, ok = maxPayloadSizes["*"]
+		}
+
+		if ok && maxSize > 0 && len(msg.Data) > maxSize {
+			w.Reject(msg, &LimitError{
+				Reason: RejectPayloadTooLarge,
+				Code:   http.StatusRequestEntityTooLarge,
+				Err:    fmt.Errorf("the message has %d bytes, the maximum for subject %s is %d bytes", len(msg.Data), subject, maxSize),
+			})
+			return
+		}
+
+		handler(msg)
+	}
+}
+
+// AllowAgent checks that the agent hasn't exceeded the rate limit of the message's subject,
+// subjects without a rate limit are never limited
+func (w *Worker) AllowAgent(msg *nats.Msg, agentID string) error {
+	// replayed messages don't arrive at the pace they were received
+	if w.isReplay(msg) {
+		return nil
+	}
+
+	subject := msg.Subject
+	limit, ok := w.liveSettings().RateLimits[subject]
+	if !ok {
+		limit, ok = DefaultRateLimits[subject]
+	}
+	if !ok || limit.Count <= 0 || limit.Period <= 0 {
+		return nil
+	}
+
+	if !w.rateLimiters.allow(subject, agentID, limit) {
+		return &LimitError{
+			Reason: RejectRateLimited,
+			Code:   http.StatusTooManyRequests,
+			Err:    fmt.Errorf("agent %s has exceeded the rate limit of %s messages for subject %s", agentID, limit, subject),
+		}
+	}
+
+	return nil
+}
+
+// CheckReportItems checks that no list in the agent report has more items than allowed
+func (w *Worker) CheckReportItems(report *openuem_nats.AgentReport) error {
+	lists := map[string]int{
+		"logicaldisks":    len(report.LogicalDisks),
+		"physicaldisks":   len(report.PhysicalDisks),
+		"monitors":        len(report.Monitors),
+		"memoryslots":     len(report.MemorySlots),
+		"printers":        len(report.Printers),
+		"shares":          len(report.Shares),
+		"networkadapters": len(report.NetworkAdapters),
+		"apps":            len(report.Applications),
+		"loggedonusers":   len(report.LoggedOnUsers),
+		"updates":         len(report.Updates),
+	}
+
+	maxReportItems := w.liveSettings().MaxReportItems
+	for name, n := range lists {
+		if maxItems := subjectLimit(maxReportItems, DefaultMaxReportItems, name); n > maxItems {
+			return &LimitError{
+				Reason: RejectTooManyItems,
+				Code:   http.StatusRequestEntityTooLarge,
+				Err:    fmt.Errorf("the report has %d %s, the maximum is %d", n, name, maxItems),
+			}
+		}
+	}
+
+	return nil
+}
+
+// Reject counts the rejected message and replies with the error so the agent knows why it
+// hasn't been processed. Rate-limited requests are dropped, the agent will send them again,
+// but the agent won't send again the messages consumed from JetStream so they're redelivered
+// with a delay. Oversized messages are permanent failures and are dead-lettered
+func (w *Worker) Reject(msg *nats.Msg, err error) {
+	logger := messageLogger(msg)
+
+	var limitErr *LimitError
+	if !errors.As(err, &limitErr) {
+		limitErr = &LimitError{Reason: "invalid", Code: http.StatusBadRequest, Err: err}
+	}
+
+	w.Metrics.MessagesRejected.WithLabelValues(subscriptionSubject(msg), limitErr.Reason).Inc()
+	logger.Warn("message has been rejected", "reason", limitErr.Reason, "error", limitErr.Err)
+
+	switch {
+	case limitErr.Reason != RejectRateLimited:
+		w.FailMessage(msg, Permanent(err))
+	case isIngested(msg):
+		w.FailMessage(msg, err)
+	}
+
+	reply := nats.NewMsg(msg.Reply)
+	reply.Header.Set(LimitErrorHeader, limitErr.Reason)
+	reply.Header.Set(LimitErrorCodeHeader, strconv.Itoa(limitErr.Code))
+	reply.Data = []byte(limitErr.Error())
+	if err := w.respondMsg(msg, reply); err != nil {
+		logger.Error("could not respond to rejected message", "error", err)
+	}
+}
+
+// ParseRateLimits parses a comma-separated list of subject=count/period pairs
+// e.g (report=10/1m,agentconfig=5/30s)
+func ParseRateLimits(s string) (map[string]RateLimit, error) {
+	limits := map[string]RateLimit{}
+
+	for item := range strings.SplitSeq(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		subject, value, found := strings.Cut(item, "=")
+		if !found {
+			return nil, fmt.Errorf("rate limit %q must have the format subject=count/period", item)
+		}
+		subject = strings.TrimSpace(subject)
+
+		count, period, found := strings.Cut(strings.TrimSpace(value), "/")
+		if !found {
+			return nil, fmt.Errorf("rate limit %q must have the format subject=count/period", item)
+		}
+
+		n, err := strconv.Atoi(strings.TrimSpace(count))
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("rate limit count for subject %s must be a positive number", subject)
+		}
+
+		d, err := time.ParseDuration(strings.TrimSpace(period))
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("rate limit period for subject %s must be a positive duration", subject)
+		}
+
+		limits[subject] = RateLimit{Count: n, Period: d}
+	}
+
+	return limits, nil
+}
+
+// ParseSizes parses a comma-separated list of subject=size pairs, sizes are bytes
+// with an optional KB, MB or GB suffix e.g (*=1MB,report=16MB)
+func ParseSizes(s string) (map[string]int, error) {
+	sizes := map[string]int{}
+
+	for item := range strings.SplitSeq(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		subject, value, found := strings.Cut(item, "=")
+		if !found {
+			return nil, fmt.Errorf("size %q must have the format subject=size", item)
+		}
+		subject = strings.TrimSpace(subject)
+
+		n, err := ParseSize(value)
+		if err != nil {
+			return nil, fmt.Errorf("size for subject %s must be a positive number of bytes", subject)
+		}
+		sizes[subject] = n
+	}
+
+	return sizes, nil
+}
+
+// ParseSize parses a size in bytes with an optional KB, MB or GB suffix e.g (100MB)
+func ParseSize(s string) (int, error) {
+	value := strings.ToUpper(strings.TrimSpace(s))
+	multiplier := 1
+	for _, unit := range []struct {
+		suffix     string
+		multiplier int
+	}{{"KB", 1 << 10}, {"MB", 1 << 20}, {"GB", 1 << 30}, {"B", 1}} {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix))
+			multiplier = unit.multiplier
+			break
+		}
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("size %q must be a positive number of bytes", s)
+	}
+	return n * multiplier, nil
+}
@@ -0,0 +1,96 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+)
+
+// SetLogger sets the default slog logger using the worker's log format and level,
+// log lines are written to the OpenUEM log file if the worker has one or to stderr otherwise
+func (w *Worker) SetLogger() error {
+	level, err := ParseLogLevel(w.LogLevel)
+	if err != nil {
+		return err
+	}
+	w.LogLevelVar.Set(level)
+
+	var out io.Writer = os.Stderr
+	if w.Logger != nil && w.Logger.LogFile != nil {
+		out = w.Logger.LogFile
+	}
+
+	opts := &slog.HandlerOptions{Level: &w.LogLevelVar}
+
+	var handler slog.Handler
+	switch strings.ToLower(w.LogFormat) {
+	case "", "text":
+		handler = slog.NewTextHandler(out, opts)
+	case "json":
+		handler = slog.NewJSONHandler(out, opts)
+	default:
+		return fmt.Errorf("unknown log format %q, valid formats are text and json", w.LogFormat)
+	}
+
+	logger := slog.New(&lastErrorHandler{Handler: handler, recorder: &w.lastError})
+	if w.Role != "" {
+		logger = logger.With("worker", w.Role)
+	}
+	slog.SetDefault(logger)
+
+	return nil
+}
+
+func ParseLogLevel(l string) (slog.Level, error) {
+	switch strings.ToLower(l) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	default:
+		return slog.LevelInfo, fmt.Errorf("unknown log level %q, valid levels are debug, info, warn and error", l)
+	}
+}
+
+// messageLogger returns a logger with the subject of the NATS message being processed
+func messageLogger(msg *nats.Msg) *slog.Logger {
+	return slog.With("subject", msg.Subject)
+}
+
+// lastErrorHandler keeps the last error logged so it can be reported in the ping replies
+type lastErrorHandler struct {
+	slog.Handler
+	recorder *lastErrorRecorder
+}
+
+func (h *lastErrorHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= slog.LevelError {
+		message := r.Message
+		r.Attrs(func(a slog.Attr) bool {
+			if a.Key == "error" {
+				message = fmt.Sprintf("%s: %v", message, a.Value.Any())
+				return false
+			}
+			return true
+		})
+		h.recorder.set(message, r.Time)
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *lastErrorHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &lastErrorHandler{Handler: h.Handler.WithAttrs(attrs), recorder: h.recorder}
+}
+
+func (h *lastErrorHandler) WithGroup(name string) slog.Handler {
+	return &lastErrorHandler{Handler: h.Handler.WithGroup(name), recorder: h.recorder}
+}
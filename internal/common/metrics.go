@@ -0,0 +1,258 @@
+package common
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+type Metrics struct {
+	Registry           *prometheus.Registry
+	MessagesReceived   *prometheus.CounterVec
+	MessagesFailed     *prometheus.CounterVec
+	HandlerDuration    *prometheus.HistogramVec
+	DBErrors           *prometheus.CounterVec
+	NATSReconnects     prometheus.Counter
+	EmailsSent         prometheus.Counter
+	EmailsFailed       prometheus.Counter
+	ClientCertReloads  prometheus.Counter
+	HandlerConcurrency *prometheus.GaugeVec
+	HandlersBusy       *prometheus.GaugeVec
+	HandlersSaturated  *prometheus.CounterVec
+	SlowConsumers      *prometheus.CounterVec
+	DeadLetters        *prometheus.CounterVec
+	MessagesRejected   *prometheus.CounterVec
+	Leader             *prometheus.GaugeVec
+	LeaderChanges      *prometheus.CounterVec
+	// Totals reported in the ping replies
+	Processed atomic.Uint64
+	Failed    atomic.Uint64
+}
+
+func NewMetrics() *Metrics {
+	m := Metrics{
+		Registry: prometheus.NewRegistry(),
+		MessagesReceived: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "openuem_worker",
+			Name:      "messages_received_total",
+			Help:      "Number of NATS messages received per subject",
+		}, []string{"subject"}),
+		MessagesFailed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "openuem_worker",
+			Name:      "messages_failed_total",
+			Help:      "Number of NATS messages that could not be processed per subject",
+		}, []string{"subject"}),
+		HandlerDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "openuem_worker",
+			Name:      "handler_duration_seconds",
+			Help:      "Time spent processing a NATS message per subject",
+			Buckets:   prometheus.ExponentialBuckets(0.005, 2, 14),
+		}, []string{"subject"}),
+		DBErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "openuem_worker",
+			Name:      "db_errors_total",
+			Help:      "Number of database errors per model method",
+		}, []string{"method"}),
+		NATSReconnects: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "openuem_worker",
+			Name:      "nats_reconnects_total",
+			Help:      "Number of times the worker has reconnected to NATS",
+		}),
+		EmailsSent: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "openuem_worker",
+			Name:      "emails_sent_total",
+			Help:      "Number of emails sent by the notification worker",
+		}),
+		EmailsFailed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "openuem_worker",
+			Name:      "emails_failed_total",
+			Help:      "Number of emails the notification worker could not send",
+		}),
+		ClientCertReloads: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "openuem_worker",
+			Name:      "client_certificate_reloads_total",
+			Help:      "Number of times the worker has loaded a replaced NATS client certificate",
+		}),
+		HandlerConcurrency: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "openuem_worker",
+			Name:      "handler_concurrency",
+			Help:      "Maximum number of messages processed at the same time per subject",
+		}, []string{"subject"}),
+		HandlersBusy: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "openuem_worker",
+			Name:      "handlers_busy",
+			Help:      "Number of messages being processed per subject",
+		}, []string{"subject"}),
+		HandlersSaturated: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "openuem_worker",
+			Name:      "handlers_saturated_total",
+			Help:      "Number of messages that had to wait because all the handlers of the subject were busy",
+		}, []string{"subject"}),
+		SlowConsumers: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "openuem_worker",
+			Name:      "slow_consumer_events_total",
+			Help:      "Number of times NATS dropped messages because the pending limit of the subject was exceeded",
+		}, []string{"subject"}),
+		DeadLetters: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "openuem_worker",
+			Name:      "dead_letters_total",
+			Help:      "Number of messages that failed permanently and were sent to the dead-letter stream per subject",
+		}, []string{"subject"}),
+		MessagesRejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "openuem_worker",
+			Name:      "messages_rejected_total",
+			Help:      "Number of agent messages rejected because of the rate or payload limits per subject and reason",
+		}, []string{"subject", "reason"}),
+		Leader: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "openuem_worker",
+			Name:      "leader",
+			Help:      "Whether this worker is the leader of the role and runs its singleton jobs (1) or not (0)",
+		}, []string{"role"}),
+		LeaderChanges: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "openuem_worker",
+			Name:      "leader_elections_won_total",
+			Help:      "Number of times this worker has become the leader of the role",
+		}, []string{"role"}),
+	}
+
+	m.Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.MessagesReceived,
+		m.MessagesFailed,
+		m.HandlerDuration,
+		m.DBErrors,
+		m.NATSReconnects,
+		m.EmailsSent,
+		m.EmailsFailed,
+		m.ClientCertReloads,
+		m.HandlerConcurrency,
+		m.HandlersBusy,
+		m.HandlersSaturated,
+		m.SlowConsumers,
+		m.DeadLetters,
+		m.MessagesRejected,
+		m.Leader,
+		m.LeaderChanges,
+	)
+
+	return &m
+}
+
+// pendingCollector reports the messages waiting for a handler per subject when metrics are scraped
+type pendingCollector struct {
+	w    *Worker
+	desc *prometheus.Desc
+}
+
+func (c *pendingCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *pendingCollector) Collect(ch chan<- prometheus.Metric) {
+	for subject, n := range c.w.PendingBySubject() {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(n), subject)
+	}
+}
+
+// RegisterWorkerState registers the gauges computed from the worker's state when metrics are scraped
+func (m *Metrics) RegisterWorkerState(w *Worker) {
+	m.Registry.MustRegister(
+		&pendingCollector{
+			w:    w,
+			desc: prometheus.NewDesc("openuem_worker_pending_messages", "Number of messages waiting for a handler per subject", []string{"subject"}, nil),
+		},
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "openuem_worker",
+			Name:      "nats_connected",
+			Help:      "1 if the worker is connected to NATS, 0 otherwise",
+		}, func() float64 {
+			if w.NATSState() == "connected" {
+				return 1
+			}
+			return 0
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "openuem_worker",
+			Name:      "db_up",
+			Help:      "1 if the database is reachable, 0 otherwise",
+		}, func() float64 {
+			if w.DBReady.Load() {
+				return 1
+			}
+			return 0
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "openuem_worker",
+			Name:      "subscriptions_active",
+			Help:      "Number of live NATS subscriptions",
+		}, func() float64 {
+			return float64(len(w.ActiveSubscriptions()))
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "openuem_worker",
+			Name:      "subscriptions_missing",
+			Help:      "Number of NATS subscriptions the worker should have but are not live",
+		}, func() float64 {
+			return float64(len(w.MissingSubscriptions()))
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "openuem_worker",
+			Name:      "handlers_in_flight",
+			Help:      "Number of NATS messages being processed",
+		}, func() float64 {
+			return float64(w.InFlight.Load())
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "openuem_worker",
+			Name:      "client_certificate_expiry_timestamp_seconds",
+			Help:      "Time when the NATS client certificate expires, in seconds since the Unix epoch",
+		}, func() float64 {
+			return float64(w.clientCertNotAfter.Load())
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "openuem_worker",
+			Name:      "client_certificate_expiring",
+			Help:      "1 if the NATS client certificate has reached an expiry warning threshold, 0 otherwise",
+		}, func() float64 {
+			if w.ClientCertExpiring() {
+				return 1
+			}
+			return 0
+		}),
+	)
+}
+
+// Instrument wraps a NATS handler so every message received through it is counted and timed
+func (w *Worker) Instrument(handler nats.MsgHandler) nats.MsgHandler {
+	return func(msg *nats.Msg) {
+		subject := subscriptionSubject(msg)
+		w.Metrics.MessagesReceived.WithLabelValues(subject).Inc()
+
+		start := time.Now()
+		handler(msg)
+		w.Metrics.Processed.Add(1)
+		w.Metrics.HandlerDuration.WithLabelValues(subject).Observe(time.Since(start).Seconds())
+	}
+}
+
+func (m *Metrics) MessageFailed(msg *nats.Msg) {
+	m.Failed.Add(1)
+	m.MessagesFailed.WithLabelValues(subscriptionSubject(msg)).Inc()
+}
+
+func (m *Metrics) DBError(method string) {
+	m.DBErrors.WithLabelValues(method).Inc()
+}
+
+// subscriptionSubject returns the subject used to subscribe (e.g certificates.agent.*)
+// so wildcard subscriptions don't create a label per agent
+func subscriptionSubject(msg *nats.Msg) string {
+	if msg.Sub != nil && msg.Sub.Subject != "" {
+		return msg.Sub.Subject
+	}
+	return msg.Subject
+}
@@ -1,52 +1,140 @@
 package common
 
 import (
-	"log"
+	"errors"
+	"log/slog"
 	"time"
 
 	"github.com/go-co-op/gocron/v2"
+	natsio "github.com/nats-io/nats.go"
 	"github.com/open-uem/nats"
 )
 
+const NATSSupervisionInterval = 30 * time.Second
+
+// StartNATSConnectJob connects to NATS and starts a job that supervises the connection,
+// the job connects again if the connection has been closed and re-creates the missing subscriptions
 func (w *Worker) StartNATSConnectJob(queueSubscribe func() error) error {
 	var err error
 
-	w.NATSConnection, err = nats.ConnectWithNATS(w.NATSServers, w.ClientCertPath, w.ClientKeyPath, w.CACertPath, "")
-	if err == nil {
-		if err := queueSubscribe(); err == nil {
-			return err
-		}
-	}
-	log.Printf("[ERROR]: could not connect to NATS servers in %s, reason: %v\n", w.NATSServers, err)
+	w.queueSubscribe = queueSubscribe
+	w.SuperviseNATSConnection()
 
 	w.NATSConnectJob, err = w.TaskScheduler.NewJob(
-		gocron.DurationJob(
-			time.Duration(time.Duration(2*time.Minute)),
-		),
-		gocron.NewTask(
-			func() {
-				if w.NATSConnection == nil {
-					w.NATSConnection, err = nats.ConnectWithNATS(w.NATSServers, w.ClientCertPath, w.ClientKeyPath, w.CACertPath, "")
-					if err != nil {
-						log.Printf("[ERROR]: could not connect to NATS %v", err)
-						return
-					}
-				}
-
-				if err := queueSubscribe(); err != nil {
-					return
-				}
-
-				if err := w.TaskScheduler.RemoveJob(w.NATSConnectJob.ID()); err != nil {
-					return
-				}
-			},
-		),
+		gocron.DurationJob(NATSSupervisionInterval),
+		gocron.NewTask(w.SuperviseNATSConnection),
+		gocron.WithSingletonMode(gocron.LimitModeReschedule),
 	)
 	if err != nil {
-		log.Fatalf("[FATAL]: could not start the NATS connect job: %v", err)
+		slog.Error("could not start the NATS connect job", "error", err)
 		return err
 	}
-	log.Printf("[INFO]: new NATS connect job has been scheduled every %d minutes", 2)
+	slog.Info("new NATS supervision job has been scheduled", "every", NATSSupervisionInterval)
 	return nil
 }
+
+func (w *Worker) SuperviseNATSConnection() {
+	w.natsMu.Lock()
+	defer w.natsMu.Unlock()
+
+	if w.Stopping.Load() {
+		return
+	}
+
+	nc := w.NATSConnection()
+	if nc == nil || nc.IsClosed() {
+		var err error
+		nc, err = nats.ConnectWithNATS(w.NATSServers, w.ClientCertPath, w.ClientKeyPath, w.CACertPath, "")
+		if err != nil {
+			slog.Error("could not connect to NATS servers", "servers", w.NATSServers, "error", err)
+			return
+		}
+		w.SetNATSConnectionHandlers(nc)
+		w.natsConnection.Store(nc)
+	}
+
+	// while reconnecting the client keeps the subscriptions, they're checked once connected
+	if !nc.IsConnected() {
+		return
+	}
+
+	// the elections campaign with the current connection once it's established
+	w.StartLeaderElections()
+
+	if w.queueSubscribe == nil || w.SubscriptionsComplete() {
+		return
+	}
+
+	if missing := w.MissingSubscriptions(); len(missing) > 0 {
+		slog.Warn("some subscriptions are missing, subscribing again", "subjects", missing)
+	}
+
+	if err := w.queueSubscribe(); err != nil {
+		slog.Error("could not subscribe to NATS subjects, will retry", "error", err, "retry_in", NATSSupervisionInterval)
+	}
+}
+
+func (w *Worker) SetNATSConnectionHandlers(nc *natsio.Conn) {
+	nc.SetDisconnectErrHandler(func(nc *natsio.Conn, err error) {
+		slog.Warn("disconnected from NATS server, will attempt reconnect", "error", err)
+	})
+
+	nc.SetReconnectHandler(func(nc *natsio.Conn) {
+		w.Metrics.NATSReconnects.Inc()
+		slog.Info("reconnected to NATS server", "server", nc.ConnectedUrlRedacted())
+		go w.SuperviseNATSConnection()
+	})
+
+	nc.SetErrorHandler(func(nc *natsio.Conn, sub *natsio.Subscription, err error) {
+		if errors.Is(err, natsio.ErrSlowConsumer) && sub != nil {
+			w.Metrics.SlowConsumers.WithLabelValues(sub.Subject).Inc()
+			dropped, _ := sub.Dropped()
+			slog.Warn("slow consumer, the pending limit has been exceeded and messages have been dropped", "subject", sub.Subject, "dropped", dropped)
+			return
+		}
+		slog.Error("NATS asynchronous error", "error", err)
+	})
+
+	nc.SetClosedHandler(func(nc *natsio.Conn) {
+		if w.Stopping.Load() {
+			slog.Info("NATS connection has been closed")
+			return
+		}
+		slog.Error("NATS connection has been closed, connecting again", "error", nc.LastError())
+		go w.SuperviseNATSConnection()
+	})
+}
+
+// NATSConnection returns the current connection with NATS, the supervision job replaces
+// it once it has been closed so it's read every time instead of being kept
+func (w *Worker) NATSConnection() *natsio.Conn {
+	return w.natsConnection.Load()
+}
+
+// NATSState returns the state of the connection with NATS
+func (w *Worker) NATSState() string {
+	nc := w.NATSConnection()
+	if nc == nil {
+		return "disconnected"
+	}
+
+	switch nc.Status() {
+	case natsio.CONNECTED:
+		return "connected"
+	case natsio.RECONNECTING:
+		return "reconnecting"
+	case natsio.CONNECTING:
+		return "connecting"
+	case natsio.DRAINING_SUBS, natsio.DRAINING_PUBS:
+		return "draining"
+	case natsio.CLOSED:
+		return "closed"
+	default:
+		return "disconnected"
+	}
+}
+
+// IsNATSReady reports if the worker is connected to NATS and all its subscriptions are live
+func (w *Worker) IsNATSReady() bool {
+	return w.NATSState() == "connected" && w.SubscriptionsComplete()
+}
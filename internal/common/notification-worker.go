@@ -1,7 +1,7 @@
 package common
 
 import (
-	"log"
+	"log/slog"
 
 	"github.com/open-uem/ent"
 )
@@ -10,43 +10,28 @@ func (w *Worker) SubscribeToNotificationWorkerQueues() error {
 	var err error
 
 	// read SMTP settings from database
-	w.Settings, err = w.Model.GetSMTPSettings()
-	if err != nil {
-		if ent.IsNotFound(err) {
-			log.Println("[INFO]: no SMTP settings found")
-		} else {
-			log.Printf("[ERROR]: could not get settings from DB, reason: %v", err)
-			return err
+	if w.Settings == nil {
+		w.Settings, err = w.Model().GetSMTPSettings(w.Context)
+		if err != nil {
+			if ent.IsNotFound(err) {
+				slog.Info("no SMTP settings found")
+			} else {
+				slog.Error("could not get settings from DB", "error", err)
+				return err
+			}
 		}
 	}
 
-	_, err = w.NATSConnection.Subscribe("notification.reload_settings", w.ReloadSettingsHandler)
-	if err != nil {
-		log.Printf("[ERROR]: could not subscribe to notification.reload_settings, reason: %v", err)
-		return err
-	}
-	log.Println("[INFO]: subscribed to queue notification.reload_setting")
-
-	_, err = w.NATSConnection.QueueSubscribe("notification.confirm_email", "openuem-notification", w.SendConfirmEmailHandler)
-	if err != nil {
-		log.Printf("[ERROR]: could not subscribe to notification.confirm_email, reason: %v", err)
-		return err
-	}
-	log.Println("[INFO]: subscribed to queue notification.confirm_email")
-
-	_, err = w.NATSConnection.QueueSubscribe("notification.send_certificate", "openuem-notification", w.SendUserCertificateHandler)
-	if err != nil {
-		log.Printf("[ERROR]: could not subscribe to notification.send_certificate, reason: %v", err)
-		return err
-	}
-	log.Println("[INFO]: subscribed to queue notification.send_certificate")
+	return w.SubscribeTo(w.notificationWorkerSubscriptions())
+}
 
-	_, err = w.NATSConnection.QueueSubscribe("ping.notificationworker", "openuem-notification", w.PingHandler)
-	if err != nil {
-		log.Printf("[ERROR]: could not subscribe to ping.notificationworker, reason: %v", err)
-		return err
+// notificationWorkerSubscriptions returns the subscriptions of the notification worker
+func (w *Worker) notificationWorkerSubscriptions() []Subscription {
+	return []Subscription{
+		{Subject: "notification.reload_settings", Handler: w.ReloadSettingsHandler, Serial: true},
+		{Subject: "notification.confirm_email", Queue: "openuem-notification", Handler: w.SendConfirmEmailHandler, NoReplay: true},
+		{Subject: "notification.send_certificate", Queue: "openuem-notification", Handler: w.SendUserCertificateHandler, NoReplay: true},
+		{Subject: "ping.notificationworker", Queue: "openuem-notification", Handler: w.PingHandler, SkipDBCheck: true},
+		{Subject: StatusSubject, Handler: w.PingHandler, SkipDBCheck: true},
 	}
-	log.Printf("[INFO]: subscribed to queue ping.notificationworker")
-
-	return nil
 }
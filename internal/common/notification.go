@@ -2,7 +2,7 @@ package common
 
 import (
 	"encoding/json"
-	"log"
+	"errors"
 	"time"
 
 	"github.com/nats-io/nats.go"
@@ -12,90 +12,121 @@ import (
 )
 
 func (w *Worker) SendConfirmEmailHandler(msg *nats.Msg) {
+	logger := messageLogger(msg)
+	ctx, cancel := w.MessageContext(msg)
+	defer cancel()
+
 	notification := openuem_nats.Notification{}
 
 	if w.Settings == nil {
-		log.Println("[ERROR]: no SMTP settings found, retry in 5 minutes")
+		logger.Error("no SMTP settings found, retry in 5 minutes")
+		w.FailMessage(msg, errors.New("no SMTP settings found"))
 		msg.NakWithDelay(5 * time.Minute)
 		return
 	}
 
 	err := json.Unmarshal(msg.Data, &notification)
 	if err != nil {
-		log.Printf("[ERROR]: could not unmarshal notification request, reason: %v", err.Error())
-		msg.NakWithDelay(5 * time.Minute)
+		logger.Error("could not unmarshal notification request", "error", err)
+		w.FailMessage(msg, Permanent(err))
 		return
 	}
 
 	mailMessage, err := notifications.PrepareMessage(&notification, w.Settings)
 	if err != nil {
-		log.Printf("[ERROR]: could not prepare notification message, reason: %v", err.Error())
-		msg.NakWithDelay(5 * time.Minute)
+		logger.Error("could not prepare notification message", "error", err)
+		w.FailMessage(msg, Permanent(err))
 		return
 	}
 
-	client, err := notifications.PrepareSMTPClient(w.Settings, w.EncryptionMasterKey)
+	settings := w.liveSettings()
+	client, err := notifications.PrepareSMTPClient(w.Settings, settings.Keyring.Decrypt, settings.SMTPPassword)
 	if err != nil {
-		log.Printf("[ERROR]: could not prepare SMTP client, reason: %v", err.Error())
+		logger.Error("could not prepare SMTP client", "error", err)
+		w.FailMessage(msg, err)
 		msg.NakWithDelay(5 * time.Minute)
 		return
 	}
-	if err := client.DialAndSend(mailMessage); err != nil {
-		log.Printf("[ERROR]: could not connect and send message, reason: %v", err.Error())
-		msg.NakWithDelay(5 * time.Minute)
+	if err := client.DialAndSendWithContext(ctx, mailMessage); err != nil {
+		logger.Error("could not connect and send message", "error", err)
+		w.Metrics.EmailsFailed.Inc()
+		w.FailMessage(msg, err)
+		// rejected emails have been dead-lettered, they won't be accepted if they're sent again
+		if !IsPermanent(err) {
+			msg.NakWithDelay(5 * time.Minute)
+		}
 		return
 	}
+	w.Metrics.EmailsSent.Inc()
 }
 
 func (w *Worker) SendUserCertificateHandler(msg *nats.Msg) {
+	logger := messageLogger(msg)
+	ctx, cancel := w.MessageContext(msg)
+	defer cancel()
+
 	notification := openuem_nats.Notification{}
 
 	if w.Settings == nil {
-		log.Println("[ERROR]: no SMTP settings found, retry in 5 minutes")
+		logger.Error("no SMTP settings found, retry in 5 minutes")
+		w.FailMessage(msg, errors.New("no SMTP settings found"))
 		msg.NakWithDelay(5 * time.Minute)
 		return
 	}
 
 	if err := json.Unmarshal(msg.Data, &notification); err != nil {
-		log.Printf("[ERROR]: could not unmarshal notification request, reason: %v", err.Error())
-		msg.NakWithDelay(5 * time.Minute)
+		logger.Error("could not unmarshal notification request", "error", err)
+		w.FailMessage(msg, Permanent(err))
 		return
 	}
 
 	mailMessage, err := notifications.PrepareMessage(&notification, w.Settings)
 	if err != nil {
-		log.Printf("[ERROR]: could not prepare notification message, reason: %v", err.Error())
-		msg.NakWithDelay(5 * time.Minute)
+		logger.Error("could not prepare notification message", "error", err)
+		w.FailMessage(msg, Permanent(err))
 		return
 	}
 
-	client, err := notifications.PrepareSMTPClient(w.Settings, w.EncryptionMasterKey)
+	settings := w.liveSettings()
+	client, err := notifications.PrepareSMTPClient(w.Settings, settings.Keyring.Decrypt, settings.SMTPPassword)
 	if err != nil {
-		log.Printf("[ERROR]: could not prepare SMTP client, reason: %v", err.Error())
+		logger.Error("could not prepare SMTP client", "error", err)
+		w.FailMessage(msg, err)
 		msg.NakWithDelay(5 * time.Minute)
 		return
 	}
 
-	err = client.DialAndSend(mailMessage)
+	err = client.DialAndSendWithContext(ctx, mailMessage)
 	if err != nil {
-		log.Printf("[ERROR]: could not connect and send message, reason: %v", err.Error())
-		msg.NakWithDelay(5 * time.Minute)
+		logger.Error("could not connect and send message", "error", err)
+		w.Metrics.EmailsFailed.Inc()
+		w.FailMessage(msg, err)
+		// rejected emails have been dead-lettered, they won't be accepted if they're sent again
+		if !IsPermanent(err) {
+			msg.NakWithDelay(5 * time.Minute)
+		}
 		return
 	}
+	w.Metrics.EmailsSent.Inc()
 }
 
 func (w *Worker) ReloadSettingsHandler(msg *nats.Msg) {
-	var err error
-	// read again SMTP settings from database
-	w.Settings, err = w.Model.GetSMTPSettings()
-	if err != nil {
-		if ent.IsNotFound(err) {
-			log.Println("[INFO]: no SMTP settings found")
-		} else {
-			log.Printf("[ERROR]: could not get settings from DB, reason: %v", err)
-			return
-		}
+	logger := messageLogger(msg)
+	ctx, cancel := w.MessageContext(msg)
+	defer cancel()
+
+	// read again SMTP settings from database, the current ones are kept if they can't be read
+	settings, err := w.Model().GetSMTPSettings(ctx)
+	switch {
+	case err == nil:
+	case ent.IsNotFound(err):
+		logger.Info("no SMTP settings found")
+	default:
+		w.Metrics.DBError("GetSMTPSettings")
+		logger.Error("could not get settings from DB", "error", err)
+		return
 	}
 
-	log.Println("[INFO]: SMTP settings have been reloaded")
+	w.Settings = settings
+	logger.Info("SMTP settings have been reloaded")
 }
@@ -10,7 +10,6 @@ import (
 	"github.com/open-uem/ent"
 	smtpsettings "github.com/open-uem/ent/settings"
 	"github.com/open-uem/nats"
-	"github.com/open-uem/utils"
 	"github.com/wneessen/go-mail"
 )
 
@@ -64,34 +63,31 @@ func PrepareMessage(notification *nats.Notification, settings *ent.Settings) (*m
 	return m, nil
 }
 
-func PrepareSMTPClient(settings *ent.Settings, encryptionMasterKey string) (*mail.Client, error) {
+func PrepareSMTPClient(settings *ent.Settings, decrypt func(string) (string, error), smtpPassword string) (*mail.Client, error) {
 	var err error
 	var c *mail.Client
 
 	smtpServer := strings.TrimSpace(settings.SMTPServer)
 
-	if settings.SMTPAuth == "NOAUTH" || (settings.SMTPUser == "" && settings.SMTPPassword == "") {
+	// the password set with a secret provider overrides the one stored in the database
+	password := settings.SMTPPassword
+	if smtpPassword != "" {
+		password = smtpPassword
+	}
+
+	if settings.SMTPAuth == "NOAUTH" || (settings.SMTPUser == "" && password == "") {
 		c, err = mail.NewClient(smtpServer, mail.WithPort(settings.SMTPPort))
 	} else {
-		// if smtp password is not empty check if we have the key to decrypt it
-		if settings.SMTPPassword != "" {
-			if encryptionMasterKey != "" {
-				isSMTPPasswordEncrypted, err := utils.IsSensitiveFieldEncrypted(settings.SMTPPassword, encryptionMasterKey)
-				if err != nil {
-					return nil, err
-				}
-
-				if isSMTPPasswordEncrypted {
-					settings.SMTPPassword, err = utils.DecryptSensitiveField(settings.SMTPPassword, encryptionMasterKey)
-					if err != nil {
-						return nil, err
-					}
-				}
+		// the password stored in the database may be encrypted with the encryption master key
+		if smtpPassword == "" && password != "" {
+			password, err = decrypt(password)
+			if err != nil {
+				return nil, err
 			}
 		}
 
 		c, err = mail.NewClient(smtpServer, mail.WithPort(settings.SMTPPort), mail.WithSMTPAuth(mail.SMTPAuthType(settings.SMTPAuth)),
-			mail.WithUsername(settings.SMTPUser), mail.WithPassword(settings.SMTPPassword))
+			mail.WithUsername(settings.SMTPUser), mail.WithPassword(password))
 	}
 
 	if err != nil {
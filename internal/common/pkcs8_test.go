@@ -0,0 +1,108 @@
+package common
+
+import (
+	"encoding/asn1"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// the keys in testdata have been generated with openssl from ca-key.pem, the passphrase is openuem:
+//
+//	openssl pkcs8 -topk8 -v2 aes-128-cbc -v2prf hmacWithSHA1 -in ca-key.pem -out ca-key-aes128-sha1.pem
+//	openssl pkcs8 -topk8 -v2 aes-256-cbc -v2prf hmacWithSHA256 -in ca-key.pem -out ca-key-aes256-sha256.pem
+//	openssl rsa -aes256 -traditional -in ca-key.pem -out ca-key-legacy.pem
+const testKeyPassphrase = "openuem"
+
+func TestReadPrivateKey(t *testing.T) {
+	want, err := readPrivateKey(filepath.Join("testdata", "ca-key.pem"), "")
+	if err != nil {
+		t.Fatalf("could not read the unencrypted key: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		path       string
+		passphrase string
+		wantErr    string
+	}{
+		{name: "AES-128-CBC with HMAC-SHA1", path: "testdata/ca-key-aes128-sha1.pem", passphrase: testKeyPassphrase},
+		{name: "AES-256-CBC with HMAC-SHA256", path: "testdata/ca-key-aes256-sha256.pem", passphrase: testKeyPassphrase},
+		{name: "wrong passphrase", path: "testdata/ca-key-aes256-sha256.pem", passphrase: "wrong", wantErr: "could not decrypt the private key"},
+		{name: "wrong passphrase with HMAC-SHA1", path: "testdata/ca-key-aes128-sha1.pem", passphrase: "wrong", wantErr: "could not decrypt the private key"},
+		{name: "no passphrase", path: "testdata/ca-key-aes256-sha256.pem", wantErr: "no passphrase has been set"},
+		{name: "legacy PEM encryption", path: "testdata/ca-key-legacy.pem", passphrase: testKeyPassphrase, wantErr: "insecure legacy PEM encryption"},
+		{name: "truncated", path: modifiedKey(t, truncate), passphrase: testKeyPassphrase, wantErr: "could not parse the encrypted private key"},
+		{name: "garbled", path: modifiedKey(t, garble), passphrase: testKeyPassphrase, wantErr: "could not parse the encrypted private key"},
+		{name: "bad padding", path: modifiedKey(t, corruptPadding), passphrase: testKeyPassphrase, wantErr: "the passphrase may be wrong"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readPrivateKey(tt.path, tt.passphrase)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !got.Equal(want) {
+				t.Errorf("the decrypted key is not the original key")
+			}
+		})
+	}
+}
+
+// modifiedKey writes the AES-256 key with its DER modified by fn to a temporary file
+func modifiedKey(t *testing.T, fn func(t *testing.T, der []byte) []byte) string {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join("testdata", "ca-key-aes256-sha256.pem"))
+	if err != nil {
+		t.Fatalf("could not read the key: %v", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		t.Fatalf("the key is not in PEM format")
+	}
+	block.Bytes = fn(t, block.Bytes)
+
+	path := filepath.Join(t.TempDir(), "ca-key.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatalf("could not write the key: %v", err)
+	}
+	return path
+}
+
+func truncate(_ *testing.T, der []byte) []byte {
+	return der[:len(der)/2]
+}
+
+func garble(_ *testing.T, der []byte) []byte {
+	garbled := make([]byte, len(der))
+	for i, b := range der {
+		garbled[i] = b ^ 0xa5
+	}
+	return garbled
+}
+
+// corruptPadding flips a bit of the next to last ciphertext block, CBC flips the same bit
+// of the padding once it's decrypted
+func corruptPadding(t *testing.T, der []byte) []byte {
+	info := encryptedPrivateKeyInfo{}
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		t.Fatalf("could not parse the key: %v", err)
+	}
+	info.EncryptedData[len(info.EncryptedData)-17] ^= 0x20
+
+	corrupted, err := asn1.Marshal(info)
+	if err != nil {
+		t.Fatalf("could not marshal the key: %v", err)
+	}
+	return corrupted
+}
@@ -0,0 +1,111 @@
+package common
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+)
+
+// DefaultHandlerConcurrency contains the number of messages of a subject processed at the same time,
+// "*" applies to the subjects not listed. Reports are slow so several are processed concurrently
+var DefaultHandlerConcurrency = map[string]int{
+	"*":                1,
+	"report":           8,
+	"deployresult":     4,
+	"agentconfig":      4,
+	"wingetcfg.report": 4,
+}
+
+// DefaultHandlerMaxPending contains the number of messages that can wait for a free handler,
+// once exceeded NATS drops the messages and reports the subscription as a slow consumer
+var DefaultHandlerMaxPending = map[string]int{
+	"*": 65536,
+}
+
+// subjectLimit returns the limit configured for the subject, the "*" entry or the default
+func subjectLimit(limits, defaults map[string]int, subject string) int {
+	for _, l := range []map[string]int{limits, defaults} {
+		if n, ok := l[subject]; ok && n > 0 {
+			return n
+		}
+	}
+	for _, l := range []map[string]int{limits, defaults} {
+		if n, ok := l["*"]; ok && n > 0 {
+			return n
+		}
+	}
+	return 1
+}
+
+// Concurrent wraps a NATS handler so up to concurrency messages are processed at the same time,
+// the subscription's goroutine waits for a free handler so NATS keeps the rest as pending messages
+func (w *Worker) Concurrent(subject string, concurrency int, handler nats.MsgHandler) nats.MsgHandler {
+	pool := w.handlerPool(subject, concurrency)
+	return func(msg *nats.Msg) {
+		pool(func() { handler(msg) })
+	}
+}
+
+// handlerPool returns a function that runs the task when one of the subject's handlers is free
+func (w *Worker) handlerPool(subject string, concurrency int) func(task func()) {
+	sem := make(chan struct{}, concurrency)
+	w.Metrics.HandlerConcurrency.WithLabelValues(subject).Set(float64(concurrency))
+	busy := w.Metrics.HandlersBusy.WithLabelValues(subject)
+	saturated := w.Metrics.HandlersSaturated.WithLabelValues(subject)
+
+	return func(task func()) {
+		select {
+		case sem <- struct{}{}:
+		default:
+			saturated.Inc()
+			sem <- struct{}{}
+		}
+
+		// counted before the goroutine starts so shutdown doesn't miss it
+		w.InFlight.Add(1)
+		busy.Inc()
+
+		run := func() {
+			defer func() {
+				busy.Dec()
+				w.InFlight.Add(-1)
+				<-sem
+			}()
+			task()
+		}
+
+		if concurrency == 1 {
+			run()
+			return
+		}
+		go run()
+	}
+}
+
+// ParseSubjectLimits parses a comma-separated list of subject=number pairs,
+// "*" sets the limit for the subjects not listed e.g (*=2,report=16)
+func ParseSubjectLimits(s string) (map[string]int, error) {
+	limits := map[string]int{}
+
+	for item := range strings.SplitSeq(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		subject, value, found := strings.Cut(item, "=")
+		if !found {
+			return nil, fmt.Errorf("limit %q must have the format subject=number", item)
+		}
+
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("limit for subject %s must be a positive number", subject)
+		}
+		limits[strings.TrimSpace(subject)] = n
+	}
+
+	return limits, nil
+}
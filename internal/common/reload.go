@@ -0,0 +1,255 @@
+package common
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"reflect"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-co-op/gocron/v2"
+)
+
+const ConfigWatchInterval = 10 * time.Second
+
+// secretSettings are compared as usual but their values are never logged
+var secretSettings = []string{"DBUrl", "DBPassword", "CAKeyPassphrase", "EncryptionMasterKey", "EncryptionRetiredKeys", "SMTPPassword", "VaultToken"}
+
+type configChange struct {
+	Key string
+	Old string
+	New string
+}
+
+// SetConfigSource sets the function used to read the settings again and the files
+// that are watched for changes, the files are optional
+func (w *Worker) SetConfigSource(loader func() (*Config, error), configFiles ...string) {
+	w.configLoader = loader
+	w.configFiles = configFiles
+}
+
+// StartConfigReload reloads the settings when the worker receives a SIGHUP
+// and starts a job that checks if the config file has changed
+func (w *Worker) StartConfigReload() {
+	if w.configLoader == nil {
+		return
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-hup:
+				w.ReloadConfig("SIGHUP received")
+			case <-w.Context.Done():
+				return
+			}
+		}
+	}()
+
+	if len(w.configFiles) == 0 || w.TaskScheduler == nil {
+		return
+	}
+
+	w.configFileState = filesState(w.configFiles)
+
+	var err error
+	w.ConfigWatchJob, err = w.TaskScheduler.NewJob(
+		gocron.DurationJob(ConfigWatchInterval),
+		gocron.NewTask(func() {
+			state := filesState(w.configFiles)
+			if state == w.configFileState {
+				return
+			}
+			w.configFileState = state
+			w.ReloadConfig("config file has changed")
+		}),
+		gocron.WithSingletonMode(gocron.LimitModeReschedule),
+	)
+	if err != nil {
+		slog.Error("could not start the config watch job", "error", err)
+		return
+	}
+	slog.Info("new config watch job has been scheduled", "files", w.configFiles, "every", ConfigWatchInterval)
+}
+
+// ReloadConfig reads the settings again and applies the ones that have changed,
+// NATS and the database are only reconnected if their settings have changed
+func (w *Worker) ReloadConfig(reason string) {
+	w.reloadMu.Lock()
+	defer w.reloadMu.Unlock()
+
+	if w.Stopping.Load() || w.configLoader == nil {
+		return
+	}
+
+	slog.Info("reloading configuration", "reason", reason)
+
+	config, err := w.configLoader()
+	if err != nil {
+		slog.Error("could not reload configuration, the current settings are kept", "error", err)
+		return
+	}
+
+	old := w.config
+	if old == nil {
+		old = &Config{}
+	}
+
+	changes := diffConfig(old, config)
+	if len(changes) == 0 {
+		slog.Info("configuration has been reloaded, no setting has changed")
+		return
+	}
+
+	keys := []string{}
+	for _, c := range changes {
+		slog.Info("setting has changed", "key", c.Key, "old", c.Old, "new", c.New)
+		keys = append(keys, c.Key)
+	}
+	changed := func(settings ...string) bool {
+		return slices.ContainsFunc(settings, func(s string) bool { return slices.Contains(keys, s) })
+	}
+
+	caCert, caPrivateKey, err := readCAFiles(config)
+	if err != nil {
+		slog.Error("could not reload configuration, the current settings are kept", "error", err)
+		return
+	}
+
+	// the database url is applied once the worker has connected with the new database
+	applied := *config
+	applied.DBUrl = old.DBUrl
+
+	// the NATS supervision job reads the connection settings with this lock held
+	w.natsMu.Lock()
+	w.setConfig(&applied, caCert, caPrivateKey)
+	w.natsMu.Unlock()
+
+	if changed("LogFormat", "LogLevel") {
+		if err := w.SetLogger(); err != nil {
+			slog.Error("could not set the logger", "error", err)
+		}
+	}
+
+	if changed("MetricsAddress", "HealthAddress") {
+		w.StopHTTPServers()
+		w.StartHTTPServers()
+	}
+
+	if changed("SecretsRefreshInterval") {
+		w.StartSecretsRefreshJob()
+	}
+
+	if changed("CaptureFile", "CaptureMaxSize", "CaptureMaxFiles", "CaptureAgents", "CaptureSubjects") {
+		if err := w.StartCapture(); err != nil {
+			slog.Error("could not start capturing messages", "error", err)
+		}
+	}
+
+	if changed("TracingExporter", "TracingEndpoint", "TracingProtocol", "TracingInsecure", "TracingSampleRatio") {
+		if err := w.StartTracing(); err != nil {
+			slog.Error("could not start tracing", "error", err)
+		}
+	}
+
+	if w.Model() != nil {
+		switch {
+		case changed("DBUrl"):
+			w.reconnectDB(config.DBUrl)
+		case changed("DBPool"):
+			w.Model().SetPool(config.DBPool)
+			slog.Info("database pool settings have been applied")
+		}
+	}
+
+	if nc := w.NATSConnection(); changed("NATSServers", "CACertPath", "ClientCertPath", "ClientKeyPath") && nc != nil && !nc.IsClosed() {
+		// once drained, the closed handler connects again with the new settings and subscribes
+		slog.Info("reconnecting to NATS with the new settings")
+		if err := nc.Drain(); err != nil {
+			slog.Error("could not drain NATS connection", "error", err)
+		}
+	}
+
+	slog.Info("configuration has been reloaded", "changed", keys)
+}
+
+// reconnectDB connects with the new database and closes the previous connection
+// once the handlers that may be using it have finished. The url is only kept if
+// the connection succeeds so the next reload tries again
+func (w *Worker) reconnectDB(url string) {
+	model, err := w.connectDB(url)
+	if err != nil {
+		slog.Error("could not connect with the new database, the current connection is kept", "error", err)
+		w.Model().SetPool(w.DBPool)
+		return
+	}
+
+	w.settingsMu.Lock()
+	w.DBUrl = url
+	w.config.DBUrl = url
+	w.settingsMu.Unlock()
+
+	previous := w.setModel(model)
+	w.DBReady.Store(true)
+	slog.Info("connection established with the new database")
+
+	if previous != nil {
+		previous.close()
+	}
+}
+
+func diffConfig(old, new *Config) []configChange {
+	changes := []configChange{}
+
+	o := reflect.ValueOf(*old)
+	n := reflect.ValueOf(*new)
+	for i := range o.NumField() {
+		key := o.Type().Field(i).Name
+		oldValue, newValue := o.Field(i).Interface(), n.Field(i).Interface()
+		if reflect.DeepEqual(oldValue, newValue) {
+			continue
+		}
+
+		changes = append(changes, configChange{
+			Key: key,
+			Old: displayValue(key, oldValue),
+			New: displayValue(key, newValue),
+		})
+	}
+
+	return changes
+}
+
+func displayValue(key string, value any) string {
+	s := fmt.Sprint(value)
+	if !slices.Contains(secretSettings, key) || s == "" {
+		return s
+	}
+
+	return redact(s)
+}
+
+// fileState returns a string that changes when the file is modified
+func fileState(path string) string {
+	info, err := os.Stat(path)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%d-%d", info.ModTime().UnixNano(), info.Size())
+}
+
+// filesState returns a string that changes when any of the files is modified
+func filesState(paths []string) string {
+	states := []string{}
+	for _, path := range paths {
+		states = append(states, fileState(path))
+	}
+	return strings.Join(states, ",")
+}
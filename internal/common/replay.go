@@ -0,0 +1,98 @@
+package common
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+
+	"github.com/nats-io/nats.go"
+)
+
+// StartReplay connects with the database the captured messages are replayed against,
+// the worker doesn't connect with NATS so the replies and published messages aren't sent
+func (w *Worker) StartReplay() error {
+	var err error
+
+	if w.DBUrl == "" {
+		return fmt.Errorf("the database url of the test database is required to replay messages")
+	}
+
+	model, err := w.connectDB(w.DBUrl)
+	if err != nil {
+		return fmt.Errorf("could not connect with database, reason: %v", err)
+	}
+	w.setModel(model)
+	w.DBReady.Store(true)
+	slog.Info("connection established with database")
+
+	if w.HasRole(NotificationWorkerRole) {
+		if w.Settings, err = w.Model().GetSMTPSettings(w.Context); err != nil {
+			slog.Warn("could not get SMTP settings from DB", "error", err)
+		}
+	}
+
+	return nil
+}
+
+// StopReplay closes the database connection
+func (w *Worker) StopReplay() {
+	if w.ContextCancel != nil {
+		w.ContextCancel()
+	}
+	if w.Model() != nil {
+		w.Model().Close()
+	}
+}
+
+// Replay runs the captured message through the handler of its subject and returns the
+// replies the handler would have sent, the message goes through the same checks it went
+// through when it was received except the rate limits
+func (w *Worker) Replay(record CaptureRecord) ([]CapturedReply, error) {
+	s, ok := w.replaySubscription(record.Subject)
+	if !ok {
+		return nil, fmt.Errorf("the worker's roles have no handler for the subject %s", record.Subject)
+	}
+	if s.NoReplay {
+		return nil, fmt.Errorf("the handler of the subject %s can't be replayed, it has effects outside the database", record.Subject)
+	}
+
+	msg := &nats.Msg{
+		Subject: record.Subject,
+		Reply:   record.ReplyTo,
+		Header:  nats.Header{},
+		Data:    slices.Clone(record.Data),
+	}
+	for k, v := range record.Header {
+		msg.Header[k] = slices.Clone(v)
+	}
+
+	entry := newCaptureEntry(msg, record.AgentID, true)
+	w.captures.Store(msg, entry)
+	defer w.captures.Delete(msg)
+
+	w.wrapHandler(s)(msg)
+
+	return entry.replies(), nil
+}
+
+// replaySubscription returns the subscription of the worker's roles that receives the subject,
+// the messages consumed from JetStream have been captured with their core NATS subject
+func (w *Worker) replaySubscription(subject string) (Subscription, bool) {
+	subscriptions := []Subscription{}
+	if w.HasRole(AgentWorkerRole) {
+		subscriptions = append(subscriptions, w.agentWorkerSubscriptions()...)
+	}
+	if w.HasRole(CertManagerWorkerRole) {
+		subscriptions = append(subscriptions, w.certManagerWorkerSubscriptions()...)
+	}
+	if w.HasRole(NotificationWorkerRole) {
+		subscriptions = append(subscriptions, w.notificationWorkerSubscriptions()...)
+	}
+
+	for _, s := range subscriptions {
+		if SubjectMatches(s.Subject, subject) {
+			return s, true
+		}
+	}
+	return Subscription{}, false
+}
@@ -0,0 +1,82 @@
+package common
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+const (
+	AgentWorkerRole        = "agent-worker"
+	CertManagerWorkerRole  = "cert-manager-worker"
+	NotificationWorkerRole = "notification-worker"
+)
+
+// RoleNames maps the names of the CLI commands to the worker roles
+var RoleNames = map[string]string{
+	"agents":        AgentWorkerRole,
+	"cert-manager":  CertManagerWorkerRole,
+	"notifications": NotificationWorkerRole,
+}
+
+// ParseRoles accepts command names (agents, cert-manager, notifications) or roles (agent-worker...)
+// and returns the roles without duplicates in a stable order
+func ParseRoles(names []string) ([]string, error) {
+	roles := []string{}
+	for _, name := range names {
+		for n := range strings.SplitSeq(name, ",") {
+			n = strings.ToLower(strings.TrimSpace(n))
+			if n == "" {
+				continue
+			}
+
+			role, ok := RoleNames[n]
+			if !ok {
+				if _, valid := PingSubjects[n]; !valid {
+					return nil, fmt.Errorf("unknown worker role %q, valid roles are agents, cert-manager and notifications", n)
+				}
+				role = n
+			}
+
+			if !slices.Contains(roles, role) {
+				roles = append(roles, role)
+			}
+		}
+	}
+
+	if len(roles) == 0 {
+		return nil, fmt.Errorf("at least one worker role must be selected")
+	}
+	slices.Sort(roles)
+
+	return roles, nil
+}
+
+// HasRole reports if the worker runs the role, a worker may run several roles in one process
+func (w *Worker) HasRole(role string) bool {
+	return slices.Contains(strings.Split(w.Role, ","), role)
+}
+
+// SubscribeToRolesQueues subscribes to the queues of all the roles run by the worker
+// so they share the same NATS connection
+func (w *Worker) SubscribeToRolesQueues() error {
+	if w.HasRole(AgentWorkerRole) {
+		if err := w.SubscribeToAgentWorkerQueues(); err != nil {
+			return err
+		}
+	}
+
+	if w.HasRole(CertManagerWorkerRole) {
+		if err := w.SubscribeToCertManagerWorkerQueues(); err != nil {
+			return err
+		}
+	}
+
+	if w.HasRole(NotificationWorkerRole) {
+		if err := w.SubscribeToNotificationWorkerQueues(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,283 @@
+package common
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-co-op/gocron/v2"
+)
+
+const (
+	// secretTimeout is the maximum time a provider can take to return a secret
+	secretTimeout = 10 * time.Second
+	// vaultMaxResponseSize protects the worker from a misbehaving secrets server
+	vaultMaxResponseSize = 1 << 20
+)
+
+// SecretProvider returns the secret a reference points to, references have the
+// form scheme://path e.g (env://DB_PASSWORD or vault://secret/data/openuem#db_password)
+type SecretProvider interface {
+	Secret(ctx context.Context, path string) (string, error)
+}
+
+// SecretResolver resolves the secret references with the provider of their scheme,
+// values that aren't references are secrets themselves
+type SecretResolver struct {
+	providers map[string]SecretProvider
+}
+
+// NewSecretResolver returns a resolver with the env, file and systemd-creds providers and,
+// if its address has been set, the Vault provider
+func NewSecretResolver(vaultAddress, vaultToken string) *SecretResolver {
+	r := &SecretResolver{
+		providers: map[string]SecretProvider{
+			"env":           envSecrets{},
+			"file":          fileSecrets{},
+			"systemd-creds": systemdCredentials{},
+		},
+	}
+	if vaultAddress != "" {
+		r.providers["vault"] = &vaultSecrets{
+			address: strings.TrimSuffix(vaultAddress, "/"),
+			token:   vaultToken,
+			client:  &http.Client{Timeout: secretTimeout},
+		}
+	}
+	return r
+}
+
+// IsSecretReference reports if the value points to a secret kept by a provider
+func IsSecretReference(v string) bool {
+	scheme, _, found := strings.Cut(v, "://")
+	if !found {
+		return false
+	}
+	switch scheme {
+	case "env", "file", "systemd-creds", "vault":
+		return true
+	}
+	return false
+}
+
+// Resolve returns the secret the value points to or the value itself if it's not a reference
+func (r *SecretResolver) Resolve(ctx context.Context, v string) (string, error) {
+	if !IsSecretReference(v) {
+		return v, nil
+	}
+
+	scheme, path, _ := strings.Cut(v, "://")
+	provider, ok := r.providers[scheme]
+	if !ok {
+		return "", fmt.Errorf("the %s secret provider has not been configured", scheme)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, secretTimeout)
+	defer cancel()
+
+	secret, err := provider.Secret(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	if secret == "" {
+		return "", fmt.Errorf("the secret %s is empty", v)
+	}
+	return secret, nil
+}
+
+// envSecrets reads the secret from an environment variable
+type envSecrets struct{}
+
+func (envSecrets) Secret(_ context.Context, name string) (string, error) {
+	return os.Getenv(name), nil
+}
+
+// fileSecrets reads the secret from a file e.g (file:///run/secrets/db_password),
+// the trailing new line is removed
+type fileSecrets struct{}
+
+func (fileSecrets) Secret(_ context.Context, path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// systemdCredentials reads the credentials passed by systemd with LoadCredential or
+// LoadCredentialEncrypted e.g (systemd-creds://openuem)
+type systemdCredentials struct{}
+
+func (systemdCredentials) Secret(ctx context.Context, name string) (string, error) {
+	dir := os.Getenv("CREDENTIALS_DIRECTORY")
+	if dir == "" {
+		return "", fmt.Errorf("CREDENTIALS_DIRECTORY is not set, the worker has not been started by systemd with credentials")
+	}
+	if strings.ContainsAny(name, `/\`) {
+		return "", fmt.Errorf("invalid credential name %q", name)
+	}
+	return fileSecrets{}.Secret(ctx, filepath.Join(dir, name))
+}
+
+// vaultSecrets reads the secret from a Vault compatible KV engine, the path is the API
+// path after /v1/ and the field follows # e.g (vault://secret/data/openuem#db_password)
+type vaultSecrets struct {
+	address string
+	token   string
+	client  *http.Client
+}
+
+func (v *vaultSecrets) Secret(ctx context.Context, ref string) (string, error) {
+	path, field, found := strings.Cut(ref, "#")
+	if !found || field == "" {
+		return "", fmt.Errorf("the vault reference %q must have the format vault://path#field", ref)
+	}
+
+	endpoint, err := url.JoinPath(v.address, "v1", path)
+	if err != nil {
+		return "", fmt.Errorf("could not build the vault url, reason: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return "", err
+	}
+	if v.token != "" {
+		req.Header.Set("X-Vault-Token", v.token)
+	}
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("could not request the secret to vault, reason: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, vaultMaxResponseSize))
+	if err != nil {
+		return "", fmt.Errorf("could not read the vault response, reason: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault replied with status %d for %s", resp.StatusCode, path)
+	}
+
+	// KV version 2 nests the secret's fields in data.data, version 1 has them in data
+	secret := struct {
+		Data map[string]any `json:"data"`
+	}{}
+	if err := json.Unmarshal(body, &secret); err != nil {
+		return "", fmt.Errorf("could not parse the vault response, reason: %v", err)
+	}
+	data := secret.Data
+	if nested, ok := data["data"].(map[string]any); ok {
+		data = nested
+	}
+
+	value, ok := data[field]
+	if !ok {
+		return "", fmt.Errorf("the vault secret %s has no field %s", path, field)
+	}
+	return fmt.Sprint(value), nil
+}
+
+// withDBPassword replaces the password of the database url
+func withDBPassword(dbURL, password string) (string, error) {
+	u, err := url.Parse(dbURL)
+	if err != nil {
+		return "", fmt.Errorf("could not parse the database url, reason: %v", err)
+	}
+	if u.User == nil {
+		return "", fmt.Errorf("the database url has no user")
+	}
+	u.User = url.UserPassword(u.User.Username(), password)
+	return u.String(), nil
+}
+
+// readPrivateKey reads an RSA private key in PEM format, encrypted PKCS#8 keys are decrypted with the passphrase
+func readPrivateKey(path, passphrase string) (*rsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("file does not contain a private key")
+	}
+
+	// the legacy PEM encryption of openssl genrsa -aes256 is insecure, the keys must be converted
+	if block.Headers["Proc-Type"] == "4,ENCRYPTED" {
+		return nil, fmt.Errorf("the private key uses the insecure legacy PEM encryption, convert it to encrypted PKCS#8 with: openssl pkcs8 -topk8 -v2 aes-256-cbc -in %s -out <new key file>", path)
+	}
+
+	der := block.Bytes
+	if block.Type == "ENCRYPTED PRIVATE KEY" {
+		if passphrase == "" {
+			return nil, fmt.Errorf("the private key is encrypted and no passphrase has been set")
+		}
+		if der, err = decryptPKCS8(der, passphrase); err != nil {
+			return nil, err
+		}
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(der)
+	case "PRIVATE KEY", "ENCRYPTED PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(der)
+		if err != nil && block.Type == "ENCRYPTED PRIVATE KEY" {
+			// a wrong passphrase may give a valid padding once in a while
+			return nil, fmt.Errorf("could not decrypt the private key, the passphrase may be wrong, reason: %v", err)
+		}
+		if err != nil {
+			return nil, err
+		}
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("the private key is not an RSA key")
+		}
+		return rsaKey, nil
+	}
+	return nil, fmt.Errorf("file does not contain a private key")
+}
+
+// StartSecretsRefreshJob reads the settings again periodically so the secrets that have been
+// rotated in their providers are used, the database is reconnected if its password has changed
+func (w *Worker) StartSecretsRefreshJob() {
+	if w.TaskScheduler == nil {
+		return
+	}
+
+	if w.SecretsRefreshJob != nil {
+		if err := w.TaskScheduler.RemoveJob(w.SecretsRefreshJob.ID()); err != nil {
+			slog.Warn("could not remove the secrets refresh job", "error", err)
+		}
+		w.SecretsRefreshJob = nil
+	}
+
+	if w.SecretsRefreshInterval <= 0 || w.configLoader == nil {
+		return
+	}
+
+	var err error
+	w.SecretsRefreshJob, err = w.TaskScheduler.NewJob(
+		gocron.DurationJob(w.SecretsRefreshInterval),
+		gocron.NewTask(func() { w.ReloadConfig("secrets refresh") }),
+		gocron.WithSingletonMode(gocron.LimitModeReschedule),
+	)
+	if err != nil {
+		slog.Error("could not start the secrets refresh job", "error", err)
+		return
+	}
+	slog.Info("new secrets refresh job has been scheduled", "every", w.SecretsRefreshInterval)
+}
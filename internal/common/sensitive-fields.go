@@ -0,0 +1,59 @@
+package common
+
+import (
+	"fmt"
+
+	"github.com/open-uem/ent"
+)
+
+// sensitiveField points to a field the console may have encrypted with the encryption master key
+type sensitiveField[T any] struct {
+	name  string
+	field func(*T) *string
+}
+
+// taskSensitiveFields are the fields of a task that may contain credentials
+var taskSensitiveFields = []sensitiveField[ent.Task]{
+	{"local user password", func(t *ent.Task) *string { return &t.LocalUserPassword }},
+	{"local user SSH key passphrase", func(t *ent.Task) *string { return &t.LocalUserSSHKeyPassphrase }},
+	{"MSI arguments", func(t *ent.Task) *string { return &t.MsiArguments }},
+	{"script", func(t *ent.Task) *string { return &t.Script }},
+}
+
+var netbirdSensitiveFields = []sensitiveField[ent.NetbirdSettings]{
+	{"NetBird access token", func(ns *ent.NetbirdSettings) *string { return &ns.AccessToken }},
+}
+
+// SensitiveFieldResolver returns a view of the tasks and settings with their sensitive fields
+// decrypted, values that aren't encrypted are kept as they are
+type SensitiveFieldResolver struct {
+	Keyring *Keyring
+}
+
+// SensitiveFields returns the resolver with the worker's current keyring
+func (w *Worker) SensitiveFields() SensitiveFieldResolver {
+	return SensitiveFieldResolver{Keyring: w.liveSettings().Keyring}
+}
+
+// Task returns a copy of the task with its sensitive fields decrypted, the task itself
+// isn't modified as the profiles and their tasks may be used again
+func (r SensitiveFieldResolver) Task(t *ent.Task) (*ent.Task, error) {
+	return resolveSensitiveFields(r.Keyring, t, taskSensitiveFields, fmt.Sprintf("task %d", t.ID))
+}
+
+// NetbirdSettings returns a copy of the settings with the access token decrypted
+func (r SensitiveFieldResolver) NetbirdSettings(ns *ent.NetbirdSettings) (*ent.NetbirdSettings, error) {
+	return resolveSensitiveFields(r.Keyring, ns, netbirdSensitiveFields, "the NetBird settings")
+}
+
+func resolveSensitiveFields[T any](keyring *Keyring, v *T, fields []sensitiveField[T], owner string) (*T, error) {
+	resolved := *v
+	for _, f := range fields {
+		plaintext, err := keyring.Decrypt(*f.field(&resolved))
+		if err != nil {
+			return nil, fmt.Errorf("could not decrypt the %s of %s, reason: %v", f.name, owner, err)
+		}
+		*f.field(&resolved) = plaintext
+	}
+	return &resolved, nil
+}
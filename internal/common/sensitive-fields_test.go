@@ -0,0 +1,106 @@
+package common
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/open-uem/ent"
+	"github.com/open-uem/utils"
+)
+
+const (
+	testActiveKey  = "0123456789abcdef0123456789abcdef"
+	testRetiredKey = "fedcba9876543210fedcba9876543210"
+	testOtherKey   = "abcdefghijklmnopqrstuvwxyz012345"
+)
+
+func TestSensitiveFieldResolverTask(t *testing.T) {
+	keyring, err := NewKeyring("2", testActiveKey, map[string]string{"1": testRetiredKey})
+	if err != nil {
+		t.Fatalf("could not create the keyring: %v", err)
+	}
+
+	keyed, err := keyring.Encrypt("Write-Host secret")
+	if err != nil {
+		t.Fatalf("could not encrypt the script: %v", err)
+	}
+	legacy, err := utils.EncryptSensitiveField("/quiet TOKEN=secret", testRetiredKey)
+	if err != nil {
+		t.Fatalf("could not encrypt the MSI arguments: %v", err)
+	}
+	otherKey, err := utils.EncryptSensitiveField("secret", testOtherKey)
+	if err != nil {
+		t.Fatalf("could not encrypt the password: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		task    ent.Task
+		want    ent.Task
+		wantErr string
+	}{
+		{
+			name: "encrypted",
+			task: ent.Task{ID: 1, Script: keyed, MsiArguments: legacy},
+			want: ent.Task{ID: 1, Script: "Write-Host secret", MsiArguments: "/quiet TOKEN=secret"},
+		},
+		{
+			name: "plain",
+			task: ent.Task{ID: 2, Script: "enc:1:echo hello", MsiArguments: "/quiet", LocalUserPassword: "cafe"},
+			want: ent.Task{ID: 2, Script: "enc:1:echo hello", MsiArguments: "/quiet", LocalUserPassword: "cafe"},
+		},
+		{
+			name:    "wrong key",
+			task:    ent.Task{ID: 3, LocalUserPassword: otherKey},
+			wantErr: "could not decrypt the local user password of task 3",
+		},
+		{
+			name:    "wrong key with key ID",
+			task:    ent.Task{ID: 4, Script: "enc:1:" + otherKey},
+			wantErr: "could not decrypt the script of task 4",
+		},
+		{
+			name:    "unknown key ID",
+			task:    ent.Task{ID: 5, Script: "enc:3:" + otherKey},
+			wantErr: "the key 3 that is not in the keyring",
+		},
+	}
+
+	resolver := SensitiveFieldResolver{Keyring: keyring}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			original := tt.task.Script
+
+			got, err := resolver.Task(&tt.task)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got.Script != tt.want.Script || got.MsiArguments != tt.want.MsiArguments || got.LocalUserPassword != tt.want.LocalUserPassword {
+				t.Errorf("got script %q, MSI arguments %q and password %q, want %q, %q and %q",
+					got.Script, got.MsiArguments, got.LocalUserPassword, tt.want.Script, tt.want.MsiArguments, tt.want.LocalUserPassword)
+			}
+			if tt.task.Script != original {
+				t.Errorf("the task has been modified")
+			}
+		})
+	}
+}
+
+func TestSensitiveFieldResolverWithoutKeyring(t *testing.T) {
+	task := &ent.Task{ID: 1, Script: "echo hello"}
+
+	got, err := SensitiveFieldResolver{}.Task(task)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got.Script != task.Script {
+		t.Errorf("got script %q, want %q", got.Script, task.Script)
+	}
+}
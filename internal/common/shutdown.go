@@ -0,0 +1,62 @@
+package common
+
+import (
+	"log/slog"
+	"time"
+)
+
+const (
+	DefaultShutdownGracePeriod = 30 * time.Second
+	// connectionDrainTimeout is the time the pending replies have to be flushed once the handlers have finished
+	connectionDrainTimeout = 10 * time.Second
+)
+
+// WaitForInFlightHandlers waits until the subscriptions have been drained and no handler is running
+// or the grace period expires, it returns the number of messages that were still being processed
+// or waiting to be delivered to a handler. The handlers of the subjects with concurrency run in
+// their own goroutines so they may still be running once their subscription has been drained
+func (w *Worker) WaitForInFlightHandlers(gracePeriod time.Duration) int64 {
+	if gracePeriod <= 0 {
+		gracePeriod = DefaultShutdownGracePeriod
+	}
+
+	deadline := time.Now().Add(gracePeriod)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		nc := w.NATSConnection()
+		drained := nc == nil || nc.IsClosed() || w.subscriptionsDrained()
+		running := w.InFlight.Load()
+		if drained && running == 0 {
+			return 0
+		}
+
+		if time.Now().After(deadline) {
+			return running + int64(w.PendingMessages())
+		}
+
+		<-ticker.C
+	}
+}
+
+// drainConnection flushes the replies and the messages published by the handlers and closes
+// the NATS connection, it must be called once the handlers have finished
+func (w *Worker) drainConnection(timeout time.Duration) {
+	nc := w.NATSConnection()
+	if nc == nil || nc.IsClosed() {
+		return
+	}
+
+	if err := nc.Drain(); err != nil {
+		slog.Error("could not drain NATS connection", "error", err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for !nc.IsClosed() && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if !nc.IsClosed() {
+		nc.Close()
+	}
+}
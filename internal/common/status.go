@@ -0,0 +1,154 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/open-uem/ent/server"
+)
+
+// StatusSubject is subscribed by every worker instance without a queue group
+// so a single request gets a reply from the whole fleet
+const StatusSubject = "status.workers"
+
+// BuildVersion and BuildChannel are set at build time, e.g
+// go build -ldflags "-X github.com/open-uem/openuem-worker/internal/common.BuildVersion=0.9.0 -X github.com/open-uem/openuem-worker/internal/common.BuildChannel=stable"
+var (
+	BuildVersion = ""
+	BuildChannel = "devel"
+)
+
+type WorkerStatus struct {
+	Role                 string         `json:"role"`
+	InstanceID           string         `json:"instance_id"`
+	Hostname             string         `json:"hostname"`
+	Version              string         `json:"version"`
+	Channel              string         `json:"channel"`
+	StartedAt            time.Time      `json:"started_at"`
+	UptimeSeconds        int64          `json:"uptime_seconds"`
+	Ready                bool           `json:"ready"`
+	DBState              string         `json:"db_state"`
+	NATSState            string         `json:"nats_state"`
+	ActiveSubscriptions  []string       `json:"active_subscriptions"`
+	MissingSubscriptions []string       `json:"missing_subscriptions,omitempty"`
+	InFlight             int64          `json:"in_flight"`
+	MessagesProcessed    uint64         `json:"messages_processed"`
+	MessagesFailed       uint64         `json:"messages_failed"`
+	LastError            *StatusError   `json:"last_error,omitempty"`
+	Leaders              []LeaderStatus `json:"leaders,omitempty"`
+}
+
+type StatusError struct {
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+type lastErrorRecorder struct {
+	mu  sync.Mutex
+	err *StatusError
+}
+
+func (r *lastErrorRecorder) set(message string, t time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.err = &StatusError{Message: message, Time: t}
+}
+
+func (r *lastErrorRecorder) get() *StatusError {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err == nil {
+		return nil
+	}
+	err := *r.err
+	return &err
+}
+
+// setIdentity sets the values that identify this worker instance in ping replies
+func (w *Worker) setIdentity() {
+	w.InstanceID = uuid.NewString()
+	w.StartedAt = time.Now()
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		slog.Warn("could not get the hostname", "error", err)
+	}
+	w.Hostname = hostname
+
+	w.Version = BuildVersion
+	if w.Version == "" {
+		if info, ok := debug.ReadBuildInfo(); ok {
+			w.Version = info.Main.Version
+		}
+	}
+	w.Channel = server.Channel(BuildChannel)
+}
+
+// Status returns the identity and the state of the worker
+func (w *Worker) Status() WorkerStatus {
+	dbState := "down"
+	if w.DBReady.Load() {
+		dbState = "up"
+	}
+
+	return WorkerStatus{
+		Role:                 w.Role,
+		InstanceID:           w.InstanceID,
+		Hostname:             w.Hostname,
+		Version:              w.Version,
+		Channel:              w.Channel.String(),
+		StartedAt:            w.StartedAt,
+		UptimeSeconds:        int64(time.Since(w.StartedAt).Seconds()),
+		Ready:                w.IsReady(),
+		DBState:              dbState,
+		NATSState:            w.NATSState(),
+		ActiveSubscriptions:  w.ActiveSubscriptions(),
+		MissingSubscriptions: w.MissingSubscriptions(),
+		InFlight:             w.InFlight.Load(),
+		MessagesProcessed:    w.Metrics.Processed.Load(),
+		MessagesFailed:       w.Metrics.Failed.Load(),
+		LastError:            w.lastError.get(),
+		Leaders:              w.LeaderStatus(),
+	}
+}
+
+// RequestStatus sends a status request to all the workers and returns the replies
+// received before the timeout expires
+func RequestStatus(nc *nats.Conn, timeout time.Duration) ([]WorkerStatus, error) {
+	inbox := nc.NewRespInbox()
+	sub, err := nc.SubscribeSync(inbox)
+	if err != nil {
+		return nil, err
+	}
+	defer sub.Unsubscribe()
+
+	if err := nc.PublishRequest(StatusSubject, inbox, nil); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	replies := []WorkerStatus{}
+	for {
+		msg, err := sub.NextMsgWithContext(ctx)
+		if err != nil {
+			// the timeout marks the end of the replies
+			return replies, nil
+		}
+
+		status := WorkerStatus{}
+		if err := json.Unmarshal(msg.Data, &status); err != nil {
+			slog.Warn("could not decode status reply", "error", err)
+			continue
+		}
+		replies = append(replies, status)
+	}
+}
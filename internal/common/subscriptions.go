@@ -0,0 +1,244 @@
+package common
+
+import (
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+)
+
+type Subscription struct {
+	Subject string
+	Queue   string
+	Handler nats.MsgHandler
+	// SkipDBCheck must be set for handlers that don't use the database
+	SkipDBCheck bool
+	// Serial must be set for handlers that use the worker's shared state,
+	// their messages are processed one at a time whatever the concurrency settings
+	Serial bool
+	// Stream consumes the subject from this JetStream stream with a durable consumer
+	// instead of subscribing to it with core NATS
+	Stream string
+	// NoReplay must be set for handlers with effects outside the database e.g (sending emails),
+	// the replay command skips their messages
+	NoReplay bool
+}
+
+// SubscribeTo subscribes to the subjects that don't have a live subscription yet,
+// so it can be called again after a partial failure without creating duplicate subscriptions
+func (w *Worker) SubscribeTo(subscriptions []Subscription) error {
+	w.subscriptionsMu.Lock()
+	defer w.subscriptionsMu.Unlock()
+
+	if w.subscriptions == nil {
+		w.subscriptions = map[string]*nats.Subscription{}
+	}
+	if w.consumers == nil {
+		w.consumers = map[string]*consumer{}
+	}
+	nc := w.NATSConnection()
+
+	for _, s := range subscriptions {
+		if !slices.Contains(w.expectedSubscriptions, s.Subject) {
+			w.expectedSubscriptions = append(w.expectedSubscriptions, s.Subject)
+		}
+
+		if sub, ok := w.subscriptions[s.Subject]; ok && sub.IsValid() {
+			continue
+		}
+		if c, ok := w.consumers[s.Subject]; ok && c.IsValid(nc) {
+			continue
+		}
+
+		handler := w.wrapHandler(s)
+
+		concurrency := 1
+		if !s.Serial {
+			concurrency = subjectLimit(w.HandlerConcurrency, DefaultHandlerConcurrency, s.Subject)
+		}
+		maxPending := subjectLimit(w.HandlerMaxPending, DefaultHandlerMaxPending, s.Subject)
+
+		if s.Stream != "" {
+			c, err := w.consume(s, handler, concurrency, maxPending)
+			if err != nil {
+				slog.Error("could not consume from JetStream", "stream", s.Stream, "subject", s.Subject, "error", err)
+				return err
+			}
+			w.consumers[s.Subject] = c
+			continue
+		}
+		handler = w.Concurrent(s.Subject, concurrency, handler)
+
+		var err error
+		var sub *nats.Subscription
+		if s.Queue == "" {
+			sub, err = nc.Subscribe(s.Subject, handler)
+		} else {
+			sub, err = nc.QueueSubscribe(s.Subject, s.Queue, handler)
+		}
+		if err != nil {
+			slog.Error("could not subscribe to NATS subject", "subject", s.Subject, "queue", s.Queue, "error", err)
+			return err
+		}
+
+		if err := sub.SetPendingLimits(maxPending, -1); err != nil {
+			slog.Error("could not set the pending limits", "subject", s.Subject, "error", err)
+		}
+
+		w.subscriptions[s.Subject] = sub
+		slog.Info("subscribed to NATS subject", "subject", s.Subject, "queue", s.Queue, "concurrency", concurrency, "max_pending", maxPending)
+	}
+
+	return nil
+}
+
+// wrapHandler adds the checks, the metrics, the tracing and the capture to the subscription's handler
+func (w *Worker) wrapHandler(s Subscription) nats.MsgHandler {
+	handler := s.Handler
+	if !s.SkipDBCheck {
+		handler = w.RequireDB(handler)
+	}
+	handler = w.LimitPayload(handler)
+	handler = w.Instrument(handler)
+	handler = w.Trace(s, handler)
+	handler = w.HoldModel(handler)
+	return w.Capture(handler)
+}
+
+// DrainSubscriptions stops receiving messages from the subscriptions and the JetStream consumers,
+// the messages already received are still delivered to their handlers
+func (w *Worker) DrainSubscriptions() {
+	w.subscriptionsMu.Lock()
+	defer w.subscriptionsMu.Unlock()
+
+	for subject, sub := range w.subscriptions {
+		if !sub.IsValid() {
+			continue
+		}
+		if err := sub.Drain(); err != nil {
+			slog.Error("could not drain the subscription", "subject", subject, "error", err)
+		}
+	}
+	for _, c := range w.consumers {
+		c.cc.Drain()
+	}
+}
+
+// subscriptionsDrained reports if the subscriptions and the JetStream consumers
+// have delivered all the messages they had received
+func (w *Worker) subscriptionsDrained() bool {
+	w.subscriptionsMu.Lock()
+	defer w.subscriptionsMu.Unlock()
+
+	for _, sub := range w.subscriptions {
+		if sub.IsValid() {
+			return false
+		}
+	}
+	for _, c := range w.consumers {
+		select {
+		case <-c.cc.Closed():
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// ActiveSubscriptions returns the subjects with a live subscription
+func (w *Worker) ActiveSubscriptions() []string {
+	w.subscriptionsMu.Lock()
+	defer w.subscriptionsMu.Unlock()
+
+	active := []string{}
+	for subject, sub := range w.subscriptions {
+		if sub.IsValid() {
+			active = append(active, subject)
+		}
+	}
+	for subject, c := range w.consumers {
+		if c.IsValid(w.NATSConnection()) {
+			active = append(active, subject)
+		}
+	}
+	slices.Sort(active)
+
+	return active
+}
+
+// MissingSubscriptions returns the subjects the worker should be subscribed to but it's not
+func (w *Worker) MissingSubscriptions() []string {
+	w.subscriptionsMu.Lock()
+	defer w.subscriptionsMu.Unlock()
+
+	missing := []string{}
+	for _, subject := range w.expectedSubscriptions {
+		if sub, ok := w.subscriptions[subject]; ok && sub.IsValid() {
+			continue
+		}
+		if c, ok := w.consumers[subject]; ok && c.IsValid(w.NATSConnection()) {
+			continue
+		}
+		missing = append(missing, subject)
+	}
+
+	return missing
+}
+
+// PendingMessages returns the number of messages received but not yet delivered to the handlers
+func (w *Worker) PendingMessages() int {
+	w.subscriptionsMu.Lock()
+	defer w.subscriptionsMu.Unlock()
+
+	pending := 0
+	for _, sub := range w.subscriptions {
+		if n, _, err := sub.Pending(); err == nil {
+			pending += n
+		}
+	}
+
+	return pending
+}
+
+// SubscriptionsComplete reports if the worker has subscribed to all its subjects
+func (w *Worker) SubscriptionsComplete() bool {
+	return len(w.expectedSubscriptionsCopy()) > 0 && len(w.MissingSubscriptions()) == 0
+}
+
+func (w *Worker) expectedSubscriptionsCopy() []string {
+	w.subscriptionsMu.Lock()
+	defer w.subscriptionsMu.Unlock()
+
+	return slices.Clone(w.expectedSubscriptions)
+}
+
+// PendingBySubject returns the number of messages waiting for a handler per subject
+func (w *Worker) PendingBySubject() map[string]int {
+	w.subscriptionsMu.Lock()
+	defer w.subscriptionsMu.Unlock()
+
+	pending := map[string]int{}
+	for subject, sub := range w.subscriptions {
+		if n, _, err := sub.Pending(); err == nil {
+			pending[subject] = n
+		}
+	}
+
+	return pending
+}
+
+// SubjectMatches reports if the subject matches the filter, the filter can use the * and > wildcards
+func SubjectMatches(filter, subject string) bool {
+	f := strings.Split(filter, ".")
+	s := strings.Split(subject, ".")
+	for i, token := range f {
+		if token == ">" {
+			return len(s) > i
+		}
+		if i >= len(s) || (token != "*" && token != s[i]) {
+			return false
+		}
+	}
+	return len(f) == len(s)
+}
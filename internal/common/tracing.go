@@ -0,0 +1,244 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.41.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const (
+	tracerName = "github.com/open-uem/openuem-worker"
+
+	TracingExporterNone   = "none"
+	TracingExporterOTLP   = "otlp"
+	TracingExporterStdout = "stdout"
+
+	TracingProtocolGRPC = "grpc"
+	TracingProtocolHTTP = "http"
+)
+
+// tracer returns the worker's tracer from the global provider, it's replaced if the tracing settings are reloaded
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// StartTracing exports the spans with the configured exporter, the trace context
+// found in the messages is propagated even if the spans aren't exported
+func (w *Worker) StartTracing() error {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	w.StopTracing()
+
+	if w.TracingExporter == "" || w.TracingExporter == TracingExporterNone {
+		return nil
+	}
+
+	exporter, err := w.newSpanExporter()
+	if err != nil {
+		return fmt.Errorf("could not create the %s span exporter, reason: %v", w.TracingExporter, err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName("openuem-worker"),
+		semconv.ServiceVersion(w.Version),
+		semconv.ServiceInstanceID(w.InstanceID),
+		attribute.String("openuem.worker.role", w.Role),
+	))
+	if err != nil {
+		return fmt.Errorf("could not create the tracing resource, reason: %v", err)
+	}
+
+	ratio := w.TracingSampleRatio
+	if ratio < 0 || ratio > 1 {
+		ratio = 1
+	}
+
+	w.tracerProvider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	)
+	otel.SetTracerProvider(w.tracerProvider)
+
+	slog.Info("tracing has been enabled", "exporter", w.TracingExporter, "endpoint", w.TracingEndpoint, "sample_ratio", ratio)
+	return nil
+}
+
+// StopTracing exports the pending spans and stops the exporter
+func (w *Worker) StopTracing() {
+	if w.tracerProvider == nil {
+		return
+	}
+
+	otel.SetTracerProvider(noop.NewTracerProvider())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := w.tracerProvider.Shutdown(ctx); err != nil {
+		slog.Error("could not stop the span exporter", "error", err)
+	}
+	w.tracerProvider = nil
+}
+
+func (w *Worker) newSpanExporter() (sdktrace.SpanExporter, error) {
+	switch w.TracingExporter {
+	case TracingExporterStdout:
+		return stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case TracingExporterOTLP:
+		// the endpoint and the TLS settings can also be set with the OTEL_EXPORTER_OTLP_* environment variables
+		switch w.TracingProtocol {
+		case "", TracingProtocolGRPC:
+			opts := []otlptracegrpc.Option{}
+			if w.TracingEndpoint != "" {
+				opts = append(opts, otlptracegrpc.WithEndpoint(w.TracingEndpoint))
+			}
+			if w.TracingInsecure {
+				opts = append(opts, otlptracegrpc.WithInsecure())
+			}
+			return otlptracegrpc.New(w.Context, opts...)
+		case TracingProtocolHTTP:
+			opts := []otlptracehttp.Option{}
+			if w.TracingEndpoint != "" {
+				opts = append(opts, otlptracehttp.WithEndpoint(w.TracingEndpoint))
+			}
+			if w.TracingInsecure {
+				opts = append(opts, otlptracehttp.WithInsecure())
+			}
+			return otlptracehttp.New(w.Context, opts...)
+		default:
+			return nil, fmt.Errorf("unknown OTLP protocol %q, it must be %s or %s", w.TracingProtocol, TracingProtocolGRPC, TracingProtocolHTTP)
+		}
+	default:
+		return nil, fmt.Errorf("unknown exporter %q, it must be %s, %s or %s", w.TracingExporter, TracingExporterNone, TracingExporterOTLP, TracingExporterStdout)
+	}
+}
+
+// Trace wraps a NATS handler so each message is processed in a span that continues the
+// trace found in the message headers, handlers get the span with MessageContext
+func (w *Worker) Trace(s Subscription, handler nats.MsgHandler) nats.MsgHandler {
+	return func(msg *nats.Msg) {
+		ctx := otel.GetTextMapPropagator().Extract(context.Background(), headerCarrier(msg.Header))
+		_, span := tracer().Start(ctx, "process "+s.Subject,
+			trace.WithSpanKind(trace.SpanKindConsumer),
+			trace.WithAttributes(
+				semconv.MessagingSystemKey.String("nats"),
+				semconv.MessagingOperationTypeProcess,
+				semconv.MessagingDestinationName(msg.Subject),
+				semconv.MessagingConsumerGroupName(s.Queue),
+				semconv.MessagingMessageBodySize(len(msg.Data)),
+			),
+		)
+		defer span.End()
+
+		w.spans.Store(msg, span)
+		defer w.spans.Delete(msg)
+
+		handler(msg)
+	}
+}
+
+// messageSpan returns the span of the message being processed, or a non-recording span
+func (w *Worker) messageSpan(msg *nats.Msg) trace.Span {
+	if span, ok := w.spans.Load(msg); ok {
+		return span.(trace.Span)
+	}
+	return trace.SpanFromContext(context.Background())
+}
+
+// recordError marks the span of the message as failed
+func (w *Worker) recordError(msg *nats.Msg, err error) {
+	span := w.messageSpan(msg)
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// Publish publishes a message with the trace context so its consumer continues the trace
+func (w *Worker) Publish(ctx context.Context, subject string, data []byte) error {
+	ctx, span := tracer().Start(ctx, "publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			semconv.MessagingSystemKey.String("nats"),
+			semconv.MessagingOperationTypeSend,
+			semconv.MessagingDestinationName(subject),
+			semconv.MessagingMessageBodySize(len(data)),
+		),
+	)
+	defer span.End()
+
+	nc := w.NATSConnection()
+	if nc == nil || !nc.IsConnected() {
+		err := fmt.Errorf("NATS is not connected")
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	msg := nats.NewMsg(subject)
+	msg.Data = data
+	otel.GetTextMapPropagator().Inject(ctx, headerCarrier(msg.Header))
+
+	if err := nc.PublishMsg(msg); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	return nil
+}
+
+// startClientSpan starts a client span for a call to an external service
+func startClientSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer().Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+}
+
+// endSpan records the error, if any, and ends the span
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// headerCarrier reads and writes the trace context in NATS headers, unlike HTTP
+// the NATS header keys are case-sensitive so they're matched ignoring the case
+type headerCarrier nats.Header
+
+func (h headerCarrier) Get(key string) string {
+	if v, ok := h[key]; ok && len(v) > 0 {
+		return v[0]
+	}
+	for k, v := range h {
+		if strings.EqualFold(k, key) && len(v) > 0 {
+			return v[0]
+		}
+	}
+	return ""
+}
+
+func (h headerCarrier) Set(key, value string) {
+	h[key] = []string{value}
+}
+
+func (h headerCarrier) Keys() []string {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	return keys
+}
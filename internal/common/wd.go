@@ -1,7 +1,7 @@
 package common
 
 import (
-	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
 )
@@ -9,7 +9,7 @@ import (
 func GetWd() (string, error) {
 	ex, err := os.Executable()
 	if err != nil {
-		log.Printf("[ERROR]:could not get executable info: %v", err)
+		slog.Error("could not get executable info", "error", err)
 		return "", err
 	}
 	return filepath.Dir(ex), nil
@@ -5,7 +5,12 @@ import (
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/json"
-	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/go-co-op/gocron/v2"
 	"github.com/nats-io/nats.go"
@@ -15,17 +20,25 @@ import (
 	openuem_nats "github.com/open-uem/nats"
 	"github.com/open-uem/openuem-worker/internal/models"
 	"github.com/open-uem/utils"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 )
 
 type Worker struct {
-	NATSConnection         *nats.Conn
 	NATSConnectJob         gocron.Job
 	NATSServers            string
 	DBUrl                  string
 	DBConnectJob           gocron.Job
+	DBLivenessJob          gocron.Job
+	DBPool                 models.PoolConfig
+	DBReady                atomic.Bool
+	AutoMigrate            bool
 	ConfigJob              gocron.Job
+	ConfigWatchJob         gocron.Job
+	CertWatchJob           gocron.Job
+	CertExpiryWarnings     []time.Duration
+	CertSelfRenew          bool
+	CertRenewBefore        time.Duration
 	TaskScheduler          gocron.Scheduler
-	Model                  *models.Model
 	CACert                 *x509.Certificate
 	CAPrivateKey           *rsa.PrivateKey
 	ClientCertPath         string
@@ -43,63 +56,220 @@ type Worker struct {
 	OCSPResponders         []string
 	JetstreamContextCancel context.CancelFunc
 	Version                string
+	InstanceID             string
+	Hostname               string
+	StartedAt              time.Time
 	Channel                server.Channel
 	Replicas               int
 	Jetstream              jetstream.JetStream
+	TracingExporter        string
+	TracingEndpoint        string
+	TracingProtocol        string
+	TracingInsecure        bool
+	TracingSampleRatio     float64
+	JetstreamEnabled       bool
+	JetstreamMaxDeliver    int
 	EncryptionMasterKey    string
+	Keyring                *Keyring
+	SMTPPassword           string
+	SecretsRefreshInterval time.Duration
+	SecretsRefreshJob      gocron.Job
+	CaptureFile            string
+	CaptureMaxSize         int
+	CaptureMaxFiles        int
+	CaptureAgents          []string
+	CaptureSubjects        []string
+	Metrics                *Metrics
+	MetricsAddress         string
+	HealthAddress          string
+	HTTPServers            []*http.Server
+	Role                   string
+	LogFormat              string
+	LogLevel               string
+	LogLevelVar            slog.LevelVar
+	Context                context.Context
+	ContextCancel          context.CancelFunc
+	HandlerTimeout         time.Duration
+	HandlerTimeouts        map[string]time.Duration
+	HandlerConcurrency     map[string]int
+	HandlerMaxPending      map[string]int
+	RateLimits             map[string]RateLimit
+	MaxPayloadSizes        map[string]int
+	MaxReportItems         map[string]int
+	ShutdownGracePeriod    time.Duration
+	InFlight               atomic.Int64
+	Stopping               atomic.Bool
+	natsMu                 sync.Mutex
+	queueSubscribe         func() error
+	subscriptionsMu        sync.Mutex
+	subscriptions          map[string]*nats.Subscription
+	consumers              map[string]*consumer
+	rateLimiters           agentLimiters
+	deadLetterMu           sync.Mutex
+	deadLetters            jetstream.JetStream
+	expectedSubscriptions  []string
+	lastError              lastErrorRecorder
+	config                 *Config
+	configLoader           func() (*Config, error)
+	configFiles            []string
+	configFileState        string
+	reloadMu               sync.Mutex
+	clientCertState        string
+	clientCertNotAfter     atomic.Int64
+	certWarnedThreshold    time.Duration
+	tracerProvider         *sdktrace.TracerProvider
+	LeaderLeaseTTL         time.Duration
+	electionsMu            sync.Mutex
+	elections              map[string]*LeaderElection
+	electionsCancel        context.CancelFunc
+	electionsWG            sync.WaitGroup
+	spans                  sync.Map
+	settingsMu             sync.RWMutex
+	modelMu                sync.RWMutex
+	model                  *modelHandle
+	capture                atomic.Pointer[captureFile]
+	captures               sync.Map
+	natsConnection         atomic.Pointer[nats.Conn]
+	outcomes               sync.Map
 }
 
 func NewWorker(logName string) *Worker {
-	worker := Worker{}
+	worker := Worker{
+		Metrics:             NewMetrics(),
+		HandlerTimeout:      DefaultHandlerTimeout,
+		DBPool:              models.DefaultPoolConfig(),
+		HandlerTimeouts:     map[string]time.Duration{},
+		ShutdownGracePeriod: DefaultShutdownGracePeriod,
+		JetstreamMaxDeliver: DefaultJetstreamMaxDeliver,
+		CertExpiryWarnings:  DefaultCertExpiryWarnings,
+		CertRenewBefore:     DefaultCertRenewBefore,
+		TracingSampleRatio:  1,
+		LeaderLeaseTTL:      DefaultLeaderLeaseTTL,
+	}
+
+	worker.Metrics.RegisterWorkerState(&worker)
+	worker.setIdentity()
+
+	// The root context is cancelled when the worker stops so in-flight DB work is interrupted
+	worker.Context, worker.ContextCancel = context.WithCancel(context.Background())
+
 	if logName != "" {
 		worker.Logger = utils.NewLogger(logName)
 	}
 
+	// Default logger until the worker's config has been read
+	if err := worker.SetLogger(); err != nil {
+		slog.Error("could not set the logger", "error", err)
+	}
+
 	return &worker
 }
 
 func (w *Worker) StartWorker(subscription func() error) {
+	// Export the spans of the handlers if an exporter has been set
+	if err := w.StartTracing(); err != nil {
+		slog.Error("could not start tracing", "error", err)
+	}
+
+	// Serve Prometheus metrics and health endpoints if an address has been set
+	w.StartHTTPServers()
+
+	// Reload the settings on SIGHUP or when the config file changes
+	w.StartConfigReload()
+
+	// Read the secrets again so the ones rotated in their providers are used
+	w.StartSecretsRefreshJob()
+
+	// Write the selected messages and their replies to the capture file
+	if err := w.StartCapture(); err != nil {
+		slog.Error("could not start capturing messages", "error", err)
+	}
+
+	// Warn before the NATS client certificate expires and reconnect when it's replaced
+	w.StartCertWatchJob()
+
 	// Start a job to try to connect with the database
 	if err := w.StartDBConnectJob(subscription); err != nil {
-		log.Fatalf("[FATAL]: could not start DB connect job, reason: %v", err)
-		return
+		slog.Error("could not start DB connect job", "error", err)
+		os.Exit(1)
 	}
 }
 
 func (w *Worker) StopWorker() {
-	if w.NATSConnection != nil {
-		if err := w.NATSConnection.Drain(); err != nil {
-			log.Printf("[ERROR]: could not drain NATS connection, reason: %v", err)
-		}
-		if w.JetstreamContextCancel != nil {
-			w.JetstreamContextCancel()
+	w.Stopping.Store(true)
+
+	// Stop the scheduler first so no job tries to reconnect while we're shutting down
+	if w.TaskScheduler != nil {
+		if err := w.TaskScheduler.Shutdown(); err != nil {
+			slog.Error("could not stop the task scheduler", "error", err)
 		}
 	}
 
-	if w.Model != nil {
-		w.Model.Close()
+	// Let another replica run the singleton jobs
+	w.StopLeaderElections()
+
+	// Stop accepting messages, drain lets the messages already received be processed
+	w.DrainSubscriptions()
+
+	// Wait for the drain and the running handlers, DB work is interrupted if the grace period expires
+	if abandoned := w.WaitForInFlightHandlers(w.ShutdownGracePeriod); abandoned > 0 {
+		slog.Warn("grace period expired, some messages have been abandoned", "abandoned", abandoned, "grace_period", w.ShutdownGracePeriod)
+	} else {
+		slog.Info("all in-flight messages have been processed")
+	}
+
+	if w.ContextCancel != nil {
+		w.ContextCancel()
 	}
 
-	if w.TaskScheduler != nil {
-		if err := w.TaskScheduler.Shutdown(); err != nil {
-			log.Printf("[ERROR]: could not stop the task scheduler, reason: %v", err)
-		}
+	if w.JetstreamContextCancel != nil {
+		w.JetstreamContextCancel()
 	}
 
-	log.Println("[INFO]: the worker has stopped")
+	// The connection is closed once the handlers have finished so their replies and acks are sent
+	w.drainConnection(connectionDrainTimeout)
+
+	if w.Model() != nil {
+		w.Model().Close()
+	}
+
+	w.StopHTTPServers()
+	w.StopTracing()
+	w.StopCapture()
+
+	slog.Info("the worker has stopped")
 
 	if w.Logger != nil {
 		w.Logger.Close()
 	}
 }
 
+// IsReady reports if the worker can process messages, the database must be reachable
+// and the worker must be subscribed to all its NATS subjects
+func (w *Worker) IsReady() bool {
+	return w.DBReady.Load() && w.IsNATSReady()
+}
+
+// PingHandler replies with the identity and the state of the worker
 func (w *Worker) PingHandler(msg *nats.Msg) {
-	if err := msg.Respond(nil); err != nil {
-		log.Printf("[ERROR]: could not respond to ping message, reason: %v", err)
+	logger := messageLogger(msg)
+
+	data, err := json.Marshal(w.Status())
+	if err != nil {
+		logger.Error("could not marshal worker status", "error", err)
+		return
+	}
+
+	if err := w.respond(msg, data); err != nil {
+		logger.Error("could not respond to ping message", "error", err)
 	}
 }
 
 func (w *Worker) AgentConfigHandler(msg *nats.Msg) {
+	logger := messageLogger(msg)
+	ctx, cancel := w.MessageContext(msg)
+	defer cancel()
+
 	config := openuem_nats.Config{}
 
 	remoteConfigRequest := openuem_nats.RemoteConfigRequest{}
@@ -107,57 +277,69 @@ func (w *Worker) AgentConfigHandler(msg *nats.Msg) {
 	if err != nil {
 		remoteConfigRequest.AgentID = string(msg.Data)
 	}
+	logger = logger.With("agent_id", remoteConfigRequest.AgentID, "tenant", remoteConfigRequest.TenantID)
+
+	if err := w.AllowAgent(msg, remoteConfigRequest.AgentID); err != nil {
+		w.Reject(msg, err)
+		return
+	}
 
-	frequency, err := w.Model.GetDefaultAgentFrequency(remoteConfigRequest)
+	frequency, err := w.Model().GetDefaultAgentFrequency(ctx, remoteConfigRequest)
 	if err != nil {
-		log.Printf("[ERROR]: could not get default frequency, reason: %v", err)
+		w.Metrics.DBError("GetDefaultAgentFrequency")
+		logger.Error("could not get default frequency", "error", err)
 		config.Ok = false
 	} else {
 		config.AgentFrequency = frequency
 		config.Ok = true
 	}
 
-	wingetFrequency, err := w.Model.GetWingetFrequency(remoteConfigRequest)
+	wingetFrequency, err := w.Model().GetWingetFrequency(ctx, remoteConfigRequest)
 	if err != nil {
-		log.Printf("[ERROR]: could not get winget frequency, reason: %v", err)
+		w.Metrics.DBError("GetWingetFrequency")
+		logger.Error("could not get winget frequency", "error", err)
 		config.Ok = false
 	} else {
 		config.WinGetFrequency = wingetFrequency
 		config.Ok = true
 	}
 
-	sftpStatus, err := w.Model.GetSFTPAgentSetting(remoteConfigRequest)
+	sftpStatus, err := w.Model().GetSFTPAgentSetting(ctx, remoteConfigRequest)
 	if err != nil {
-		log.Printf("[ERROR]: could not get SFTP service for agent, reason: %v", err)
+		w.Metrics.DBError("GetSFTPAgentSetting")
+		logger.Error("could not get SFTP service for agent", "error", err)
 		config.Ok = false
 	} else {
 		config.SFTPDisabled = !sftpStatus
 		config.Ok = true
-		if err := w.Model.SaveSFTPAgentSetting(remoteConfigRequest, sftpStatus); err != nil {
-			log.Printf("[ERROR]: could not save Agent SFTP status, reason: %v", err)
+		if err := w.Model().SaveSFTPAgentSetting(ctx, remoteConfigRequest, sftpStatus); err != nil {
+			w.Metrics.DBError("SaveSFTPAgentSetting")
+			logger.Error("could not save Agent SFTP status", "error", err)
 		}
 	}
 
-	remoteAssistance, err := w.Model.GetRemoteAssistanceAgentSetting(remoteConfigRequest)
+	remoteAssistance, err := w.Model().GetRemoteAssistanceAgentSetting(ctx, remoteConfigRequest)
 	if err != nil {
-		log.Printf("[ERROR]: could not get Remote Assistance for agent, reason: %v", err)
+		w.Metrics.DBError("GetRemoteAssistanceAgentSetting")
+		logger.Error("could not get Remote Assistance for agent", "error", err)
 		config.Ok = false
 	} else {
 		config.RemoteAssistanceDisabled = !remoteAssistance
 		config.Ok = true
-		if err := w.Model.SaveRemoteAssistanceAgentSetting(remoteConfigRequest, remoteAssistance); err != nil {
-			log.Printf("[ERROR]: could not save Agent Remote Assistance status, reason: %v", err)
+		if err := w.Model().SaveRemoteAssistanceAgentSetting(ctx, remoteConfigRequest, remoteAssistance); err != nil {
+			w.Metrics.DBError("SaveRemoteAssistanceAgentSetting")
+			logger.Error("could not save Agent Remote Assistance status", "error", err)
 		}
 	}
 
 	data, err := json.Marshal(config)
 	if err != nil {
-		log.Printf("[ERROR]: could not marshal config data, reason: %v", err)
+		logger.Error("could not marshal config data", "error", err)
 		return
 	}
 
-	if err := msg.Respond(data); err != nil {
-		log.Printf("[ERROR]: could not respond with agent config, reason: %v", err)
+	if err := w.respond(msg, data); err != nil {
+		logger.Error("could not respond with agent config", "error", err)
 	}
 
 }
@@ -5,7 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"slices"
 	"strconv"
@@ -34,11 +34,10 @@ import (
 	"github.com/open-uem/ent/update"
 	"github.com/open-uem/nats"
 	"github.com/open-uem/utils"
+	semconv "go.opentelemetry.io/otel/semconv/v1.41.0"
 )
 
-func (m *Model) SaveAgentInfo(data *nats.AgentReport, servers string, autoAdmitAgents bool) error {
-	ctx := context.Background()
-
+func (m *Model) SaveAgentInfo(ctx context.Context, data *nats.AgentReport, servers string, autoAdmitAgents bool) error {
 	exists := true
 	existingAgent, err := m.Client.Agent.Query().WithSite().Where(agent.ID(data.AgentID)).First(ctx)
 	if err != nil {
@@ -49,7 +48,7 @@ func (m *Model) SaveAgentInfo(data *nats.AgentReport, servers string, autoAdmitA
 		}
 	}
 
-	isRemoteAgent := checkIfRemote(data, servers)
+	isRemoteAgent := checkIfRemote(ctx, data, servers)
 
 	query := m.Client.Agent.Create().
 		SetID(data.AgentID).
@@ -121,42 +120,42 @@ func (m *Model) SaveAgentInfo(data *nats.AgentReport, servers string, autoAdmitA
 		// Check if we must add the site, only if no site has been assigned yet
 		associatedSites := existingAgent.Edges.Site
 		if len(associatedSites) > 1 {
-			log.Println("[ERROR]: agent cannot be associated to two or more sites")
+			slog.Error("agent cannot be associated to two or more sites")
 			return fmt.Errorf("agent cannot be associated to two or more sites")
 		}
 
 		if len(associatedSites) == 0 {
 			if data.Site == "" {
-				s, err := m.GetDefaultSite()
+				s, err := m.GetDefaultSite(ctx)
 				if err != nil {
-					log.Printf("[ERROR]: could not get default site, reason: %v", err)
+					slog.Error("could not get default site", "error", err)
 					return err
 				}
 				query.AddSite(s)
 			} else {
 				tenantID, err := strconv.Atoi(data.Tenant)
 				if err != nil {
-					log.Printf("[ERROR]: could not convert tenant ID to int, reason: %v", err)
+					slog.Error("could not convert tenant ID to int", "error", err)
 					return err
 				}
 
 				siteID, err := strconv.Atoi(data.Site)
 				if err != nil {
-					log.Printf("[ERROR]: could not convert site ID to int, reason: %v", err)
+					slog.Error("could not convert site ID to int", "error", err)
 					return err
 				}
 
 				// Check if tenantID is right and associated with the site
-				valid, err := m.ValidateTenantAndSite(tenantID, siteID)
+				valid, err := m.ValidateTenantAndSite(ctx, tenantID, siteID)
 				if err != nil {
-					log.Printf("[ERROR]: could not check if tenant and site are valid, reason: %v", err)
+					slog.Error("could not check if tenant and site are valid", "error", err)
 					return err
 				}
 
 				if valid {
 					query.AddSiteIDs(siteID)
 				} else {
-					log.Printf("[ERROR]: tenant and site are not valid")
+					slog.Error("tenant and site are not valid")
 					return errors.New("tenant and site are not valid")
 				}
 			}
@@ -166,7 +165,7 @@ func (m *Model) SaveAgentInfo(data *nats.AgentReport, servers string, autoAdmitA
 			SetLastContact(time.Now()).
 			OnConflictColumns(agent.FieldID).
 			UpdateNewValues().
-			Exec(context.Background())
+			Exec(ctx)
 	} else {
 		// This is a new agent, we must create a record and set enabled if auto admit agents is enabled
 		if autoAdmitAgents {
@@ -178,36 +177,36 @@ func (m *Model) SaveAgentInfo(data *nats.AgentReport, servers string, autoAdmitA
 
 		// Set the associated site
 		if data.Site == "" {
-			s, err := m.GetDefaultSite()
+			s, err := m.GetDefaultSite(ctx)
 			if err != nil {
-				log.Printf("[ERROR]: could not get default site, reason: %v", err)
+				slog.Error("could not get default site", "error", err)
 				return err
 			}
 			query.AddSite(s)
 		} else {
 			siteID, err := strconv.Atoi(data.Site)
 			if err != nil {
-				log.Printf("[ERROR]: could not convert site ID to int, reason: %v", err)
+				slog.Error("could not convert site ID to int", "error", err)
 				return err
 			}
 
 			tenantID, err := strconv.Atoi(data.Tenant)
 			if err != nil {
-				log.Printf("[ERROR]: could not convert tenant ID to int, reason: %v", err)
+				slog.Error("could not convert tenant ID to int", "error", err)
 				return err
 			}
 
 			// Check if tenantID is right and associated with the site
-			valid, err := m.ValidateTenantAndSite(tenantID, siteID)
+			valid, err := m.ValidateTenantAndSite(ctx, tenantID, siteID)
 			if err != nil {
-				log.Printf("[ERROR]: could not check if tenant and site are valid, reason: %v", err)
+				slog.Error("could not check if tenant and site are valid", "error", err)
 				return err
 			}
 
 			if valid {
 				query.AddSiteIDs(siteID)
 			} else {
-				log.Printf("[ERROR]: tenant and site are not valid")
+				slog.Error("tenant and site are not valid")
 				return errors.New("tenant and site are not valid")
 			}
 		}
@@ -217,11 +216,11 @@ func (m *Model) SaveAgentInfo(data *nats.AgentReport, servers string, autoAdmitA
 			SetLastContact(time.Now()).
 			OnConflictColumns(agent.FieldID).
 			UpdateNewValues().
-			Exec(context.Background())
+			Exec(ctx)
 	}
 }
 
-func (m *Model) SaveComputerInfo(data *nats.AgentReport) error {
+func (m *Model) SaveComputerInfo(ctx context.Context, data *nats.AgentReport) error {
 	return m.Client.Computer.
 		Create().
 		SetManufacturer(data.Computer.Manufacturer).
@@ -234,10 +233,10 @@ func (m *Model) SaveComputerInfo(data *nats.AgentReport) error {
 		SetOwnerID(data.AgentID).
 		OnConflictColumns(computer.OwnerColumn).
 		UpdateNewValues().
-		Exec(context.Background())
+		Exec(ctx)
 }
 
-func (m *Model) SaveOSInfo(data *nats.AgentReport) error {
+func (m *Model) SaveOSInfo(ctx context.Context, data *nats.AgentReport) error {
 	return m.Client.OperatingSystem.
 		Create().
 		SetType(data.OS).
@@ -252,10 +251,10 @@ func (m *Model) SaveOSInfo(data *nats.AgentReport) error {
 		SetOwnerID(data.AgentID).
 		OnConflictColumns(operatingsystem.OwnerColumn).
 		UpdateNewValues().
-		Exec(context.Background())
+		Exec(ctx)
 }
 
-func (m *Model) SaveAntivirusInfo(data *nats.AgentReport) error {
+func (m *Model) SaveAntivirusInfo(ctx context.Context, data *nats.AgentReport) error {
 	return m.Client.Antivirus.
 		Create().
 		SetName(data.Antivirus.Name).
@@ -264,10 +263,10 @@ func (m *Model) SaveAntivirusInfo(data *nats.AgentReport) error {
 		SetOwnerID(data.AgentID).
 		OnConflictColumns(antivirus.OwnerColumn).
 		UpdateNewValues().
-		Exec(context.Background())
+		Exec(ctx)
 }
 
-func (m *Model) SaveSystemUpdateInfo(data *nats.AgentReport) error {
+func (m *Model) SaveSystemUpdateInfo(ctx context.Context, data *nats.AgentReport) error {
 	return m.Client.SystemUpdate.
 		Create().
 		SetSystemUpdateStatus(data.SystemUpdate.Status).
@@ -277,12 +276,10 @@ func (m *Model) SaveSystemUpdateInfo(data *nats.AgentReport) error {
 		SetOwnerID(data.AgentID).
 		OnConflictColumns(systemupdate.OwnerColumn).
 		UpdateNewValues().
-		Exec(context.Background())
+		Exec(ctx)
 }
 
-func (m *Model) SaveAppsInfo(data *nats.AgentReport) error {
-	ctx := context.Background()
-
+func (m *Model) SaveAppsInfo(ctx context.Context, data *nats.AgentReport) error {
 	tx, err := m.Client.Tx(ctx)
 	if err != nil {
 		return err
@@ -290,7 +287,7 @@ func (m *Model) SaveAppsInfo(data *nats.AgentReport) error {
 
 	_, err = tx.App.Delete().Where(app.HasOwnerWith(agent.ID(data.AgentID))).Exec(ctx)
 	if err != nil {
-		log.Printf("could not delete previous apps information: %v", err)
+		slog.Error("could not delete previous apps information", "error", err)
 		return tx.Rollback()
 	}
 
@@ -310,9 +307,7 @@ func (m *Model) SaveAppsInfo(data *nats.AgentReport) error {
 	return tx.Commit()
 }
 
-func (m *Model) SaveMonitorsInfo(data *nats.AgentReport) error {
-	ctx := context.Background()
-
+func (m *Model) SaveMonitorsInfo(ctx context.Context, data *nats.AgentReport) error {
 	tx, err := m.Client.Tx(ctx)
 	if err != nil {
 		return err
@@ -320,7 +315,7 @@ func (m *Model) SaveMonitorsInfo(data *nats.AgentReport) error {
 
 	_, err = tx.Monitor.Delete().Where(monitor.HasOwnerWith(agent.ID(data.AgentID))).Exec(ctx)
 	if err != nil {
-		log.Printf("could not delete previous monitors information: %v", err)
+		slog.Error("could not delete previous monitors information", "error", err)
 		return tx.Rollback()
 	}
 
@@ -341,9 +336,7 @@ func (m *Model) SaveMonitorsInfo(data *nats.AgentReport) error {
 	return tx.Commit()
 }
 
-func (m *Model) SaveMemorySlotsInfo(data *nats.AgentReport) error {
-	ctx := context.Background()
-
+func (m *Model) SaveMemorySlotsInfo(ctx context.Context, data *nats.AgentReport) error {
 	tx, err := m.Client.Tx(ctx)
 	if err != nil {
 		return err
@@ -351,7 +344,7 @@ func (m *Model) SaveMemorySlotsInfo(data *nats.AgentReport) error {
 
 	_, err = tx.MemorySlot.Delete().Where(memoryslot.HasOwnerWith(agent.ID(data.AgentID))).Exec(ctx)
 	if err != nil {
-		log.Printf("could not delete previous memory slots information: %v", err)
+		slog.Error("could not delete previous memory slots information", "error", err)
 		return tx.Rollback()
 	}
 
@@ -374,9 +367,7 @@ func (m *Model) SaveMemorySlotsInfo(data *nats.AgentReport) error {
 	return tx.Commit()
 }
 
-func (m *Model) SaveLogicalDisksInfo(data *nats.AgentReport) error {
-	ctx := context.Background()
-
+func (m *Model) SaveLogicalDisksInfo(ctx context.Context, data *nats.AgentReport) error {
 	tx, err := m.Client.Tx(ctx)
 	if err != nil {
 		return err
@@ -384,7 +375,7 @@ func (m *Model) SaveLogicalDisksInfo(data *nats.AgentReport) error {
 
 	_, err = tx.LogicalDisk.Delete().Where(logicaldisk.HasOwnerWith(agent.ID(data.AgentID))).Exec(ctx)
 	if err != nil {
-		log.Printf("could not delete previous logical disks information: %v", err)
+		slog.Error("could not delete previous logical disks information", "error", err)
 		return tx.Rollback()
 	}
 
@@ -407,9 +398,7 @@ func (m *Model) SaveLogicalDisksInfo(data *nats.AgentReport) error {
 	return tx.Commit()
 }
 
-func (m *Model) SavePhysicalDisksInfo(data *nats.AgentReport) error {
-	ctx := context.Background()
-
+func (m *Model) SavePhysicalDisksInfo(ctx context.Context, data *nats.AgentReport) error {
 	tx, err := m.Client.Tx(ctx)
 	if err != nil {
 		return err
@@ -417,7 +406,7 @@ func (m *Model) SavePhysicalDisksInfo(data *nats.AgentReport) error {
 
 	_, err = tx.PhysicalDisk.Delete().Where(physicaldisk.HasOwnerWith(agent.ID(data.AgentID))).Exec(ctx)
 	if err != nil {
-		log.Printf("could not delete previous physical disks information: %v", err)
+		slog.Error("could not delete previous physical disks information", "error", err)
 		return tx.Rollback()
 	}
 
@@ -437,9 +426,7 @@ func (m *Model) SavePhysicalDisksInfo(data *nats.AgentReport) error {
 	return tx.Commit()
 }
 
-func (m *Model) SavePrintersInfo(data *nats.AgentReport) error {
-	ctx := context.Background()
-
+func (m *Model) SavePrintersInfo(ctx context.Context, data *nats.AgentReport) error {
 	tx, err := m.Client.Tx(ctx)
 	if err != nil {
 		return err
@@ -447,7 +434,7 @@ func (m *Model) SavePrintersInfo(data *nats.AgentReport) error {
 
 	_, err = tx.Printer.Delete().Where(printer.HasOwnerWith(agent.ID(data.AgentID))).Exec(ctx)
 	if err != nil {
-		log.Printf("could not delete previous printers information: %v", err)
+		slog.Error("could not delete previous printers information", "error", err)
 		return tx.Rollback()
 	}
 
@@ -468,9 +455,7 @@ func (m *Model) SavePrintersInfo(data *nats.AgentReport) error {
 	return tx.Commit()
 }
 
-func (m *Model) SaveNetworkAdaptersInfo(data *nats.AgentReport) error {
-	ctx := context.Background()
-
+func (m *Model) SaveNetworkAdaptersInfo(ctx context.Context, data *nats.AgentReport) error {
 	tx, err := m.Client.Tx(ctx)
 	if err != nil {
 		return err
@@ -478,7 +463,7 @@ func (m *Model) SaveNetworkAdaptersInfo(data *nats.AgentReport) error {
 
 	_, err = tx.NetworkAdapter.Delete().Where(networkadapter.HasOwnerWith(agent.ID(data.AgentID))).Exec(ctx)
 	if err != nil {
-		log.Printf("could not delete previous network adapters information: %v", err)
+		slog.Error("could not delete previous network adapters information", "error", err)
 		return tx.Rollback()
 	}
 
@@ -506,9 +491,7 @@ func (m *Model) SaveNetworkAdaptersInfo(data *nats.AgentReport) error {
 	return tx.Commit()
 }
 
-func (m *Model) SaveSharesInfo(data *nats.AgentReport) error {
-	ctx := context.Background()
-
+func (m *Model) SaveSharesInfo(ctx context.Context, data *nats.AgentReport) error {
 	tx, err := m.Client.Tx(ctx)
 	if err != nil {
 		return err
@@ -516,7 +499,7 @@ func (m *Model) SaveSharesInfo(data *nats.AgentReport) error {
 
 	_, err = tx.Share.Delete().Where(share.HasOwnerWith(agent.ID(data.AgentID))).Exec(ctx)
 	if err != nil {
-		log.Printf("could not delete previous shares information: %v", err)
+		slog.Error("could not delete previous shares information", "error", err)
 		return tx.Rollback()
 	}
 
@@ -535,9 +518,7 @@ func (m *Model) SaveSharesInfo(data *nats.AgentReport) error {
 	return tx.Commit()
 }
 
-func (m *Model) SaveUpdatesInfo(data *nats.AgentReport) error {
-	ctx := context.Background()
-
+func (m *Model) SaveUpdatesInfo(ctx context.Context, data *nats.AgentReport) error {
 	tx, err := m.Client.Tx(ctx)
 	if err != nil {
 		return err
@@ -545,7 +526,7 @@ func (m *Model) SaveUpdatesInfo(data *nats.AgentReport) error {
 
 	_, err = tx.Update.Delete().Where(update.HasOwnerWith(agent.ID(data.AgentID))).Exec(ctx)
 	if err != nil {
-		log.Printf("could not delete previous updates information: %v", err)
+		slog.Error("could not delete previous updates information", "error", err)
 		return tx.Rollback()
 	}
 
@@ -564,19 +545,19 @@ func (m *Model) SaveUpdatesInfo(data *nats.AgentReport) error {
 	return tx.Commit()
 }
 
-func (m *Model) GetDefaultAgentFrequency(request nats.RemoteConfigRequest) (int, error) {
+func (m *Model) GetDefaultAgentFrequency(ctx context.Context, request nats.RemoteConfigRequest) (int, error) {
 	var err error
 
-	tenantID, err := m.GetTenantFromAgentID(request)
+	tenantID, err := m.GetTenantFromAgentID(ctx, request)
 	if err != nil {
-		settings, err := m.Client.Settings.Query().Where(settings.Not(settings.HasTenant())).Select(settings.FieldAgentReportFrequenceInMinutes).Only(context.Background())
+		settings, err := m.Client.Settings.Query().Where(settings.Not(settings.HasTenant())).Select(settings.FieldAgentReportFrequenceInMinutes).Only(ctx)
 		if err != nil {
 			return 0, err
 		}
 		return settings.AgentReportFrequenceInMinutes, nil
 	}
 
-	settings, err := m.Client.Settings.Query().Where(settings.HasTenantWith(tenant.ID(tenantID))).Select(settings.FieldAgentReportFrequenceInMinutes).Only(context.Background())
+	settings, err := m.Client.Settings.Query().Where(settings.HasTenantWith(tenant.ID(tenantID))).Select(settings.FieldAgentReportFrequenceInMinutes).Only(ctx)
 	if err != nil {
 		return 0, err
 	}
@@ -584,12 +565,12 @@ func (m *Model) GetDefaultAgentFrequency(request nats.RemoteConfigRequest) (int,
 	return settings.AgentReportFrequenceInMinutes, nil
 }
 
-func (m *Model) GetWingetFrequency(request nats.RemoteConfigRequest) (int, error) {
+func (m *Model) GetWingetFrequency(ctx context.Context, request nats.RemoteConfigRequest) (int, error) {
 	var err error
 
-	tenantID, err := m.GetTenantFromAgentID(request)
+	tenantID, err := m.GetTenantFromAgentID(ctx, request)
 	if err != nil {
-		settings, err := m.Client.Settings.Query().Where(settings.Not(settings.HasTenant())).Select(settings.FieldProfilesApplicationFrequenceInMinutes).Only(context.Background())
+		settings, err := m.Client.Settings.Query().Where(settings.Not(settings.HasTenant())).Select(settings.FieldProfilesApplicationFrequenceInMinutes).Only(ctx)
 		if err != nil {
 			return 0, err
 		}
@@ -597,7 +578,7 @@ func (m *Model) GetWingetFrequency(request nats.RemoteConfigRequest) (int, error
 		return settings.ProfilesApplicationFrequenceInMinutes, nil
 	}
 
-	settings, err := m.Client.Settings.Query().Where(settings.HasTenantWith(tenant.ID(tenantID))).Select(settings.FieldProfilesApplicationFrequenceInMinutes).Only(context.Background())
+	settings, err := m.Client.Settings.Query().Where(settings.HasTenantWith(tenant.ID(tenantID))).Select(settings.FieldProfilesApplicationFrequenceInMinutes).Only(ctx)
 	if err != nil {
 		return 0, err
 	}
@@ -605,12 +586,12 @@ func (m *Model) GetWingetFrequency(request nats.RemoteConfigRequest) (int, error
 	return settings.ProfilesApplicationFrequenceInMinutes, nil
 }
 
-func (m *Model) GetSFTPAgentSetting(request nats.RemoteConfigRequest) (bool, error) {
-	agent, err := m.Client.Agent.Query().Select(agent.FieldSftpService).Where(agent.ID(request.AgentID)).First(context.Background())
+func (m *Model) GetSFTPAgentSetting(ctx context.Context, request nats.RemoteConfigRequest) (bool, error) {
+	agent, err := m.Client.Agent.Query().Select(agent.FieldSftpService).Where(agent.ID(request.AgentID)).First(ctx)
 	if err != nil {
-		tenantID, err := m.GetTenantFromAgentID(request)
+		tenantID, err := m.GetTenantFromAgentID(ctx, request)
 		if err != nil {
-			settings, err := m.Client.Settings.Query().Where(settings.Not(settings.HasTenant())).Select(settings.FieldProfilesApplicationFrequenceInMinutes).Only(context.Background())
+			settings, err := m.Client.Settings.Query().Where(settings.Not(settings.HasTenant())).Select(settings.FieldProfilesApplicationFrequenceInMinutes).Only(ctx)
 			if err != nil {
 				return false, err
 			}
@@ -618,7 +599,7 @@ func (m *Model) GetSFTPAgentSetting(request nats.RemoteConfigRequest) (bool, err
 			return !settings.DisableSftp, nil
 		}
 
-		settings, err := m.Client.Settings.Query().Where(settings.HasTenantWith(tenant.ID(tenantID))).Select(settings.FieldProfilesApplicationFrequenceInMinutes).Only(context.Background())
+		settings, err := m.Client.Settings.Query().Where(settings.HasTenantWith(tenant.ID(tenantID))).Select(settings.FieldProfilesApplicationFrequenceInMinutes).Only(ctx)
 		if err != nil {
 			return false, err
 		}
@@ -628,16 +609,16 @@ func (m *Model) GetSFTPAgentSetting(request nats.RemoteConfigRequest) (bool, err
 	return agent.SftpService, nil
 }
 
-func (m *Model) SaveSFTPAgentSetting(request nats.RemoteConfigRequest, status bool) error {
-	return m.Client.Agent.UpdateOneID(request.AgentID).SetSftpService(status).Exec(context.Background())
+func (m *Model) SaveSFTPAgentSetting(ctx context.Context, request nats.RemoteConfigRequest, status bool) error {
+	return m.Client.Agent.UpdateOneID(request.AgentID).SetSftpService(status).Exec(ctx)
 }
 
-func (m *Model) GetRemoteAssistanceAgentSetting(request nats.RemoteConfigRequest) (bool, error) {
-	agent, err := m.Client.Agent.Query().Select(agent.FieldRemoteAssistance).Where(agent.ID(request.AgentID)).First(context.Background())
+func (m *Model) GetRemoteAssistanceAgentSetting(ctx context.Context, request nats.RemoteConfigRequest) (bool, error) {
+	agent, err := m.Client.Agent.Query().Select(agent.FieldRemoteAssistance).Where(agent.ID(request.AgentID)).First(ctx)
 	if err != nil {
-		tenantID, err := m.GetTenantFromAgentID(request)
+		tenantID, err := m.GetTenantFromAgentID(ctx, request)
 		if err != nil {
-			settings, err := m.Client.Settings.Query().Where(settings.Not(settings.HasTenant())).Select(settings.FieldProfilesApplicationFrequenceInMinutes).Only(context.Background())
+			settings, err := m.Client.Settings.Query().Where(settings.Not(settings.HasTenant())).Select(settings.FieldProfilesApplicationFrequenceInMinutes).Only(ctx)
 			if err != nil {
 				return false, err
 			}
@@ -645,7 +626,7 @@ func (m *Model) GetRemoteAssistanceAgentSetting(request nats.RemoteConfigRequest
 			return !settings.DisableRemoteAssistance, nil
 		}
 
-		settings, err := m.Client.Settings.Query().Where(settings.HasTenantWith(tenant.ID(tenantID))).Select(settings.FieldProfilesApplicationFrequenceInMinutes).Only(context.Background())
+		settings, err := m.Client.Settings.Query().Where(settings.HasTenantWith(tenant.ID(tenantID))).Select(settings.FieldProfilesApplicationFrequenceInMinutes).Only(ctx)
 		if err != nil {
 			return false, err
 		}
@@ -655,11 +636,11 @@ func (m *Model) GetRemoteAssistanceAgentSetting(request nats.RemoteConfigRequest
 	return agent.RemoteAssistance, nil
 }
 
-func (m *Model) SaveRemoteAssistanceAgentSetting(request nats.RemoteConfigRequest, status bool) error {
-	return m.Client.Agent.UpdateOneID(request.AgentID).SetRemoteAssistance(status).Exec(context.Background())
+func (m *Model) SaveRemoteAssistanceAgentSetting(ctx context.Context, request nats.RemoteConfigRequest, status bool) error {
+	return m.Client.Agent.UpdateOneID(request.AgentID).SetRemoteAssistance(status).Exec(ctx)
 }
 
-func (m *Model) SaveNetbirdInfo(data *nats.AgentReport) error {
+func (m *Model) SaveNetbirdInfo(ctx context.Context, data *nats.AgentReport) error {
 	return m.Client.Netbird.
 		Create().
 		SetVersion(data.Netbird.Version).
@@ -679,10 +660,10 @@ func (m *Model) SaveNetbirdInfo(data *nats.AgentReport) error {
 		SetOwnerID(data.AgentID).
 		OnConflictColumns(netbird.OwnerColumn).
 		UpdateNewValues().
-		Exec(context.Background())
+		Exec(ctx)
 }
 
-func (m *Model) SaveReleaseInfo(data *nats.AgentReport) error {
+func (m *Model) SaveReleaseInfo(ctx context.Context, data *nats.AgentReport) error {
 	var err error
 	var r *ent.Release
 	releaseExists := false
@@ -690,7 +671,7 @@ func (m *Model) SaveReleaseInfo(data *nats.AgentReport) error {
 	r, err = m.Client.Release.Query().
 		WithAgents().
 		Where(release.ReleaseTypeEQ(release.ReleaseTypeAgent), release.Version(data.Release.Version), release.Channel(data.Release.Channel), release.Os(data.Release.Os), release.Arch(data.Release.Arch)).
-		Only(context.Background())
+		Only(ctx)
 
 	// First check if the release is in our database
 	if err != nil {
@@ -706,7 +687,9 @@ func (m *Model) SaveReleaseInfo(data *nats.AgentReport) error {
 		// Get release info from API
 		url := fmt.Sprintf("https://releases.openuem.eu/api?action=agentReleaseInfo&version=%s", data.Release.Version)
 
+		_, span := startClientSpan(ctx, "releases.agentReleaseInfo", semconv.URLFull(url))
 		body, err := utils.QueryReleasesEndpoint(url)
+		endSpan(span, err)
 		if err != nil {
 			return err
 		}
@@ -740,7 +723,7 @@ func (m *Model) SaveReleaseInfo(data *nats.AgentReport) error {
 			SetArch(data.Release.Arch).
 			SetOs(data.Release.Os).
 			AddAgentIDs(data.AgentID).
-			Save(context.Background())
+			Save(ctx)
 		if err != nil {
 			return err
 		}
@@ -756,19 +739,19 @@ func (m *Model) SaveReleaseInfo(data *nats.AgentReport) error {
 		// Finally connect the release with the agent if new, and disconnect from previous release
 		if newAgent {
 
-			existingAgent, err := m.Client.Agent.Query().WithRelease().Where(agent.ID(data.AgentID)).First(context.Background())
+			existingAgent, err := m.Client.Agent.Query().WithRelease().Where(agent.ID(data.AgentID)).First(ctx)
 			if err != nil {
 				return err
 			}
 
 			if existingAgent.Edges.Release != nil {
 				previousReleaseID := existingAgent.Edges.Release.ID
-				if err := m.Client.Release.UpdateOneID(previousReleaseID).RemoveAgentIDs(data.AgentID).Exec(context.Background()); err != nil {
+				if err := m.Client.Release.UpdateOneID(previousReleaseID).RemoveAgentIDs(data.AgentID).Exec(ctx); err != nil {
 					return err
 				}
 			}
 
-			if err := m.Client.Release.UpdateOneID(r.ID).AddAgentIDs(data.AgentID).Exec(context.Background()); err != nil {
+			if err := m.Client.Release.UpdateOneID(r.ID).AddAgentIDs(data.AgentID).Exec(ctx); err != nil {
 				return err
 			}
 		}
@@ -777,11 +760,11 @@ func (m *Model) SaveReleaseInfo(data *nats.AgentReport) error {
 	return nil
 }
 
-func (m *Model) SetAgentIsWaitingForAdmissionAgain(agentId string) error {
-	return m.Client.Agent.Update().SetAgentStatus(agent.AgentStatusWaitingForAdmission).Where(agent.ID(agentId)).Exec(context.Background())
+func (m *Model) SetAgentIsWaitingForAdmissionAgain(ctx context.Context, agentId string) error {
+	return m.Client.Agent.Update().SetAgentStatus(agent.AgentStatusWaitingForAdmission).Where(agent.ID(agentId)).Exec(ctx)
 }
 
-func checkIfRemote(data *nats.AgentReport, servers string) bool {
+func checkIfRemote(ctx context.Context, data *nats.AgentReport, servers string) bool {
 	// Check if agent's IP is IPv6 and ignore if it is
 	ip := net.ParseIP(data.IP)
 	if ip == nil {
@@ -803,7 +786,7 @@ func checkIfRemote(data *nats.AgentReport, servers string) bool {
 	domain := strings.Split(strings.Replace(serversHostnames[0], serverDomain[0], "", 1), ":")[0]
 
 	// Check if we can find the DNS record for the agent
-	addresses, err := net.LookupHost(strings.ToLower(data.Hostname) + domain)
+	addresses, err := net.DefaultResolver.LookupHost(ctx, strings.ToLower(data.Hostname)+domain)
 	if err != nil {
 		return false
 	}
@@ -812,9 +795,26 @@ func checkIfRemote(data *nats.AgentReport, servers string) bool {
 	return !slices.Contains(addresses, data.IP)
 }
 
-func (m *Model) GetTenantFromAgentID(request nats.RemoteConfigRequest) (int, error) {
+func (m *Model) AgentExists(ctx context.Context, agentID string) (bool, error) {
+	return m.Client.Agent.Query().Where(agent.ID(agentID)).Exist(ctx)
+}
+
+func (m *Model) GetAgent(ctx context.Context, agentID string) (*ent.Agent, error) {
+	return m.Client.Agent.Get(ctx, agentID)
+}
+
+// GetAgentWithSite returns the agent with its sites and their tenants
+func (m *Model) GetAgentWithSite(ctx context.Context, agentID string) (*ent.Agent, error) {
+	return m.Client.Agent.Query().WithSite(func(q *ent.SiteQuery) { q.WithTenant() }).Where(agent.ID(agentID)).Only(ctx)
+}
+
+func (m *Model) GetAgentWithNetbird(ctx context.Context, agentID string) (*ent.Agent, error) {
+	return m.Client.Agent.Query().WithNetbird().Where(agent.ID(agentID)).Only(ctx)
+}
+
+func (m *Model) GetTenantFromAgentID(ctx context.Context, request nats.RemoteConfigRequest) (int, error) {
 
-	a, err := m.Client.Agent.Query().WithSite().Where(agent.ID(request.AgentID)).Only(context.Background())
+	a, err := m.Client.Agent.Query().WithSite().Where(agent.ID(request.AgentID)).Only(ctx)
 	if err != nil {
 		if request.TenantID != "" {
 			return 0, err
@@ -827,7 +827,7 @@ func (m *Model) GetTenantFromAgentID(request nats.RemoteConfigRequest) (int, err
 		return 0, fmt.Errorf("the agent should belong to only one site")
 	}
 
-	s, err := m.Client.Site.Query().WithTenant().Where(site.ID(sites[0].ID)).Only(context.Background())
+	s, err := m.Client.Site.Query().WithTenant().Where(site.ID(sites[0].ID)).Only(ctx)
 	if err != nil {
 		return 0, err
 	}
@@ -840,23 +840,23 @@ func (m *Model) GetTenantFromAgentID(request nats.RemoteConfigRequest) (int, err
 	return t.ID, nil
 }
 
-func (m *Model) GetDefaultTenant() (*ent.Tenant, error) {
-	return m.Client.Tenant.Query().Where(tenant.IsDefault(true)).Only(context.Background())
+func (m *Model) GetDefaultTenant(ctx context.Context) (*ent.Tenant, error) {
+	return m.Client.Tenant.Query().Where(tenant.IsDefault(true)).Only(ctx)
 }
 
-func (m *Model) GetDefaultSite() (*ent.Site, error) {
-	t, err := m.GetDefaultTenant()
+func (m *Model) GetDefaultSite(ctx context.Context) (*ent.Site, error) {
+	t, err := m.GetDefaultTenant(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	return m.Client.Site.Query().Where(site.IsDefault(true), site.HasTenantWith(tenant.ID(t.ID))).Only(context.Background())
+	return m.Client.Site.Query().Where(site.IsDefault(true), site.HasTenantWith(tenant.ID(t.ID))).Only(ctx)
 }
 
-func (m *Model) ValidateTenantAndSite(tenantID, siteID int) (bool, error) {
-	return m.Client.Site.Query().Where(site.ID(siteID), site.HasTenantWith(tenant.ID(tenantID))).Exist(context.Background())
+func (m *Model) ValidateTenantAndSite(ctx context.Context, tenantID, siteID int) (bool, error) {
+	return m.Client.Site.Query().Where(site.ID(siteID), site.HasTenantWith(tenant.ID(tenantID))).Exist(ctx)
 }
 
-func (m *Model) GetAgentApps(agentId string) ([]*ent.App, error) {
-	return m.Client.App.Query().Where(app.HasOwnerWith(agent.ID(agentId), agent.AgentStatusNEQ(agent.AgentStatusWaitingForAdmission))).All(context.Background())
+func (m *Model) GetAgentApps(ctx context.Context, agentId string) ([]*ent.App, error) {
+	return m.Client.App.Query().Where(app.HasOwnerWith(agent.ID(agentId), agent.AgentStatusNEQ(agent.AgentStatusWaitingForAdmission))).All(ctx)
 }
@@ -9,19 +9,19 @@ import (
 	"golang.org/x/crypto/ocsp"
 )
 
-func (m *Model) SaveCertificate(serial int64, certType certificate.Type, uid, description string, expiry time.Time) error {
+func (m *Model) SaveCertificate(ctx context.Context, serial int64, certType certificate.Type, uid, description string, expiry time.Time) error {
 
 	if uid != "" {
-		_, err := m.Client.Certificate.Create().SetID(serial).SetType(certType).SetDescription(description).SetExpiry(expiry).SetUID(uid).Save(context.Background())
+		_, err := m.Client.Certificate.Create().SetID(serial).SetType(certType).SetDescription(description).SetExpiry(expiry).SetUID(uid).Save(ctx)
 		if err != nil {
 			return err
 		}
 
-		if _, err := m.Client.User.UpdateOneID(uid).SetExpiry(expiry).Save(context.Background()); err != nil {
+		if _, err := m.Client.User.UpdateOneID(uid).SetExpiry(expiry).Save(ctx); err != nil {
 			return err
 		}
 	} else {
-		_, err := m.Client.Certificate.Create().SetID(serial).SetType(certType).SetDescription(description).SetExpiry(expiry).Save(context.Background())
+		_, err := m.Client.Certificate.Create().SetID(serial).SetType(certType).SetDescription(description).SetExpiry(expiry).Save(ctx)
 		if err != nil {
 			return err
 		}
@@ -30,8 +30,8 @@ func (m *Model) SaveCertificate(serial int64, certType certificate.Type, uid, de
 	return nil
 }
 
-func (m *Model) RevokePreviousCertificates(description string) error {
-	cert, err := m.Client.Certificate.Query().Where(certificate.DescriptionEQ(description)).Only(context.Background())
+func (m *Model) RevokePreviousCertificates(ctx context.Context, description string) error {
+	cert, err := m.Client.Certificate.Query().Where(certificate.DescriptionEQ(description)).Only(ctx)
 	if err != nil {
 		if ent.IsNotFound(err) {
 			return nil
@@ -39,9 +39,9 @@ func (m *Model) RevokePreviousCertificates(description string) error {
 		return err
 	}
 
-	if err := m.Client.Certificate.DeleteOneID(cert.ID).Exec(context.Background()); err != nil {
+	if err := m.Client.Certificate.DeleteOneID(cert.ID).Exec(ctx); err != nil {
 		return err
 	}
 
-	return m.AddRevocation(cert.ID, ocsp.Superseded, "new certificate requested from console", cert.Expiry)
+	return m.AddRevocation(ctx, cert.ID, ocsp.Superseded, "new certificate requested from console", cert.Expiry)
 }
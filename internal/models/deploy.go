@@ -2,7 +2,7 @@ package models
 
 import (
 	"context"
-	"log"
+	"log/slog"
 	"strings"
 
 	"github.com/open-uem/ent/agent"
@@ -11,8 +11,8 @@ import (
 	"github.com/open-uem/nats"
 )
 
-func (m *Model) SaveDeployInfo(data *nats.DeployAction) error {
-	exists, err := m.Client.Deployment.Query().Where(deployment.And(deployment.PackageID(data.PackageId), deployment.HasOwnerWith(agent.ID(data.AgentId)))).Exist(context.Background())
+func (m *Model) SaveDeployInfo(ctx context.Context, data *nats.DeployAction) error {
+	exists, err := m.Client.Deployment.Query().Where(deployment.And(deployment.PackageID(data.PackageId), deployment.HasOwnerWith(agent.ID(data.AgentId)))).Exist(ctx)
 	if err != nil {
 		return err
 	}
@@ -37,7 +37,7 @@ func (m *Model) SaveDeployInfo(data *nats.DeployAction) error {
 				query.SetVerified(data.PackageVerified)
 			}
 
-			return query.Where(deployment.And(deployment.PackageID(data.PackageId), deployment.HasOwnerWith(agent.ID(data.AgentId)))).Exec(context.Background())
+			return query.Where(deployment.And(deployment.PackageID(data.PackageId), deployment.HasOwnerWith(agent.ID(data.AgentId)))).Exec(ctx)
 		} else {
 			query := m.Client.Deployment.Create().
 				SetName(data.PackageName).
@@ -60,7 +60,7 @@ func (m *Model) SaveDeployInfo(data *nats.DeployAction) error {
 				query.SetVerified(data.PackageVerified)
 			}
 
-			return query.Exec(context.Background())
+			return query.Exec(ctx)
 		}
 	}
 
@@ -84,7 +84,7 @@ func (m *Model) SaveDeployInfo(data *nats.DeployAction) error {
 
 			return query.
 				Where(deployment.And(deployment.PackageID(data.PackageId), deployment.HasOwnerWith(agent.ID(data.AgentId)))).
-				Exec(context.Background())
+				Exec(ctx)
 		} else {
 			query := m.Client.Deployment.Update().
 				SetName(data.PackageName).
@@ -108,13 +108,13 @@ func (m *Model) SaveDeployInfo(data *nats.DeployAction) error {
 
 			return query.
 				Where(deployment.And(deployment.PackageID(data.PackageId), deployment.HasOwnerWith(agent.ID(data.AgentId)))).
-				Exec(context.Background())
+				Exec(ctx)
 		}
 	}
 
 	if data.Action == "uninstall" {
 		if exists {
-			d, err := m.Client.Deployment.Query().Where(deployment.And(deployment.PackageID(data.PackageId), deployment.HasOwnerWith(agent.ID(data.AgentId)))).Only(context.Background())
+			d, err := m.Client.Deployment.Query().Where(deployment.And(deployment.PackageID(data.PackageId), deployment.HasOwnerWith(agent.ID(data.AgentId)))).Only(ctx)
 			if err != nil {
 				return err
 			}
@@ -138,18 +138,18 @@ func (m *Model) SaveDeployInfo(data *nats.DeployAction) error {
 
 				return query.
 					Where(deployment.And(deployment.PackageID(data.PackageId), deployment.HasOwnerWith(agent.ID(data.AgentId)))).
-					Exec(context.Background())
+					Exec(ctx)
 			} else {
 				_, err = m.Client.Deployment.Delete().
 					Where(deployment.And(deployment.PackageID(data.PackageId), deployment.HasOwnerWith(agent.ID(data.AgentId)))).
-					Exec(context.Background())
+					Exec(ctx)
 				if err != nil {
 					return err
 				}
 
 				// If package was installed due to a profile, add a new exclusion as we've removed it using OpenUEM Console
 				if d.ByProfile {
-					return m.Client.WingetConfigExclusion.Create().SetPackageID(data.PackageId).SetOwnerID(data.AgentId).Exec(context.Background())
+					return m.Client.WingetConfigExclusion.Create().SetPackageID(data.PackageId).SetOwnerID(data.AgentId).Exec(ctx)
 				}
 			}
 		}
@@ -158,9 +158,9 @@ func (m *Model) SaveDeployInfo(data *nats.DeployAction) error {
 	return nil
 }
 
-func (m *Model) SaveWinGetDeployInfo(data nats.DeployAction) error {
+func (m *Model) SaveWinGetDeployInfo(ctx context.Context, data nats.DeployAction) error {
 
-	exists, err := m.Client.Deployment.Query().Where(deployment.PackageID(data.PackageId), deployment.HasOwnerWith(agent.ID(data.AgentId))).Exist(context.Background())
+	exists, err := m.Client.Deployment.Query().Where(deployment.PackageID(data.PackageId), deployment.HasOwnerWith(agent.ID(data.AgentId))).Exist(ctx)
 	if err != nil {
 		return err
 	}
@@ -174,20 +174,20 @@ func (m *Model) SaveWinGetDeployInfo(data nats.DeployAction) error {
 				SetInstalled(data.When).
 				SetUpdated(data.When).
 				SetByProfile(true).
-				Exec(context.Background())
+				Exec(ctx)
 		}
 	} else {
 		if data.Action == "update" {
 			return m.Client.Deployment.Update().
 				SetUpdated(data.When).
 				Where(deployment.And(deployment.PackageID(data.PackageId), deployment.HasOwnerWith(agent.ID(data.AgentId)))).
-				Exec(context.Background())
+				Exec(ctx)
 		}
 
 		if data.Action == "uninstall" {
 			_, err := m.Client.Deployment.Delete().
 				Where(deployment.And(deployment.PackageID(data.PackageId), deployment.HasOwnerWith(agent.ID(data.AgentId)))).
-				Exec(context.Background())
+				Exec(ctx)
 			if err != nil {
 				return err
 			}
@@ -197,9 +197,9 @@ func (m *Model) SaveWinGetDeployInfo(data nats.DeployAction) error {
 	return nil
 }
 
-func (m *Model) SaveFlatpakOrBrewDeployInfo(data nats.DeployAction) error {
+func (m *Model) SaveFlatpakOrBrewDeployInfo(ctx context.Context, data nats.DeployAction) error {
 
-	exists, err := m.Client.Deployment.Query().Where(deployment.PackageID(data.PackageId), deployment.HasOwnerWith(agent.ID(data.AgentId))).Exist(context.Background())
+	exists, err := m.Client.Deployment.Query().Where(deployment.PackageID(data.PackageId), deployment.HasOwnerWith(agent.ID(data.AgentId))).Exist(ctx)
 	if err != nil {
 		return err
 	}
@@ -226,7 +226,7 @@ func (m *Model) SaveFlatpakOrBrewDeployInfo(data nats.DeployAction) error {
 				query.SetVerified(data.PackageVerified)
 			}
 
-			return query.Exec(context.Background())
+			return query.Exec(ctx)
 		}
 	} else {
 		if data.Action == "update" {
@@ -246,13 +246,13 @@ func (m *Model) SaveFlatpakOrBrewDeployInfo(data nats.DeployAction) error {
 				query.SetVerified(data.PackageVerified)
 			}
 
-			return query.Exec(context.Background())
+			return query.Exec(ctx)
 		}
 
 		if data.Action == "uninstall" {
 			_, err := m.Client.Deployment.Delete().
 				Where(deployment.And(deployment.PackageID(data.PackageId), deployment.HasOwnerWith(agent.ID(data.AgentId)))).
-				Exec(context.Background())
+				Exec(ctx)
 			if err != nil {
 				return err
 			}
@@ -262,31 +262,31 @@ func (m *Model) SaveFlatpakOrBrewDeployInfo(data nats.DeployAction) error {
 	return nil
 }
 
-func (m *Model) GetDeployedPackages(agentID string) ([]string, error) {
-	return m.Client.Deployment.Query().Where(deployment.HasOwnerWith(agent.ID(agentID))).Select(wingetconfigexclusion.FieldPackageID).Strings(context.Background())
+func (m *Model) GetDeployedPackages(ctx context.Context, agentID string) ([]string, error) {
+	return m.Client.Deployment.Query().Where(deployment.HasOwnerWith(agent.ID(agentID))).Select(wingetconfigexclusion.FieldPackageID).Strings(ctx)
 }
 
-// func (m *Model) GetDeployedPackages(agentID string) ([]*ent.Deployment, error) {
-// 	return m.Client.Deployment.Query().Where(deployment.HasOwnerWith(agent.ID(agentID))).All(context.Background())
+// func (m *Model) GetDeployedPackages(ctx context.Context, agentID string) ([]*ent.Deployment, error) {
+// 	return m.Client.Deployment.Query().Where(deployment.HasOwnerWith(agent.ID(agentID))).All(ctx)
 // }
 
-func (m *Model) GetExcludedWinGetPackages(agentID string) ([]string, error) {
-	return m.Client.WingetConfigExclusion.Query().Where(wingetconfigexclusion.HasOwnerWith(agent.ID(agentID))).Select(wingetconfigexclusion.FieldPackageID).Strings(context.Background())
+func (m *Model) GetExcludedWinGetPackages(ctx context.Context, agentID string) ([]string, error) {
+	return m.Client.WingetConfigExclusion.Query().Where(wingetconfigexclusion.HasOwnerWith(agent.ID(agentID))).Select(wingetconfigexclusion.FieldPackageID).Strings(ctx)
 }
 
-func (m *Model) MarkPackageAsExcluded(data nats.DeployAction) error {
-	_, err := m.Client.Deployment.Delete().Where(deployment.PackageID(data.PackageId), deployment.HasOwnerWith(agent.ID(data.AgentId))).Exec(context.Background())
+func (m *Model) MarkPackageAsExcluded(ctx context.Context, data nats.DeployAction) error {
+	_, err := m.Client.Deployment.Delete().Where(deployment.PackageID(data.PackageId), deployment.HasOwnerWith(agent.ID(data.AgentId))).Exec(ctx)
 	if err != nil {
-		log.Printf("[ERROR]: could not delete entry for package %s and agent %s", data.PackageId, data.AgentId)
+		slog.Error("could not delete entry for package", "package_id", data.PackageId, "agent_id", data.AgentId, "error", err)
 	}
 
-	exists, err := m.Client.WingetConfigExclusion.Query().Where(wingetconfigexclusion.PackageID(data.PackageId), wingetconfigexclusion.HasOwnerWith(agent.ID(data.AgentId))).Exist(context.Background())
+	exists, err := m.Client.WingetConfigExclusion.Query().Where(wingetconfigexclusion.PackageID(data.PackageId), wingetconfigexclusion.HasOwnerWith(agent.ID(data.AgentId))).Exist(ctx)
 	if err != nil {
-		log.Printf("[ERROR]: could not check if  entry for package %s and agent %s", data.PackageId, data.AgentId)
+		slog.Error("could not check if entry for package exists", "package_id", data.PackageId, "agent_id", data.AgentId, "error", err)
 	}
 
 	if !exists {
-		return m.Client.WingetConfigExclusion.Create().SetPackageID(data.PackageId).SetOwnerID(data.AgentId).Exec(context.Background())
+		return m.Client.WingetConfigExclusion.Create().SetPackageID(data.PackageId).SetOwnerID(data.AgentId).Exec(ctx)
 	}
 
 	return nil
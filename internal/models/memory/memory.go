@@ -0,0 +1,618 @@
+// Package memory implements models.Store with maps so the workers' handlers can be
+// run with an embedded NATS server and no database
+package memory
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/open-uem/ent"
+	"github.com/open-uem/ent/agent"
+	"github.com/open-uem/ent/certificate"
+	"github.com/open-uem/nats"
+	"github.com/open-uem/openuem-worker/internal/models"
+)
+
+// Certificate is a certificate saved by the cert-manager worker
+type Certificate struct {
+	Serial      int64
+	Type        certificate.Type
+	UID         string
+	Description string
+	Expiry      time.Time
+}
+
+// Store keeps the data in memory, the zero value is not usable, use New
+type Store struct {
+	mu sync.Mutex
+
+	agents          map[string]*ent.Agent
+	reports         map[string]nats.AgentReport
+	settings        map[string]*ent.Settings
+	netbirdSettings map[int]*ent.NetbirdSettings
+
+	profilesAppliedToAll   map[int][]*ent.Profile
+	profilesAppliedToAgent map[string][]*ent.Profile
+	profileIssues          []nats.ProfileReport
+
+	deployments []nats.DeployAction
+	excluded    map[string][]string
+
+	certificates     map[int64]Certificate
+	revoked          []int64
+	certificatesSent map[string]bool
+	emailsVerified   map[string]bool
+
+	err        error
+	methodErrs map[string]error
+}
+
+var _ models.Store = (*Store)(nil)
+
+func New() *Store {
+	return &Store{
+		agents:                 map[string]*ent.Agent{},
+		reports:                map[string]nats.AgentReport{},
+		settings:               map[string]*ent.Settings{},
+		netbirdSettings:        map[int]*ent.NetbirdSettings{},
+		profilesAppliedToAll:   map[int][]*ent.Profile{},
+		profilesAppliedToAgent: map[string][]*ent.Profile{},
+		excluded:               map[string][]string{},
+		certificates:           map[int64]Certificate{},
+		certificatesSent:       map[string]bool{},
+		emailsVerified:         map[string]bool{},
+		methodErrs:             map[string]error{},
+	}
+}
+
+// AddAgent adds an agent that belongs to the site and the tenant
+func (s *Store) AddAgent(a *ent.Agent, siteID, tenantID int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a.Edges.Site = []*ent.Site{{ID: siteID, Edges: ent.SiteEdges{Tenant: &ent.Tenant{ID: tenantID}}}}
+	s.agents[a.ID] = a
+}
+
+// SetSettings sets the settings of the tenant, the general settings have an empty tenant
+func (s *Store) SetSettings(tenant string, settings *ent.Settings) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.settings[tenant] = settings
+}
+
+func (s *Store) SetNetbirdSettings(tenantID int, settings *ent.NetbirdSettings) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.netbirdSettings[tenantID] = settings
+}
+
+// AddProfile applies the profile to every agent of the site or, if agentID is set, to that agent
+func (s *Store) AddProfile(siteID int, agentID string, p *ent.Profile) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if agentID == "" {
+		s.profilesAppliedToAll[siteID] = append(s.profilesAppliedToAll[siteID], p)
+		return
+	}
+	s.profilesAppliedToAgent[agentID] = append(s.profilesAppliedToAgent[agentID], p)
+}
+
+// FailWith makes every method return the error, nil restores the normal behavior
+func (s *Store) FailWith(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+// FailMethodWith makes the method that saves a section of the agent reports e.g (SaveReleaseInfo)
+// return the error, nil restores its normal behavior
+func (s *Store) FailMethodWith(method string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.methodErrs[method] = err
+}
+
+// Report returns the last report saved for the agent
+func (s *Store) Report(agentID string) (nats.AgentReport, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.reports[agentID]
+	return r, ok
+}
+
+func (s *Store) Deployments() []nats.DeployAction {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.deployments)
+}
+
+func (s *Store) ProfileIssues() []nats.ProfileReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.profileIssues)
+}
+
+func (s *Store) Certificates() []Certificate {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	certs := []Certificate{}
+	for _, serial := range slices.Sorted(maps.Keys(s.certificates)) {
+		certs = append(certs, s.certificates[serial])
+	}
+	return certs
+}
+
+func (s *Store) Revoked() []int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.revoked)
+}
+
+// Inventory
+
+func (s *Store) AgentExists(_ context.Context, agentID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return false, s.err
+	}
+	_, ok := s.agents[agentID]
+	return ok, nil
+}
+
+func (s *Store) GetAgent(_ context.Context, agentID string) (*ent.Agent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.agent(agentID)
+}
+
+func (s *Store) GetAgentWithSite(ctx context.Context, agentID string) (*ent.Agent, error) {
+	return s.GetAgent(ctx, agentID)
+}
+
+func (s *Store) GetAgentWithNetbird(ctx context.Context, agentID string) (*ent.Agent, error) {
+	return s.GetAgent(ctx, agentID)
+}
+
+func (s *Store) GetTenantFromAgentID(_ context.Context, request nats.RemoteConfigRequest) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tenant(request)
+}
+
+// SaveAgentInfo adds the agent if it doesn't exist, new agents wait for admission unless they're admitted automatically
+func (s *Store) SaveAgentInfo(_ context.Context, data *nats.AgentReport, _ string, autoAdmitAgents bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+
+	a, ok := s.agents[data.AgentID]
+	if !ok {
+		a = &ent.Agent{ID: data.AgentID, FirstContact: time.Now(), AgentStatus: agent.AgentStatusWaitingForAdmission}
+		if autoAdmitAgents {
+			a.AgentStatus = agent.AgentStatusEnabled
+		}
+		s.agents[data.AgentID] = a
+	}
+	a.Os = data.OS
+	a.Hostname = data.Hostname
+	a.IP = data.IP
+	a.MAC = data.MACAddress
+	a.Wan = data.WAN
+	a.DebugMode = data.DebugMode
+	a.LastContact = time.Now()
+
+	s.reports[data.AgentID] = *data
+	return nil
+}
+
+func (s *Store) SaveComputerInfo(ctx context.Context, data *nats.AgentReport) error {
+	return s.saveReport("SaveComputerInfo", data)
+}
+
+func (s *Store) SaveOSInfo(ctx context.Context, data *nats.AgentReport) error {
+	return s.saveReport("SaveOSInfo", data)
+}
+
+func (s *Store) SaveAntivirusInfo(ctx context.Context, data *nats.AgentReport) error {
+	return s.saveReport("SaveAntivirusInfo", data)
+}
+
+func (s *Store) SaveSystemUpdateInfo(ctx context.Context, data *nats.AgentReport) error {
+	return s.saveReport("SaveSystemUpdateInfo", data)
+}
+
+func (s *Store) SaveAppsInfo(ctx context.Context, data *nats.AgentReport) error {
+	return s.saveReport("SaveAppsInfo", data)
+}
+
+func (s *Store) SaveMonitorsInfo(ctx context.Context, data *nats.AgentReport) error {
+	return s.saveReport("SaveMonitorsInfo", data)
+}
+
+func (s *Store) SaveMemorySlotsInfo(ctx context.Context, data *nats.AgentReport) error {
+	return s.saveReport("SaveMemorySlotsInfo", data)
+}
+
+func (s *Store) SaveLogicalDisksInfo(ctx context.Context, data *nats.AgentReport) error {
+	return s.saveReport("SaveLogicalDisksInfo", data)
+}
+
+func (s *Store) SavePhysicalDisksInfo(ctx context.Context, data *nats.AgentReport) error {
+	return s.saveReport("SavePhysicalDisksInfo", data)
+}
+
+func (s *Store) SavePrintersInfo(ctx context.Context, data *nats.AgentReport) error {
+	return s.saveReport("SavePrintersInfo", data)
+}
+
+func (s *Store) SaveNetworkAdaptersInfo(ctx context.Context, data *nats.AgentReport) error {
+	return s.saveReport("SaveNetworkAdaptersInfo", data)
+}
+
+func (s *Store) SaveSharesInfo(ctx context.Context, data *nats.AgentReport) error {
+	return s.saveReport("SaveSharesInfo", data)
+}
+
+func (s *Store) SaveUpdatesInfo(ctx context.Context, data *nats.AgentReport) error {
+	return s.saveReport("SaveUpdatesInfo", data)
+}
+
+func (s *Store) SaveReleaseInfo(ctx context.Context, data *nats.AgentReport) error {
+	return s.saveReport("SaveReleaseInfo", data)
+}
+
+func (s *Store) SaveNetbirdInfo(ctx context.Context, data *nats.AgentReport) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+
+	a, err := s.agent(data.AgentID)
+	if err != nil {
+		return err
+	}
+	a.Edges.Netbird = &ent.Netbird{Version: data.Netbird.Version, Installed: data.Netbird.Installed, IP: data.Netbird.IP}
+	s.reports[data.AgentID] = *data
+	return nil
+}
+
+// Deployments
+
+func (s *Store) SaveDeployInfo(_ context.Context, data *nats.DeployAction) error {
+	return s.saveDeployment(*data)
+}
+
+func (s *Store) SaveWinGetDeployInfo(_ context.Context, data nats.DeployAction) error {
+	return s.saveDeployment(data)
+}
+
+// GetDeployedPackages returns the packages installed and not removed afterwards
+func (s *Store) GetDeployedPackages(_ context.Context, agentID string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	packages := []string{}
+	for _, d := range s.deployments {
+		if d.AgentId != agentID || d.Failed {
+			continue
+		}
+		switch d.Action {
+		case "install":
+			if !slices.Contains(packages, d.PackageId) {
+				packages = append(packages, d.PackageId)
+			}
+		case "uninstall":
+			packages = slices.DeleteFunc(packages, func(p string) bool { return p == d.PackageId })
+		}
+	}
+	return packages, nil
+}
+
+func (s *Store) GetExcludedWinGetPackages(_ context.Context, agentID string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return nil, s.err
+	}
+	return slices.Clone(s.excluded[agentID]), nil
+}
+
+func (s *Store) MarkPackageAsExcluded(_ context.Context, data nats.DeployAction) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.deployments = slices.DeleteFunc(s.deployments, func(d nats.DeployAction) bool {
+		return d.AgentId == data.AgentId && d.PackageId == data.PackageId
+	})
+	if !slices.Contains(s.excluded[data.AgentId], data.PackageId) {
+		s.excluded[data.AgentId] = append(s.excluded[data.AgentId], data.PackageId)
+	}
+	return nil
+}
+
+// Profiles
+
+func (s *Store) GetProfilesAppliedToAll(_ context.Context, siteID int, _ int) ([]*ent.Profile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return nil, s.err
+	}
+	return slices.Clone(s.profilesAppliedToAll[siteID]), nil
+}
+
+func (s *Store) GetProfilesAppliedToAllFilteredByProfile(ctx context.Context, siteID int, profileID int) ([]*ent.Profile, error) {
+	profiles, err := s.GetProfilesAppliedToAll(ctx, siteID, 0)
+	return filterProfile(profiles, profileID), err
+}
+
+func (s *Store) GetProfilesAppliedToAgent(_ context.Context, _ int, agentID string, _ int) ([]*ent.Profile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return nil, s.err
+	}
+	return slices.Clone(s.profilesAppliedToAgent[agentID]), nil
+}
+
+func (s *Store) GetProfilesAppliedToAgentFilteredByProfile(ctx context.Context, siteID int, agentID string, profileID int) ([]*ent.Profile, error) {
+	profiles, err := s.GetProfilesAppliedToAgent(ctx, siteID, agentID, 0)
+	return filterProfile(profiles, profileID), err
+}
+
+func (s *Store) SaveProfileApplicationIssues(_ context.Context, p nats.ProfileReport) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.profileIssues = append(s.profileIssues, p)
+	return nil
+}
+
+// Certificates
+
+func (s *Store) SaveCertificate(_ context.Context, serial int64, certType certificate.Type, uid, description string, expiry time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.certificates[serial] = Certificate{Serial: serial, Type: certType, UID: uid, Description: description, Expiry: expiry}
+	return nil
+}
+
+func (s *Store) RevokePreviousCertificates(_ context.Context, description string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	for serial, c := range s.certificates {
+		if c.Description == description {
+			delete(s.certificates, serial)
+			s.revoked = append(s.revoked, serial)
+		}
+	}
+	return nil
+}
+
+func (s *Store) SetCertificateSent(_ context.Context, uid string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.certificatesSent[uid] = true
+	return nil
+}
+
+func (s *Store) SetEmailVerified(_ context.Context, uid string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.emailsVerified[uid] = true
+	return nil
+}
+
+// Settings
+
+// GetSettings returns the settings of the tenant or the general settings if the tenant has none
+func (s *Store) GetSettings(_ context.Context, t string) (*ent.Settings, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tenantSettings(t)
+}
+
+func (s *Store) GetSMTPSettings(ctx context.Context) (*ent.Settings, error) {
+	return s.GetSettings(ctx, "")
+}
+
+func (s *Store) GetNetbirdSettings(_ context.Context, tenantID int) (*ent.NetbirdSettings, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return nil, s.err
+	}
+	ns, ok := s.netbirdSettings[tenantID]
+	if !ok {
+		return nil, &ent.NotFoundError{}
+	}
+	return ns, nil
+}
+
+func (s *Store) GetDefaultAgentFrequency(_ context.Context, request nats.RemoteConfigRequest) (int, error) {
+	settings, err := s.requestSettings(request)
+	if err != nil {
+		return 0, err
+	}
+	return settings.AgentReportFrequenceInMinutes, nil
+}
+
+func (s *Store) GetWingetFrequency(_ context.Context, request nats.RemoteConfigRequest) (int, error) {
+	settings, err := s.requestSettings(request)
+	if err != nil {
+		return 0, err
+	}
+	return settings.ProfilesApplicationFrequenceInMinutes, nil
+}
+
+func (s *Store) GetSFTPAgentSetting(_ context.Context, request nats.RemoteConfigRequest) (bool, error) {
+	s.mu.Lock()
+	if a, ok := s.agents[request.AgentID]; ok && s.err == nil {
+		s.mu.Unlock()
+		return a.SftpService, nil
+	}
+	s.mu.Unlock()
+
+	settings, err := s.requestSettings(request)
+	if err != nil {
+		return false, err
+	}
+	return !settings.DisableSftp, nil
+}
+
+func (s *Store) SaveSFTPAgentSetting(_ context.Context, request nats.RemoteConfigRequest, status bool) error {
+	return s.updateAgent(request.AgentID, func(a *ent.Agent) { a.SftpService = status })
+}
+
+func (s *Store) GetRemoteAssistanceAgentSetting(_ context.Context, request nats.RemoteConfigRequest) (bool, error) {
+	s.mu.Lock()
+	if a, ok := s.agents[request.AgentID]; ok && s.err == nil {
+		s.mu.Unlock()
+		return a.RemoteAssistance, nil
+	}
+	s.mu.Unlock()
+
+	settings, err := s.requestSettings(request)
+	if err != nil {
+		return false, err
+	}
+	return !settings.DisableRemoteAssistance, nil
+}
+
+func (s *Store) SaveRemoteAssistanceAgentSetting(_ context.Context, request nats.RemoteConfigRequest, status bool) error {
+	return s.updateAgent(request.AgentID, func(a *ent.Agent) { a.RemoteAssistance = status })
+}
+
+// Connection
+
+func (s *Store) Ping(_ context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *Store) SetPool(_ models.PoolConfig) {}
+
+func (s *Store) Close() {}
+
+// agent must be called with the lock held
+func (s *Store) agent(agentID string) (*ent.Agent, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	a, ok := s.agents[agentID]
+	if !ok {
+		return nil, &ent.NotFoundError{}
+	}
+	return a, nil
+}
+
+// tenant returns the tenant of the agent's site or the tenant of the request if the agent doesn't exist,
+// it must be called with the lock held
+func (s *Store) tenant(request nats.RemoteConfigRequest) (int, error) {
+	a, err := s.agent(request.AgentID)
+	if err != nil {
+		if ent.IsNotFound(err) && request.TenantID != "" {
+			return strconv.Atoi(request.TenantID)
+		}
+		return 0, err
+	}
+	if len(a.Edges.Site) != 1 || a.Edges.Site[0].Edges.Tenant == nil {
+		return 0, &ent.NotFoundError{}
+	}
+	return a.Edges.Site[0].Edges.Tenant.ID, nil
+}
+
+// tenantSettings must be called with the lock held
+func (s *Store) tenantSettings(t string) (*ent.Settings, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	if settings, ok := s.settings[t]; ok {
+		return settings, nil
+	}
+	if settings, ok := s.settings[""]; ok {
+		return settings, nil
+	}
+	return nil, &ent.NotFoundError{}
+}
+
+func (s *Store) requestSettings(request nats.RemoteConfigRequest) (*ent.Settings, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	tenantID, err := s.tenant(request)
+	if err != nil {
+		return s.tenantSettings("")
+	}
+	return s.tenantSettings(strconv.Itoa(tenantID))
+}
+
+func (s *Store) updateAgent(agentID string, update func(*ent.Agent)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, err := s.agent(agentID)
+	if err != nil {
+		return err
+	}
+	update(a)
+	return nil
+}
+
+func (s *Store) saveReport(method string, data *nats.AgentReport) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.methodErrs[method]; err != nil {
+		return err
+	}
+	if _, err := s.agent(data.AgentID); err != nil {
+		return err
+	}
+	s.reports[data.AgentID] = *data
+	return nil
+}
+
+func (s *Store) saveDeployment(data nats.DeployAction) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.deployments = append(s.deployments, data)
+	return nil
+}
+
+func filterProfile(profiles []*ent.Profile, profileID int) []*ent.Profile {
+	return slices.DeleteFunc(profiles, func(p *ent.Profile) bool { return p.ID != profileID })
+}
@@ -0,0 +1,160 @@
+package models
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	atlas "ariga.io/atlas/sql/schema"
+	"entgo.io/ent/dialect/sql/schema"
+	"github.com/open-uem/ent/migrate"
+)
+
+// migrationLockID is the key of the Postgres advisory lock held while the schema is migrated
+const migrationLockID int64 = 0x6f70656e75656d
+
+const DefaultMigrationLockTimeout = time.Minute
+
+var ErrMigrationLocked = errors.New("another process is migrating the database schema")
+
+// MigrateOptions sets which destructive changes are allowed, columns and indexes that
+// are no longer in the schema are kept unless their drop is allowed explicitly
+type MigrateOptions struct {
+	DropColumns bool
+	DropIndexes bool
+	LockTimeout time.Duration
+}
+
+// schemaOptions lets ent plan every drop and removes the drops that haven't been
+// allowed in a diff hook, they're added to skipped
+func (o MigrateOptions) schemaOptions(skipped *[]string) []schema.MigrateOption {
+	return []schema.MigrateOption{
+		migrate.WithDropColumn(true),
+		migrate.WithDropIndex(true),
+		schema.WithDiffHook(o.skipDrops(skipped)),
+	}
+}
+
+// skipDrops removes the column and index drops that haven't been allowed from the tables' changes
+func (o MigrateOptions) skipDrops(skipped *[]string) schema.DiffHook {
+	return func(next schema.Differ) schema.Differ {
+		return schema.DiffFunc(func(current, desired *atlas.Schema) ([]atlas.Change, error) {
+			changes, err := next.Diff(current, desired)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, c := range changes {
+				table, ok := c.(*atlas.ModifyTable)
+				if !ok {
+					continue
+				}
+				table.Changes = slices.DeleteFunc(table.Changes, func(c atlas.Change) bool {
+					switch c := c.(type) {
+					case *atlas.DropColumn:
+						if !o.DropColumns {
+							*skipped = append(*skipped, fmt.Sprintf("ALTER TABLE %q DROP COLUMN %q", table.T.Name, c.C.Name))
+							return true
+						}
+					case *atlas.DropIndex:
+						if !o.DropIndexes {
+							*skipped = append(*skipped, fmt.Sprintf("DROP INDEX %q", c.I.Name))
+							return true
+						}
+					}
+					return false
+				})
+			}
+			return changes, nil
+		})
+	}
+}
+
+// MigrationPlan contains the statements that would be run to migrate the schema
+// and the drop statements that are skipped because they haven't been allowed
+type MigrationPlan struct {
+	Statements []string
+	Skipped    []string
+}
+
+// PlanMigration returns the statements that Migrate would run with the same options
+func (m *Model) PlanMigration(ctx context.Context, opts MigrateOptions) (*MigrationPlan, error) {
+	plan := MigrationPlan{}
+
+	var b strings.Builder
+	if err := m.Client.Schema.WriteTo(ctx, &b, opts.schemaOptions(&plan.Skipped)...); err != nil {
+		return nil, err
+	}
+
+	for line := range strings.SplitSeq(b.String(), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			plan.Statements = append(plan.Statements, line)
+		}
+	}
+	return &plan, nil
+}
+
+// Migrate applies the schema changes, an advisory lock prevents two processes
+// from migrating the schema at the same time
+func (m *Model) Migrate(ctx context.Context, opts MigrateOptions) error {
+	unlock, err := m.lockMigrations(ctx, opts.LockTimeout)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	skipped := []string{}
+	return m.Client.Schema.Create(ctx, opts.schemaOptions(&skipped)...)
+}
+
+// lockMigrations waits for the migration advisory lock, the lock is held by a dedicated
+// connection that's discarded if the lock can't be released
+func (m *Model) lockMigrations(ctx context.Context, timeout time.Duration) (func(), error) {
+	if timeout <= 0 {
+		timeout = DefaultMigrationLockTimeout
+	}
+
+	conn, err := m.DB.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		locked := false
+		if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", migrationLockID).Scan(&locked); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if locked {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			conn.Close()
+			return nil, ErrMigrationLocked
+		}
+
+		slog.Info("waiting for another process to finish the database schema migration")
+		select {
+		case <-ctx.Done():
+			conn.Close()
+			return nil, ctx.Err()
+		case <-time.After(2 * time.Second):
+		}
+	}
+
+	return func() {
+		if _, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLockID); err != nil {
+			slog.Error("could not release the migration lock, the connection will be closed", "error", err)
+			// the session lock is released when Postgres closes the connection
+			_ = conn.Raw(func(any) error { return driver.ErrBadConn })
+		}
+		conn.Close()
+	}, nil
+}
@@ -4,20 +4,36 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
-	"os"
+	"time"
 
 	"entgo.io/ent/dialect"
 	entsql "entgo.io/ent/dialect/sql"
 	_ "github.com/jackc/pgx/v5/stdlib"
 	ent "github.com/open-uem/ent"
-	"github.com/open-uem/ent/migrate"
 )
 
 type Model struct {
 	Client *ent.Client
+	DB     *sql.DB
 }
 
-func New(dbUrl string) (*Model, error) {
+type PoolConfig struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+}
+
+func DefaultPoolConfig() PoolConfig {
+	return PoolConfig{
+		MaxOpenConns:    10,
+		MaxIdleConns:    5,
+		ConnMaxLifetime: 30 * time.Minute,
+		ConnMaxIdleTime: 5 * time.Minute,
+	}
+}
+
+func New(ctx context.Context, dbUrl string, pool PoolConfig) (*Model, error) {
 	model := Model{}
 
 	db, err := sql.Open("pgx", dbUrl)
@@ -25,21 +41,36 @@ func New(dbUrl string) (*Model, error) {
 		return nil, fmt.Errorf("could not connect with Postgres database: %v", err)
 	}
 
-	model.Client = ent.NewClient(ent.Driver(entsql.OpenDB(dialect.Postgres, db)))
+	setPool(db, pool)
 
-	// TODO Automatic migrations only in development
-	ctx := context.Background()
-	if os.Getenv("ENV") != "prod" {
-		if err := model.Client.Schema.Create(ctx,
-			migrate.WithDropIndex(true),
-			migrate.WithDropColumn(true)); err != nil {
-			return nil, err
-		}
+	// sql.Open doesn't connect with the database so we check that it's reachable
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not ping Postgres database: %v", err)
 	}
+	model.DB = db
+
+	model.Client = ent.NewClient(ent.Driver(&tracedDriver{Driver: entsql.OpenDB(dialect.Postgres, db)}))
 
 	return &model, nil
 }
 
+// SetPool changes the settings of the connection pool without closing the open connections
+func (m *Model) SetPool(pool PoolConfig) {
+	setPool(m.DB, pool)
+}
+
+func setPool(db *sql.DB, pool PoolConfig) {
+	db.SetMaxOpenConns(pool.MaxOpenConns)
+	db.SetMaxIdleConns(pool.MaxIdleConns)
+	db.SetConnMaxLifetime(pool.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(pool.ConnMaxIdleTime)
+}
+
+func (m *Model) Ping(ctx context.Context) error {
+	return m.DB.PingContext(ctx)
+}
+
 func (m *Model) Close() {
 	m.Client.Close()
 }
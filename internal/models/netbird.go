@@ -8,6 +8,6 @@ import (
 	"github.com/open-uem/ent/tenant"
 )
 
-func (m *Model) GetNetbirdSettings(tenantID int) (*ent.NetbirdSettings, error) {
-	return m.Client.NetbirdSettings.Query().Where(netbirdsettings.HasTenantWith(tenant.ID(tenantID))).Only(context.Background())
+func (m *Model) GetNetbirdSettings(ctx context.Context, tenantID int) (*ent.NetbirdSettings, error) {
+	return m.Client.NetbirdSettings.Query().Where(netbirdsettings.HasTenantWith(tenant.ID(tenantID))).Only(ctx)
 }
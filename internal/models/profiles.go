@@ -3,7 +3,7 @@ package models
 import (
 	"context"
 	"errors"
-	"log"
+	"log/slog"
 	"strconv"
 	"strings"
 	"time"
@@ -20,7 +20,7 @@ import (
 	"github.com/open-uem/nats"
 )
 
-func (m *Model) GetProfilesAppliedToAll(siteID int, tenantID int) ([]*ent.Profile, error) {
+func (m *Model) GetProfilesAppliedToAll(ctx context.Context, siteID int, tenantID int) ([]*ent.Profile, error) {
 	return m.Client.Profile.Query().WithTasks().
 		Where(
 			profile.DisabledEQ(false),
@@ -30,19 +30,19 @@ func (m *Model) GetProfilesAppliedToAll(siteID int, tenantID int) ([]*ent.Profil
 				profile.HasTenantWith(tenant.ID(tenantID)),
 				profile.HasSiteWith(site.ID(siteID)),
 			),
-		).All(context.Background())
+		).All(ctx)
 }
 
-func (m *Model) GetProfilesAppliedToAllFilteredByProfile(siteID int, profileID int) ([]*ent.Profile, error) {
+func (m *Model) GetProfilesAppliedToAllFilteredByProfile(ctx context.Context, siteID int, profileID int) ([]*ent.Profile, error) {
 	return m.Client.Profile.Query().WithTasks().Where(
 		profile.ID(profileID),
 		profile.DisabledEQ(false),
 		profile.ApplyToAll(true),
-	).All(context.Background())
+	).All(ctx)
 }
 
-func (m *Model) GetProfilesAppliedToAgent(siteID int, agentID string, tenantID int) ([]*ent.Profile, error) {
-	agent, err := m.Client.Agent.Query().WithTags().Where(agent.ID(agentID), agent.HasSiteWith(site.ID(siteID))).Only(context.Background())
+func (m *Model) GetProfilesAppliedToAgent(ctx context.Context, siteID int, agentID string, tenantID int) ([]*ent.Profile, error) {
+	agent, err := m.Client.Agent.Query().WithTags().Where(agent.ID(agentID), agent.HasSiteWith(site.ID(siteID))).Only(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -62,14 +62,14 @@ func (m *Model) GetProfilesAppliedToAgent(siteID int, agentID string, tenantID i
 				profile.HasTenantWith(tenant.ID(tenantID)),
 				profile.And(profile.Not(profile.HasTenant()), profile.Not(profile.HasSite())),
 			),
-		).All(context.Background())
+		).All(ctx)
 	}
 
 	return []*ent.Profile{}, nil
 }
 
-func (m *Model) GetProfilesAppliedToAgentFilteredByProfile(siteID int, agentID string, profileID int) ([]*ent.Profile, error) {
-	agent, err := m.Client.Agent.Query().WithTags().Where(agent.ID(agentID), agent.HasSiteWith(site.ID(siteID))).Only(context.Background())
+func (m *Model) GetProfilesAppliedToAgentFilteredByProfile(ctx context.Context, siteID int, agentID string, profileID int) ([]*ent.Profile, error) {
+	agent, err := m.Client.Agent.Query().WithTags().Where(agent.ID(agentID), agent.HasSiteWith(site.ID(siteID))).Only(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -81,19 +81,19 @@ func (m *Model) GetProfilesAppliedToAgentFilteredByProfile(siteID int, agentID s
 			tags = append(tags, tag.ID)
 		}
 
-		return m.Client.Profile.Query().WithTasks().Where(profile.ID(profileID), profile.DisabledEQ(false), profile.HasTagsWith(tag.IDIn(tags...))).All(context.Background())
+		return m.Client.Profile.Query().WithTasks().Where(profile.ID(profileID), profile.DisabledEQ(false), profile.HasTagsWith(tag.IDIn(tags...))).All(ctx)
 	}
 
 	return []*ent.Profile{}, nil
 }
 
-func (m *Model) SaveProfileApplicationIssues(p nats.ProfileReport) error {
+func (m *Model) SaveProfileApplicationIssues(ctx context.Context, p nats.ProfileReport) error {
 	var err error
 
 	exists := true
 	profileIssueID := -1
 	// Create issue or update the issue
-	profileIssue, err := m.Client.ProfileIssue.Query().Where(profileissue.HasProfileWith(profile.ID(p.ProfileID)), profileissue.HasAgentsWith(agent.ID(p.AgentID))).Only(context.Background())
+	profileIssue, err := m.Client.ProfileIssue.Query().Where(profileissue.HasProfileWith(profile.ID(p.ProfileID)), profileissue.HasAgentsWith(agent.ID(p.AgentID))).Only(ctx)
 	if err != nil {
 		if !ent.IsNotFound(err) {
 			return err
@@ -104,11 +104,11 @@ func (m *Model) SaveProfileApplicationIssues(p nats.ProfileReport) error {
 	}
 
 	if exists {
-		if err := m.Client.ProfileIssue.Update().Where(profileissue.ID(profileIssueID)).SetError(p.Error).Exec(context.Background()); err != nil {
+		if err := m.Client.ProfileIssue.Update().Where(profileissue.ID(profileIssueID)).SetError(p.Error).Exec(ctx); err != nil {
 			return err
 		}
 	} else {
-		profileIssue, err = m.Client.ProfileIssue.Create().SetError(p.Error).SetAgentsID(p.AgentID).SetProfileID(p.ProfileID).Save(context.Background())
+		profileIssue, err = m.Client.ProfileIssue.Create().SetError(p.Error).SetAgentsID(p.AgentID).SetProfileID(p.ProfileID).Save(ctx)
 		if err != nil {
 			return err
 		}
@@ -126,32 +126,32 @@ func (m *Model) SaveProfileApplicationIssues(p nats.ProfileReport) error {
 
 			taskExist := true
 
-			theTask, err := m.Client.Task.Query().Where(task.ID(taskID)).First(context.Background())
+			theTask, err := m.Client.Task.Query().Where(task.ID(taskID)).First(ctx)
 			if err != nil {
 				if ent.IsNotFound(err) {
 					taskExist = false
 				} else {
-					log.Printf("[ERROR]: could not check if profile task exists, reason: %v", err)
+					slog.Error("could not check if profile task exists", "error", err)
 					return err
 				}
 			}
 
 			if !taskExist {
-				log.Printf("[ERROR]: the task %d for profile %d, doesn't exist", taskID, profileIssueID)
+				slog.Error("the task for profile doesn't exist", "task_id", taskID, "profile_issue_id", profileIssueID)
 				continue
 			}
 
 			// if we have a task to install, update or delete a package we must try to update the deployment info
 			if theTask.Type == task.TypeFlatpakInstall || theTask.Type == task.TypeBrewCaskInstall || theTask.Type == task.TypeBrewFormulaInstall {
-				m.SetFlatpakOrBrewDeploymentInfo(taskID, p, report, theTask, "install")
+				m.SetFlatpakOrBrewDeploymentInfo(ctx, taskID, p, report, theTask, "install")
 			}
 
 			if theTask.Type == task.TypeBrewCaskUpgrade {
-				m.SetFlatpakOrBrewDeploymentInfo(taskID, p, report, theTask, "update")
+				m.SetFlatpakOrBrewDeploymentInfo(ctx, taskID, p, report, theTask, "update")
 			}
 
 			if theTask.Type == task.TypeFlatpakUninstall || theTask.Type == task.TypeBrewCaskUninstall || theTask.Type == task.TypeBrewFormulaUninstall {
-				m.SetFlatpakOrBrewDeploymentInfo(taskID, p, report, theTask, "uninstall")
+				m.SetFlatpakOrBrewDeploymentInfo(ctx, taskID, p, report, theTask, "uninstall")
 			}
 
 			exists, err := m.Client.TaskReport.Query().
@@ -159,10 +159,10 @@ func (m *Model) SaveProfileApplicationIssues(p nats.ProfileReport) error {
 					taskreport.HasProfileissueWith(profileissue.ID(profileIssueID)),
 					taskreport.HasTaskWith(task.ID(taskID)),
 				).
-				Exist(context.Background())
+				Exist(ctx)
 
 			if err != nil {
-				log.Printf("[ERROR]: could not check if profile issue exists, reason: %v", err)
+				slog.Error("could not check if profile issue exists", "error", err)
 				return err
 			}
 
@@ -176,9 +176,9 @@ func (m *Model) SaveProfileApplicationIssues(p nats.ProfileReport) error {
 					SetStdOutput(report.StdOut).
 					SetEnd(report.EndTime).
 					SetFailed(report.Failed).
-					Exec(context.Background())
+					Exec(ctx)
 				if err != nil {
-					log.Printf("[ERROR]: could not save task %d report for profile %d, reason: %v", taskID, profileIssueID, err)
+					slog.Error("could not save task report for profile", "task_id", taskID, "profile_issue_id", profileIssueID, "error", err)
 				}
 			} else {
 				err := m.Client.TaskReport.Create().
@@ -188,9 +188,9 @@ func (m *Model) SaveProfileApplicationIssues(p nats.ProfileReport) error {
 					SetStdOutput(report.StdOut).
 					SetEnd(report.EndTime).
 					SetFailed(report.Failed).
-					Exec(context.Background())
+					Exec(ctx)
 				if err != nil {
-					log.Printf("[ERROR]: could not save task %d report for profile %d, reason: %v", taskID, profileIssueID, err)
+					slog.Error("could not save task report for profile", "task_id", taskID, "profile_issue_id", profileIssueID, "error", err)
 				}
 			}
 		}
@@ -199,7 +199,7 @@ func (m *Model) SaveProfileApplicationIssues(p nats.ProfileReport) error {
 	return nil
 }
 
-func (m *Model) SetFlatpakOrBrewDeploymentInfo(taskID int, p nats.ProfileReport, report nats.TaskReport, t *ent.Task, action string) {
+func (m *Model) SetFlatpakOrBrewDeploymentInfo(ctx context.Context, taskID int, p nats.ProfileReport, report nats.TaskReport, t *ent.Task, action string) {
 	deployAction := nats.DeployAction{
 		Failed:          report.Failed,
 		PackageId:       t.PackageID,
@@ -224,7 +224,7 @@ func (m *Model) SetFlatpakOrBrewDeploymentInfo(taskID int, p nats.ProfileReport,
 		deployAction.Info = report.StdErr
 	}
 
-	if err := m.SaveFlatpakOrBrewDeployInfo(deployAction); err != nil {
-		log.Printf("[ERROR]: could not save deployment action for flatpak install task %d, reason: %v", taskID, err)
+	if err := m.SaveFlatpakOrBrewDeployInfo(ctx, deployAction); err != nil {
+		slog.Error("could not save deployment action for flatpak install task", "task_id", taskID, "error", err)
 	}
 }
@@ -5,8 +5,8 @@ import (
 	"time"
 )
 
-func (m *Model) AddRevocation(serial int64, reason int, info string, expiry time.Time) error {
-	_, err := m.Client.Revocation.Create().SetID(serial).SetReason(reason).SetInfo(info).SetExpiry(expiry).SetRevoked(time.Now()).Save(context.Background())
+func (m *Model) AddRevocation(ctx context.Context, serial int64, reason int, info string, expiry time.Time) error {
+	_, err := m.Client.Revocation.Create().SetID(serial).SetReason(reason).SetInfo(info).SetExpiry(expiry).SetRevoked(time.Now()).Save(ctx)
 	if err != nil {
 		return err
 	}
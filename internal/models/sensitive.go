@@ -0,0 +1,119 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/open-uem/ent/netbirdsettings"
+	"github.com/open-uem/ent/settings"
+	"github.com/open-uem/ent/task"
+)
+
+// SensitiveField is a column whose values are encrypted with the encryption master key
+type SensitiveField struct {
+	Table  string
+	Column string
+}
+
+func (f SensitiveField) String() string {
+	return f.Table + "." + f.Column
+}
+
+// SensitiveFields contains the columns that the console may encrypt, they must match the fields decrypted by the workers
+var SensitiveFields = []SensitiveField{
+	{Table: settings.Table, Column: settings.FieldSMTPPassword},
+	{Table: task.Table, Column: task.FieldLocalUserPassword},
+	{Table: task.Table, Column: task.FieldLocalUserSSHKeyPassphrase},
+	{Table: task.Table, Column: task.FieldMsiArguments},
+	{Table: task.Table, Column: task.FieldScript},
+	{Table: netbirdsettings.Table, Column: netbirdsettings.FieldAccessToken},
+}
+
+// ReencryptOptions tells ReencryptSensitiveFields how to encrypt the values again and where to report
+// the progress, Reencrypt returns the new value and if it has changed
+type ReencryptOptions struct {
+	Reencrypt func(v string) (string, bool, error)
+	Progress  func(field SensitiveField, done, total int)
+	DryRun    bool
+}
+
+// ReencryptSensitiveFields encrypts again the values of every sensitive field in a single transaction so
+// either all of them or none are changed, it returns the number of values changed per field
+func (m *Model) ReencryptSensitiveFields(ctx context.Context, opts ReencryptOptions) (map[SensitiveField]int, error) {
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	changed := map[SensitiveField]int{}
+	for _, f := range SensitiveFields {
+		n, err := reencryptField(ctx, tx, f, opts)
+		if err != nil {
+			return nil, fmt.Errorf("could not encrypt %s again, reason: %v", f, err)
+		}
+		changed[f] = n
+	}
+
+	if opts.DryRun {
+		return changed, nil
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return changed, nil
+}
+
+// reencryptField locks the rows of the field until the transaction ends, the table and column
+// names come from the ent schema so they're safe to use in the queries
+func reencryptField(ctx context.Context, tx *sql.Tx, f SensitiveField, opts ReencryptOptions) (int, error) {
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf(`SELECT id, %[2]s FROM %[1]s WHERE %[2]s IS NOT NULL AND %[2]s <> '' ORDER BY id FOR UPDATE`, f.Table, f.Column))
+	if err != nil {
+		return 0, err
+	}
+
+	type row struct {
+		id    int
+		value string
+	}
+	values := []row{}
+	for rows.Next() {
+		r := row{}
+		if err := rows.Scan(&r.id, &r.value); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		values = append(values, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	changed := 0
+	for i, r := range values {
+		v, ok, err := opts.Reencrypt(r.value)
+		if err != nil {
+			return 0, fmt.Errorf("row %d: %v", r.id, err)
+		}
+
+		if ok {
+			if _, err := tx.ExecContext(ctx, fmt.Sprintf(`UPDATE %s SET %s = $1 WHERE id = $2`, f.Table, f.Column), v, r.id); err != nil {
+				return 0, err
+			}
+			changed++
+		}
+
+		if opts.Progress != nil {
+			opts.Progress(f, i+1, len(values))
+		}
+	}
+
+	if opts.Progress != nil && len(values) == 0 {
+		opts.Progress(f, 0, 0)
+	}
+
+	return changed, nil
+}
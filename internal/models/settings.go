@@ -9,26 +9,26 @@ import (
 	"github.com/open-uem/ent/tenant"
 )
 
-func (m *Model) GetSettings(t string) (*ent.Settings, error) {
+func (m *Model) GetSettings(ctx context.Context, t string) (*ent.Settings, error) {
 	if t == "" {
-		return m.Client.Settings.Query().Where(settings.Not(settings.HasTenant())).Only(context.Background())
+		return m.Client.Settings.Query().Where(settings.Not(settings.HasTenant())).Only(ctx)
 	} else {
 		tenantID, err := strconv.Atoi(t)
 		if err != nil {
-			return m.Client.Settings.Query().Where(settings.Not(settings.HasTenant())).Only(context.Background())
+			return m.Client.Settings.Query().Where(settings.Not(settings.HasTenant())).Only(ctx)
 		}
 
-		s, err := m.Client.Settings.Query().Where(settings.HasTenantWith(tenant.ID(tenantID))).Only(context.Background())
+		s, err := m.Client.Settings.Query().Where(settings.HasTenantWith(tenant.ID(tenantID))).Only(ctx)
 		if err != nil {
-			return m.Client.Settings.Query().Where(settings.Not(settings.HasTenant())).Only(context.Background())
+			return m.Client.Settings.Query().Where(settings.Not(settings.HasTenant())).Only(ctx)
 		}
 		return s, nil
 	}
 }
 
-func (m *Model) GetSMTPSettings() (*ent.Settings, error) {
+func (m *Model) GetSMTPSettings(ctx context.Context) (*ent.Settings, error) {
 	return m.Client.Settings.Query().Where(settings.Not(settings.HasTenant())).
 		Select(settings.FieldSMTPAuth, settings.FieldSMTPPassword,
 			settings.FieldSMTPPort, settings.FieldSMTPServer,
-			settings.FieldSMTPUser, settings.FieldMessageFrom, settings.FieldSMTPEncryptionType).Only(context.Background())
+			settings.FieldSMTPUser, settings.FieldMessageFrom, settings.FieldSMTPEncryptionType).Only(ctx)
 }
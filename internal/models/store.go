@@ -0,0 +1,89 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"github.com/open-uem/ent"
+	"github.com/open-uem/ent/certificate"
+	"github.com/open-uem/nats"
+)
+
+// InventoryStore keeps the agents and the inventory they report
+type InventoryStore interface {
+	AgentExists(ctx context.Context, agentID string) (bool, error)
+	GetAgent(ctx context.Context, agentID string) (*ent.Agent, error)
+	GetAgentWithSite(ctx context.Context, agentID string) (*ent.Agent, error)
+	GetAgentWithNetbird(ctx context.Context, agentID string) (*ent.Agent, error)
+	GetTenantFromAgentID(ctx context.Context, request nats.RemoteConfigRequest) (int, error)
+	SaveAgentInfo(ctx context.Context, data *nats.AgentReport, servers string, autoAdmitAgents bool) error
+	SaveComputerInfo(ctx context.Context, data *nats.AgentReport) error
+	SaveOSInfo(ctx context.Context, data *nats.AgentReport) error
+	SaveAntivirusInfo(ctx context.Context, data *nats.AgentReport) error
+	SaveSystemUpdateInfo(ctx context.Context, data *nats.AgentReport) error
+	SaveAppsInfo(ctx context.Context, data *nats.AgentReport) error
+	SaveMonitorsInfo(ctx context.Context, data *nats.AgentReport) error
+	SaveMemorySlotsInfo(ctx context.Context, data *nats.AgentReport) error
+	SaveLogicalDisksInfo(ctx context.Context, data *nats.AgentReport) error
+	SavePhysicalDisksInfo(ctx context.Context, data *nats.AgentReport) error
+	SavePrintersInfo(ctx context.Context, data *nats.AgentReport) error
+	SaveNetworkAdaptersInfo(ctx context.Context, data *nats.AgentReport) error
+	SaveSharesInfo(ctx context.Context, data *nats.AgentReport) error
+	SaveUpdatesInfo(ctx context.Context, data *nats.AgentReport) error
+	SaveReleaseInfo(ctx context.Context, data *nats.AgentReport) error
+	SaveNetbirdInfo(ctx context.Context, data *nats.AgentReport) error
+}
+
+// DeploymentStore keeps the packages deployed to the agents
+type DeploymentStore interface {
+	SaveDeployInfo(ctx context.Context, data *nats.DeployAction) error
+	SaveWinGetDeployInfo(ctx context.Context, data nats.DeployAction) error
+	GetDeployedPackages(ctx context.Context, agentID string) ([]string, error)
+	GetExcludedWinGetPackages(ctx context.Context, agentID string) ([]string, error)
+	MarkPackageAsExcluded(ctx context.Context, data nats.DeployAction) error
+}
+
+// ProfileStore keeps the profiles applied to the agents and the issues reported when they're applied
+type ProfileStore interface {
+	GetProfilesAppliedToAll(ctx context.Context, siteID int, tenantID int) ([]*ent.Profile, error)
+	GetProfilesAppliedToAllFilteredByProfile(ctx context.Context, siteID int, profileID int) ([]*ent.Profile, error)
+	GetProfilesAppliedToAgent(ctx context.Context, siteID int, agentID string, tenantID int) ([]*ent.Profile, error)
+	GetProfilesAppliedToAgentFilteredByProfile(ctx context.Context, siteID int, agentID string, profileID int) ([]*ent.Profile, error)
+	SaveProfileApplicationIssues(ctx context.Context, p nats.ProfileReport) error
+}
+
+// CertificateStore keeps the certificates issued by the CA and the users they're sent to
+type CertificateStore interface {
+	SaveCertificate(ctx context.Context, serial int64, certType certificate.Type, uid, description string, expiry time.Time) error
+	RevokePreviousCertificates(ctx context.Context, description string) error
+	SetCertificateSent(ctx context.Context, uid string) error
+	SetEmailVerified(ctx context.Context, uid string) error
+}
+
+// SettingsStore keeps the general settings and the settings of each agent
+type SettingsStore interface {
+	GetSettings(ctx context.Context, t string) (*ent.Settings, error)
+	GetSMTPSettings(ctx context.Context) (*ent.Settings, error)
+	GetNetbirdSettings(ctx context.Context, tenantID int) (*ent.NetbirdSettings, error)
+	GetDefaultAgentFrequency(ctx context.Context, request nats.RemoteConfigRequest) (int, error)
+	GetWingetFrequency(ctx context.Context, request nats.RemoteConfigRequest) (int, error)
+	GetSFTPAgentSetting(ctx context.Context, request nats.RemoteConfigRequest) (bool, error)
+	SaveSFTPAgentSetting(ctx context.Context, request nats.RemoteConfigRequest, status bool) error
+	GetRemoteAssistanceAgentSetting(ctx context.Context, request nats.RemoteConfigRequest) (bool, error)
+	SaveRemoteAssistanceAgentSetting(ctx context.Context, request nats.RemoteConfigRequest, status bool) error
+}
+
+// Store is the storage used by the workers' handlers, Model implements it with Postgres
+// and the memory package with maps so the handlers can be run without a database
+type Store interface {
+	InventoryStore
+	DeploymentStore
+	ProfileStore
+	CertificateStore
+	SettingsStore
+	Ping(ctx context.Context) error
+	SetPool(pool PoolConfig)
+	Close()
+}
+
+var _ Store = (*Model)(nil)
@@ -0,0 +1,152 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"entgo.io/ent/dialect"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.41.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/open-uem/openuem-worker/internal/models"
+
+// tracedDriver creates a span for each statement sent to the database, the spans are
+// children of the span found in the context, e.g the span of the NATS message
+type tracedDriver struct {
+	dialect.Driver
+}
+
+func startSpan(ctx context.Context, query string) (context.Context, trace.Span) {
+	operation, _, _ := strings.Cut(strings.TrimSpace(query), " ")
+	operation = strings.ToUpper(operation)
+
+	return otel.Tracer(tracerName).Start(ctx, operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.DBSystemNamePostgreSQL,
+			semconv.DBOperationName(operation),
+			semconv.DBQueryText(query),
+		),
+	)
+}
+
+// startClientSpan starts a span for a call to an external service
+func startClientSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func (d *tracedDriver) Exec(ctx context.Context, query string, args, v any) error {
+	ctx, span := startSpan(ctx, query)
+	err := d.Driver.Exec(ctx, query, args, v)
+	endSpan(span, err)
+	return err
+}
+
+func (d *tracedDriver) Query(ctx context.Context, query string, args, v any) error {
+	ctx, span := startSpan(ctx, query)
+	err := d.Driver.Query(ctx, query, args, v)
+	endSpan(span, err)
+	return err
+}
+
+func (d *tracedDriver) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	drv, ok := d.Driver.(interface {
+		ExecContext(context.Context, string, ...any) (sql.Result, error)
+	})
+	if !ok {
+		return nil, fmt.Errorf("Driver.ExecContext is not supported")
+	}
+	ctx, span := startSpan(ctx, query)
+	res, err := drv.ExecContext(ctx, query, args...)
+	endSpan(span, err)
+	return res, err
+}
+
+func (d *tracedDriver) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	drv, ok := d.Driver.(interface {
+		QueryContext(context.Context, string, ...any) (*sql.Rows, error)
+	})
+	if !ok {
+		return nil, fmt.Errorf("Driver.QueryContext is not supported")
+	}
+	ctx, span := startSpan(ctx, query)
+	rows, err := drv.QueryContext(ctx, query, args...)
+	endSpan(span, err)
+	return rows, err
+}
+
+func (d *tracedDriver) Tx(ctx context.Context) (dialect.Tx, error) {
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "transaction", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.DBSystemNamePostgreSQL))
+	tx, err := d.Driver.Tx(ctx)
+	if err != nil {
+		endSpan(span, err)
+		return nil, err
+	}
+	return &tracedTx{Tx: tx, span: span}, nil
+}
+
+func (d *tracedDriver) BeginTx(ctx context.Context, opts *sql.TxOptions) (dialect.Tx, error) {
+	drv, ok := d.Driver.(interface {
+		BeginTx(context.Context, *sql.TxOptions) (dialect.Tx, error)
+	})
+	if !ok {
+		return nil, fmt.Errorf("Driver.BeginTx is not supported")
+	}
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "transaction", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.DBSystemNamePostgreSQL))
+	tx, err := drv.BeginTx(ctx, opts)
+	if err != nil {
+		endSpan(span, err)
+		return nil, err
+	}
+	return &tracedTx{Tx: tx, span: span}, nil
+}
+
+// tracedTx creates a span for each statement of the transaction, the transaction's
+// span ends when it's committed or rolled back
+type tracedTx struct {
+	dialect.Tx
+	span trace.Span
+}
+
+func (t *tracedTx) Exec(ctx context.Context, query string, args, v any) error {
+	ctx, span := startSpan(trace.ContextWithSpan(ctx, t.span), query)
+	err := t.Tx.Exec(ctx, query, args, v)
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedTx) Query(ctx context.Context, query string, args, v any) error {
+	ctx, span := startSpan(trace.ContextWithSpan(ctx, t.span), query)
+	err := t.Tx.Query(ctx, query, args, v)
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedTx) Commit() error {
+	err := t.Tx.Commit()
+	endSpan(t.span, err)
+	return err
+}
+
+func (t *tracedTx) Rollback() error {
+	err := t.Tx.Rollback()
+	t.span.SetAttributes(attribute.Bool("db.transaction.rolled_back", true))
+	endSpan(t.span, err)
+	return err
+}
@@ -7,10 +7,10 @@ import (
 	"github.com/open-uem/nats"
 )
 
-func (m *Model) SetCertificateSent(uid string) error {
-	return m.Client.User.Update().SetRegister(nats.REGISTER_CERTIFICATE_SENT).Where(user.ID(uid)).Exec(context.Background())
+func (m *Model) SetCertificateSent(ctx context.Context, uid string) error {
+	return m.Client.User.Update().SetRegister(nats.REGISTER_CERTIFICATE_SENT).Where(user.ID(uid)).Exec(ctx)
 }
 
-func (m *Model) SetEmailVerified(uid string) error {
-	return m.Client.User.Update().SetEmailVerified(true).Where(user.ID(uid)).Exec(context.Background())
+func (m *Model) SetEmailVerified(ctx context.Context, uid string) error {
+	return m.Client.User.Update().SetEmailVerified(true).Where(user.ID(uid)).Exec(ctx)
 }
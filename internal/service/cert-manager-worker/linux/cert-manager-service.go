@@ -3,7 +3,7 @@
 package main
 
 import (
-	"log"
+	"log/slog"
 	"os"
 	"os/signal"
 	"syscall"
@@ -19,18 +19,18 @@ func main() {
 	// Start Task Scheduler
 	w.TaskScheduler, err = gocron.NewScheduler()
 	if err != nil {
-		log.Fatalf("[FATAL]: could not create task scheduler, reason: %v", err)
-		return
+		slog.Error("could not create task scheduler", "error", err)
+		os.Exit(1)
 	}
 	w.TaskScheduler.Start()
-	log.Println("[INFO]: task scheduler has been started")
+	slog.Info("task scheduler has been started")
 
 	// Get config for service
 	if err := w.GenerateCertManagerWorkerConfig(); err != nil {
-		log.Printf("[ERROR]: could not generate config for cert-manager worker: %v", err)
+		slog.Error("could not generate config for cert-manager worker", "error", err)
 		if err := w.StartGenerateWorkerConfigJob("cert-manager-worker", true); err != nil {
-			log.Fatalf("[FATAL]: could not start generate config for worker: %v", err)
-			return
+			slog.Error("could not start generate config for worker", "error", err)
+			os.Exit(1)
 		}
 
 	}
@@ -40,7 +40,7 @@ func main() {
 	// Keep the connection alive
 	done := make(chan os.Signal, 1)
 	signal.Notify(done, syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
-	log.Println("[INFO]: the cert-manager worker is ready and waiting for requests")
+	slog.Info("the cert-manager worker is ready and waiting for requests")
 	<-done
 
 	w.StopWorker()
@@ -3,7 +3,8 @@
 package main
 
 import (
-	"log"
+	"log/slog"
+	"os"
 
 	"github.com/go-co-op/gocron/v2"
 	"github.com/open-uem/openuem-worker/internal/common"
@@ -20,18 +21,18 @@ func main() {
 	// Start Task Scheduler
 	w.TaskScheduler, err = gocron.NewScheduler()
 	if err != nil {
-		log.Fatalf("[FATAL]: could not create task scheduler, reason: %v", err)
-		return
+		slog.Error("could not create task scheduler", "error", err)
+		os.Exit(1)
 	}
 	w.TaskScheduler.Start()
-	log.Println("[INFO]: task scheduler has been started")
+	slog.Info("task scheduler has been started")
 
 	// Get config for service
 	if err := w.GenerateCommonWorkerConfig("notification-worker"); err != nil {
-		log.Printf("[ERROR]: could not generate config for notification worker: %v", err)
+		slog.Error("could not generate config for notification worker", "error", err)
 		if err := w.StartGenerateWorkerConfigJob("notification-worker", true); err != nil {
-			log.Fatalf("[FATAL]: could not start generate config for worker: %v", err)
-			return
+			slog.Error("could not start generate config for worker", "error", err)
+			os.Exit(1)
 		}
 	}
 
@@ -40,6 +41,6 @@ func main() {
 
 	// Run service
 	if err := svc.Run("openuem-notification-worker", s); err != nil {
-		log.Printf("[ERROR]: could not run service: %v", err)
+		slog.Error("could not run service", "error", err)
 	}
 }
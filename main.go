@@ -1,7 +1,7 @@
 package main
 
 import (
-	"log"
+	"log/slog"
 	"os"
 
 	"github.com/open-uem/openuem-worker/internal/commands"
@@ -18,7 +18,8 @@ func main() {
 	}
 
 	if err := app.Run(os.Args); err != nil {
-		log.Fatal(err)
+		slog.Error("could not run the worker", "error", err)
+		os.Exit(1)
 	}
 }
 
@@ -27,6 +28,13 @@ func getCommands() []*cli.Command {
 		commands.AgentWorker(),
 		commands.CertManagerWorker(),
 		commands.NotificationsWorker(),
+		commands.Workers(),
 		commands.HealthCheck(),
+		commands.Status(),
+		commands.DeadLetters(),
+		commands.Migrate(),
+		commands.Secrets(),
+		commands.Replay(),
+		commands.Config(),
 	}
 }